@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"ruslanlesko/brightonum/src/crypto"
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+// requireOwner returns token owner if the token is valid and belongs to the user with given id
+func (s *AuthService) requireOwner(ctx context.Context, token string, id int) (*st.User, error) {
+	u, err := s.validateToken(ctx, token)
+	if err != nil {
+		return nil, mapDaoError(err)
+	}
+	if u == nil || u.ID != id {
+		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
+	}
+	return u, nil
+}
+
+// usernamePattern allows 3 to 32 letters, digits, dots, dashes and underscores starting with a letter or digit
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{2,31}$`)
+
+// validatePassword checks new password of the user against password policy
+func (s *AuthService) validatePassword(u *st.User, password string) error {
+	minLength := s.Config.PasswordMinLength
+	if minLength < 1 {
+		minLength = 1
+	}
+	if utf8.RuneCountInString(password) < minLength {
+		return st.AuthError{Msg: fmt.Sprintf("Password must be at least %d characters long", minLength), Status: 400}
+	}
+	maxBytes := crypto.MaxPasswordBytes()
+	if len(password) > maxBytes {
+		return st.AuthError{Msg: fmt.Sprintf("Password must be at most %d bytes long", maxBytes), Status: 400}
+	}
+	if strings.EqualFold(password, u.Username) || strings.EqualFold(password, u.Email) {
+		return st.AuthError{Msg: "Password must not match username or email", Status: 400}
+	}
+	return nil
+}
+
+// ChangePassword replaces password of the user given the current one.
+// If other sessions are revoked, all previously issued tokens stop working
+// and new access and refresh tokens for the caller are returned.
+func (s *AuthService) ChangePassword(ctx context.Context, token string, id int, currentPassword string, newPassword string, revokeOtherSessions bool) (string, string, error) {
+	u, err := s.requireOwner(ctx, token, id)
+	if err != nil {
+		return "", "", err
+	}
+
+	if !crypto.Match(currentPassword, u.Password) {
+		return "", "", st.AuthError{Msg: "Password is wrong", Status: 403}
+	}
+	err = s.validatePassword(u, newPassword)
+	if err != nil {
+		return "", "", err
+	}
+
+	hashedPassword, err := crypto.Hash(newPassword)
+	if err != nil {
+		logger.Logf("ERROR Failed to hash password, %s", err.Error())
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	err = s.UserDao.ResetPassword(ctx, id, hashedPassword)
+	if err != nil {
+		return "", "", mapDaoError(err)
+	}
+
+	accessToken, refreshToken := "", ""
+	if revokeOtherSessions {
+		err = s.revokeSessions(ctx, id)
+		if err != nil {
+			return "", "", err
+		}
+		accessToken, err = s.issueAccessToken(ctx, u)
+		if err != nil {
+			return "", "", err
+		}
+		refreshToken, err = s.issueRefreshToken(ctx, u)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	if u.Email != "" {
+		err = s.Mailer.SendPasswordChangedNotice(u.Email)
+		if err != nil {
+			logger.Logf("ERROR Password change notice was not sent: %s", err.Error())
+		}
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// ChangeUsername changes username of the user. Previous username stays reserved for the user
+// during reservation period and tokens issued before the change keep working.
+func (s *AuthService) ChangeUsername(ctx context.Context, token string, id int, username string) error {
+	u, err := s.requireOwner(ctx, token, id)
+	if err != nil {
+		return err
+	}
+
+	if !usernamePattern.MatchString(username) {
+		return st.AuthError{Msg: "Username must be 3 to 32 letters, digits, dots, dashes or underscores", Status: 400}
+	}
+	if strings.EqualFold(username, u.Username) {
+		return st.AuthError{Msg: "Username is the same as current one", Status: 400}
+	}
+
+	err = s.UserDao.ChangeUsername(ctx, id, username, time.Now().Add(s.Config.UsernameReservation))
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	logger.Logf("INFO User %d changed username from %s to %s", id, u.Username, strings.ToLower(username))
+	return nil
+}
+
+// RequestEmailChange starts change of user email. Confirmation code is sent to the new address
+// and the current one is notified, email is changed only after ConfirmEmailChange.
+// New address must satisfy registration policy, so it can not be used to bypass it.
+func (s *AuthService) RequestEmailChange(ctx context.Context, token string, id int, newEmail string, password string) error {
+	u, err := s.requireOwner(ctx, token, id)
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(newEmail, "@") {
+		return st.AuthError{Msg: "Invalid email", Status: 400}
+	}
+	if !crypto.Match(password, u.Password) {
+		return st.AuthError{Msg: "Password is wrong", Status: 403}
+	}
+	if strings.EqualFold(newEmail, u.Email) {
+		return st.AuthError{Msg: "Email is the same as current one", Status: 400}
+	}
+	err = s.checkRegistrationPolicy(newEmail)
+	if err != nil {
+		return err
+	}
+
+	existing, err := s.UserDao.GetByEmail(ctx, newEmail)
+	if err != nil && !errors.Is(err, dao.ErrNotFound) {
+		return mapDaoError(err)
+	}
+	if existing != nil && existing.Username != "" {
+		return st.AuthError{Msg: "Email already exists", Status: 409}
+	}
+
+	code, err := s.newCode(codeEmailChange)
+	if err != nil {
+		return err
+	}
+
+	change := st.EmailChange{Email: newEmail, CodeHash: crypto.HashCode(code), ExpiresAt: time.Now().Add(s.Config.EmailChangeExpiration).UTC()}
+	err = s.UserDao.SetEmailChange(ctx, id, &change)
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	if u.Email != "" {
+		err = s.Mailer.SendEmailChangeNotice(u.Email)
+		if err != nil {
+			logger.Logf("ERROR Email was not sent: " + err.Error())
+			return st.AuthError{Msg: err.Error(), Status: 500}
+		}
+	}
+
+	err = s.Mailer.SendEmailChangeCode(newEmail, code)
+	if err != nil {
+		logger.Logf("ERROR Email was not sent: " + err.Error())
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	return nil
+}
+
+// ConfirmEmailChange replaces user email with the pending one if the code matches
+func (s *AuthService) ConfirmEmailChange(ctx context.Context, token string, id int, code string) error {
+	u, err := s.requireOwner(ctx, token, id)
+	if err != nil {
+		return err
+	}
+
+	change := u.EmailChange
+	if change == nil || time.Now().After(change.ExpiresAt) {
+		return st.AuthError{Msg: "Email change was not requested or has expired", Status: 404}
+	}
+	if code == "" || !crypto.MatchCode(code, change.CodeHash) {
+		return st.AuthError{Msg: "Confirmation code does not match", Status: 403}
+	}
+
+	err = s.UserDao.ChangeEmail(ctx, id, change.Email)
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	logger.Logf("INFO Email of user %d is changed", id)
+	return nil
+}
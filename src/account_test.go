@@ -0,0 +1,288 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"ruslanlesko/brightonum/src/crypto"
+	"ruslanlesko/brightonum/src/dao"
+	"ruslanlesko/brightonum/src/email"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+func TestAuthService_RequestEmailChange(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+	newEmail := "new@email.com"
+	conf := createTestConfig()
+	conf.EmailChangeExpiration = time.Hour
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetByEmail", newEmail).Return(nil, dao.ErrNotFound)
+	userDao.On("SetEmailChange", user.ID, mock.MatchedBy(func(c *st.EmailChange) bool {
+		return c.Email == newEmail && c.CodeHash != "" && c.ExpiresAt.After(time.Now().Add(59*time.Minute))
+	})).Return(nil)
+
+	mailer := email.MailerMock{}
+	mailer.On("SendEmailChangeNotice", user.Email).Return(nil)
+	mailer.On("SendEmailChangeCode", newEmail, mock.MatchedBy(func(code string) bool { return len(code) == 6 })).Return(nil)
+
+	s := AuthService{&mailer, &userDao, conf}
+
+	err := s.RequestEmailChange(ctx, token, user.ID, newEmail, "oakheart")
+	assert.Nil(t, err)
+	userDao.AssertExpectations(t)
+	mailer.AssertExpectations(t)
+}
+
+func TestAuthService_RequestEmailChange_Rejected(t *testing.T) {
+	user := createTestUser()
+	other := createAnotherTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetByEmail", "taken@email.com").Return(&other, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.RequestEmailChange(ctx, token, other.ID, "new@email.com", "oakheart")
+	assert.Equal(t, st.AuthError{Msg: "Invalid token", Status: 401}, err)
+
+	err = s.RequestEmailChange(ctx, token, user.ID, "new@email.com", "wrong")
+	assert.Equal(t, st.AuthError{Msg: "Password is wrong", Status: 403}, err)
+
+	err = s.RequestEmailChange(ctx, token, user.ID, "not an email", "oakheart")
+	assert.Equal(t, st.AuthError{Msg: "Invalid email", Status: 400}, err)
+
+	err = s.RequestEmailChange(ctx, token, user.ID, "taken@email.com", "oakheart")
+	assert.Equal(t, st.AuthError{Msg: "Email already exists", Status: 409}, err)
+
+	userDao.AssertNotCalled(t, "SetEmailChange", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_RequestEmailChange_RegistrationPolicy(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	conf := createTestConfig()
+	conf.AllowedDomains = []string{"email.com", "hollywoo.org"}
+	conf.BlockedDomains = []string{"spam.email.com"}
+	conf.disposableDomains = map[string]bool{"hollywoo.org": true}
+	s := AuthService{&mailer, &userDao, conf}
+
+	err := s.RequestEmailChange(ctx, token, user.ID, "alle@example.com", "oakheart")
+	assert.Equal(t, st.AuthError{Msg: "Registration with email domain example.com is not allowed", Status: 403, Code: st.CodeEmailDomainNotAllowed}, err)
+
+	err = s.RequestEmailChange(ctx, token, user.ID, "alle@spam.email.com", "oakheart")
+	assert.Equal(t, st.AuthError{Msg: "Registration with email domain spam.email.com is not allowed", Status: 403, Code: st.CodeEmailDomainNotAllowed}, err)
+
+	err = s.RequestEmailChange(ctx, token, user.ID, "alle@hollywoo.org", "oakheart")
+	assert.Equal(t, st.AuthError{Msg: "Disposable email addresses are not allowed", Status: 403, Code: st.CodeDisposableEmail}, err)
+
+	userDao.AssertNotCalled(t, "GetByEmail", mock.Anything)
+	userDao.AssertNotCalled(t, "SetEmailChange", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_ConfirmEmailChange(t *testing.T) {
+	user := createTestUser()
+	user.EmailChange = &st.EmailChange{Email: "new@email.com", CodeHash: hashedCode, ExpiresAt: time.Now().Add(time.Hour)}
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("ChangeEmail", user.ID, "new@email.com").Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.ConfirmEmailChange(ctx, token, user.ID, "000000")
+	assert.Equal(t, st.AuthError{Msg: "Confirmation code does not match", Status: 403}, err)
+
+	err = s.ConfirmEmailChange(ctx, token, user.ID, code)
+	assert.Nil(t, err)
+	userDao.AssertNumberOfCalls(t, "ChangeEmail", 1)
+}
+
+func TestAuthService_ConfirmEmailChange_Expired(t *testing.T) {
+	user := createTestUser()
+	user.EmailChange = &st.EmailChange{Email: "new@email.com", CodeHash: hashedCode, ExpiresAt: time.Now().Add(-time.Minute)}
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.ConfirmEmailChange(ctx, token, user.ID, code)
+	assert.Equal(t, st.AuthError{Msg: "Email change was not requested or has expired", Status: 404}, err)
+	userDao.AssertNotCalled(t, "ChangeEmail", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_ConfirmEmailChange_TakenMeanwhile(t *testing.T) {
+	user := createTestUser()
+	user.EmailChange = &st.EmailChange{Email: "new@email.com", CodeHash: hashedCode, ExpiresAt: time.Now().Add(time.Hour)}
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("ChangeEmail", user.ID, "new@email.com").Return(dao.ErrDuplicateEmail)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.ConfirmEmailChange(ctx, token, user.ID, code)
+	assert.Equal(t, st.AuthError{Msg: "Email already exists", Status: 409}, err)
+}
+
+func TestAuthService_ChangePassword(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("ResetPassword", user.ID, mock.MatchedBy(func(hash string) bool { return crypto.Match("n3w-secret", hash) })).Return(nil)
+
+	mailer := email.MailerMock{}
+	mailer.On("SendPasswordChangedNotice", user.Email).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	accessToken, refreshToken, err := s.ChangePassword(ctx, token, user.ID, "oakheart", "n3w-secret", false)
+	assert.Nil(t, err)
+	assert.Empty(t, accessToken)
+	assert.Empty(t, refreshToken)
+	userDao.AssertNotCalled(t, "RevokeTokens", mock.Anything, mock.Anything)
+	mailer.AssertExpectations(t)
+}
+
+func TestAuthService_ChangePassword_RevokeOtherSessions(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetByUUID", user.UUID).Return(&user, nil)
+	userDao.On("ResetPassword", user.ID, mock.Anything).Return(nil)
+	userDao.On("RevokeTokens", user.ID, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		revokedAt := args.Get(1).(time.Time)
+		user.TokensRevokedAt = &revokedAt
+	})
+
+	mailer := email.MailerMock{}
+	mailer.On("SendPasswordChangedNotice", user.Email).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	accessToken, refreshToken, err := s.ChangePassword(ctx, token, user.ID, "oakheart", "n3w-secret", true)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, accessToken)
+	assert.NotEmpty(t, refreshToken)
+
+	owner, err := s.validateToken(ctx, accessToken)
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, owner.ID)
+
+	owner, err = s.validateToken(ctx, token)
+	assert.Nil(t, err)
+	assert.Nil(t, owner)
+}
+
+func TestAuthService_ChangePassword_Rejected(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+	conf := createTestConfig()
+	conf.PasswordMinLength = 8
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := AuthService{&mailer, &userDao, conf}
+
+	_, _, err := s.ChangePassword(ctx, token, user.ID, "wrong", "n3w-secret", false)
+	assert.Equal(t, st.AuthError{Msg: "Password is wrong", Status: 403}, err)
+
+	_, _, err = s.ChangePassword(ctx, token, user.ID, "oakheart", "short", false)
+	assert.Equal(t, st.AuthError{Msg: "Password must be at least 8 characters long", Status: 400}, err)
+
+	_, _, err = s.ChangePassword(ctx, token, user.ID, "oakheart", strings.Repeat("x", 73), false)
+	assert.Equal(t, st.AuthError{Msg: "Password must be at most 72 bytes long", Status: 400}, err)
+
+	_, _, err = s.ChangePassword(ctx, token, user.ID, "oakheart", "TEST@email.com", false)
+	assert.Equal(t, st.AuthError{Msg: "Password must not match username or email", Status: 400}, err)
+
+	userDao.AssertNotCalled(t, "ResetPassword", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_ChangeUsername(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+	conf := createTestConfig()
+	conf.UsernameReservation = 24 * time.Hour
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("ChangeUsername", user.ID, "bojack", mock.MatchedBy(func(until time.Time) bool {
+		return until.After(time.Now().Add(23 * time.Hour))
+	})).Return(nil)
+	userDao.On("ChangeUsername", user.ID, "sarah", mock.Anything).Return(dao.ErrDuplicateUsername)
+
+	s := AuthService{&mailer, &userDao, conf}
+
+	err := s.ChangeUsername(ctx, token, user.ID, "bojack")
+	assert.Nil(t, err)
+
+	err = s.ChangeUsername(ctx, token, user.ID, "sarah")
+	assert.Equal(t, st.AuthError{Msg: "Username already exists", Status: 409}, err)
+
+	err = s.ChangeUsername(ctx, token, user.ID, "no spaces")
+	assert.Equal(t, st.AuthError{Msg: "Username must be 3 to 32 letters, digits, dots, dashes or underscores", Status: 400}, err)
+
+	err = s.ChangeUsername(ctx, token, user.ID, "ALLE")
+	assert.Equal(t, st.AuthError{Msg: "Username is the same as current one", Status: 400}, err)
+}
+
+func TestAuthService_TokenAfterUsernameChange(t *testing.T) {
+	user := createTestUser()
+	user.Username = "bojack"
+	accessToken := issueTestToken(user.ID, "alle", createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "alle").Return(nil, dao.ErrNotFound)
+	userDao.On("Get", user.ID).Return(&user, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	owner, err := s.validateToken(ctx, accessToken)
+	assert.Nil(t, err)
+	assert.Equal(t, &user, owner)
+
+	legacyRefreshToken := issueTestTokenWithClaims(jwt.MapClaims{"sub": "alle", "exp": time.Now().Add(time.Hour).Unix()}, createTestConfig().PrivKeyPath)
+	userDao.On("GetUsernameHolder", "alle").Return(user.ID, nil)
+
+	refreshed, err := s.RefreshToken(ctx, legacyRefreshToken)
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(refreshed, "sub", user.UUID))
+}
+
+func TestAuthService_TokenOfPreviousUsernameOwner(t *testing.T) {
+	newOwner := createAnotherTestUser()
+	newOwner.Username = "alle"
+	token := issueTestToken(42, "alle", createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "alle").Return(&newOwner, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	owner, err := s.validateToken(ctx, token)
+	assert.Nil(t, err)
+	assert.Nil(t, owner)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"ruslanlesko/brightonum/src/crypto"
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+// requireAdmin returns token owner if the token is valid and belongs to an admin
+func (s *AuthService) requireAdmin(ctx context.Context, token string) (*st.User, error) {
+	u, err := s.validateToken(ctx, token)
+	if err != nil {
+		return nil, mapDaoError(err)
+	}
+	if u == nil {
+		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
+	}
+	if !contains(s.Config.AdminIDs, u.ID) {
+		return nil, st.AuthError{Msg: "Available only for admin", Status: 403}
+	}
+	return u, nil
+}
+
+// audit records admin action. Failure to record does not undo the action, so it is only logged.
+func (s *AuthService) audit(ctx context.Context, admin *st.User, action string, targetID int, details string) {
+	logger.Logf("INFO Admin %d performed %s on user %d", admin.ID, action, targetID)
+
+	record := st.AuditRecord{ActorID: admin.ID, Action: action, TargetID: targetID, Details: details, At: time.Now().UTC()}
+	err := s.UserDao.SaveAuditRecord(ctx, &record)
+	if err != nil {
+		logger.Logf("ERROR Failed to record %s by admin %d: %s", action, admin.ID, err.Error())
+	}
+}
+
+// AdminCreateUser creates verified user without invite
+func (s *AuthService) AdminCreateUser(ctx context.Context, token string, u *st.User) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if u.Username == "" || u.Password == "" {
+		return st.AuthError{Msg: "Username and password are required", Status: 400}
+	}
+	err = validateMembership(u.Roles, u.Organization)
+	if err != nil {
+		return err
+	}
+	err = s.validatePassword(u, u.Password)
+	if err != nil {
+		return err
+	}
+	err = s.checkAttributes(ctx, u, true, true)
+	if err != nil {
+		return err
+	}
+
+	alreadyExists, err := s.usernameExists(ctx, u.Username)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	if alreadyExists {
+		return st.AuthError{Msg: "Username already exists", Status: 409}
+	}
+
+	hashedPassword, err := crypto.Hash(u.Password)
+	if err != nil {
+		logger.Logf("ERROR Failed to hash password, %s", err.Error())
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	u.ID = 0
+	u.Password = hashedPassword
+	u.InviteCode = ""
+	u.InviteExpiresAt = nil
+	u.VerificationCode = ""
+	ID, err := s.UserDao.Save(ctx, u)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	u.ID = ID
+
+	s.audit(ctx, admin, st.AuditCreateUser, ID, "")
+	return nil
+}
+
+// AdminUpdateUser updates profile fields of any user
+func (s *AuthService) AdminUpdateUser(ctx context.Context, token string, u *st.User) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if !validateUpdatePayload(u) {
+		return st.AuthError{Msg: "Invalid Update payload", Status: 400}
+	}
+	err = s.checkAttributes(ctx, u, false, true)
+	if err != nil {
+		return err
+	}
+
+	err = s.UserDao.Update(ctx, u)
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	s.audit(ctx, admin, st.AuditUpdateUser, u.ID, "fields: "+strings.Join(updatedFields(u), ","))
+	return nil
+}
+
+// updatedFields lists profile fields which update payload changes
+func updatedFields(u *st.User) []string {
+	fields := []string{}
+	if u.FirstName != "" {
+		fields = append(fields, "firstName")
+	}
+	if u.LastName != "" {
+		fields = append(fields, "lastName")
+	}
+	if u.Email != "" {
+		fields = append(fields, "email")
+	}
+	attributes := []string{}
+	for name := range u.Attributes {
+		attributes = append(attributes, "attributes."+name)
+	}
+	sort.Strings(attributes)
+	return append(fields, attributes...)
+}
+
+// AdminSetPassword replaces password of any user, the password has to satisfy password policy.
+// Tokens issued to the user before are revoked.
+func (s *AuthService) AdminSetPassword(ctx context.Context, token string, id int, password string) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if password == "" {
+		return st.AuthError{Msg: "Password is missing", Status: 400}
+	}
+	u, err := s.UserDao.Get(ctx, id)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	err = s.validatePassword(u, password)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := crypto.Hash(password)
+	if err != nil {
+		logger.Logf("ERROR Failed to hash password, %s", err.Error())
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	err = s.UserDao.ResetPassword(ctx, id, hashedPassword)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	err = s.revokeSessions(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	s.audit(ctx, admin, st.AuditSetPassword, id, "")
+	return nil
+}
+
+// revokeSessions makes all tokens issued to the user so far stop working
+func (s *AuthService) revokeSessions(ctx context.Context, id int) error {
+	// Token issue time has second precision, so tokens issued right after revocation stay valid
+	err := s.UserDao.RevokeTokens(ctx, id, time.Now().Truncate(time.Second))
+	if err != nil {
+		return mapDaoError(err)
+	}
+	return nil
+}
+
+// AdminForcePasswordReset invalidates password and tokens of the user and emails password recovery code,
+// so the user has to set a new password through the recovery flow
+func (s *AuthService) AdminForcePasswordReset(ctx context.Context, token string, id int) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	u, err := s.UserDao.Get(ctx, id)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	if u.Email == "" {
+		return st.AuthError{Msg: "User has no email", Status: 400}
+	}
+
+	code, err := s.newCode(codeRecovery)
+	if err != nil {
+		return err
+	}
+
+	err = s.UserDao.ResetPassword(ctx, id, "")
+	if err != nil {
+		return mapDaoError(err)
+	}
+	err = s.revokeSessions(ctx, id)
+	if err != nil {
+		return err
+	}
+	s.audit(ctx, admin, st.AuditForceReset, id, "")
+
+	// Admin is not throttled, the code replaces any previous one
+	err = s.UserDao.SetRecoveryCode(ctx, id, crypto.HashCode(code), time.Now())
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	err = s.Mailer.SendRecoveryCode(u.Email, code)
+	if err != nil {
+		logger.Logf("ERROR Email was not sent: " + err.Error())
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return nil
+}
+
+// AdminVerifyEmail marks email of the user as verified
+func (s *AuthService) AdminVerifyEmail(ctx context.Context, token string, id int) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	err = s.UserDao.ClearVerificationCode(ctx, id)
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	s.audit(ctx, admin, st.AuditVerifyEmail, id, "")
+	return nil
+}
+
+// AdminSetStatus changes account status of the user.
+// Suspended and disabled users can not log in and their tokens are rejected.
+func (s *AuthService) AdminSetStatus(ctx context.Context, token string, id int, status st.AccountStatus) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	var action string
+	switch status.Status {
+	case st.StatusActive:
+		action = st.AuditEnableUser
+	case st.StatusSuspended:
+		action = st.AuditSuspendUser
+	case st.StatusDisabled:
+		action = st.AuditDisableUser
+	default:
+		return st.AuthError{Msg: "Unknown status", Status: 400}
+	}
+
+	if status.Status != st.StatusSuspended {
+		status.Reason = ""
+		status.Until = nil
+	}
+	if status.Until != nil && !status.Until.After(time.Now()) {
+		return st.AuthError{Msg: "Suspension end must be in the future", Status: 400}
+	}
+	if status.Status != st.StatusActive && admin.ID == id {
+		return st.AuthError{Msg: "Admin can not block themselves", Status: 400}
+	}
+
+	err = s.UserDao.SetStatus(ctx, id, status)
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	details := status.Reason
+	if status.Until != nil {
+		details = "until " + status.Until.UTC().Format(time.RFC3339) + " " + details
+	}
+	s.audit(ctx, admin, action, id, strings.TrimSpace(details))
+	return nil
+}
+
+// AdminDeleteUser deletes any user, the user can be restored until purged
+func (s *AuthService) AdminDeleteUser(ctx context.Context, token string, id int) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	err = s.UserDao.DeleteById(ctx, id)
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	s.audit(ctx, admin, st.AuditDeleteUser, id, "")
+	return nil
+}
+
+// AdminRestoreUser restores deleted user which has not been purged yet
+func (s *AuthService) AdminRestoreUser(ctx context.Context, token string, id int) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	err = s.UserDao.Restore(ctx, id)
+	if errors.Is(err, dao.ErrNotFound) {
+		return st.AuthError{Msg: "Deleted user does not exist", Status: 404}
+	}
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	s.audit(ctx, admin, st.AuditRestoreUser, id, "")
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+func TestAuthService_AdminCreateUser(t *testing.T) {
+	admin := createTestUser()
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+	u := st.User{Username: "sarah", Email: "sarah@email.com", Password: "oakheart", InviteCode: "123", VerificationCode: "4567"}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("Save", mock.MatchedBy(func(saved *st.User) bool {
+		return saved.Username == "sarah" && saved.InviteCode == "" && saved.VerificationCode == "" && saved.Password != "oakheart"
+	})).Return(43, nil)
+	userDao.On("SaveAuditRecord", mock.MatchedBy(func(r *st.AuditRecord) bool {
+		return r.ActorID == admin.ID && r.Action == st.AuditCreateUser && r.TargetID == 43
+	})).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.AdminCreateUser(ctx, token, &u)
+	assert.Nil(t, err)
+	assert.Equal(t, 43, u.ID)
+	userDao.AssertExpectations(t)
+}
+
+func TestAuthService_AdminCreateUser_NotAdmin(t *testing.T) {
+	u := createAnotherTestUser()
+	token := issueTestToken(u.ID, u.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(&u, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.AdminCreateUser(ctx, token, &st.User{Username: "sarah", Password: "oakheart"})
+	assert.Equal(t, st.AuthError{Msg: "Available only for admin", Status: 403}, err)
+	userDao.AssertNotCalled(t, "Save", mock.Anything)
+}
+
+func TestAuthService_AdminUpdateUser(t *testing.T) {
+	admin := createTestUser()
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+	payload := st.User{ID: 43, LastName: "Lynn", Email: "sarah@email.com"}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("Update", &payload).Return(nil)
+	userDao.On("SaveAuditRecord", mock.MatchedBy(func(r *st.AuditRecord) bool {
+		return r.Action == st.AuditUpdateUser && r.TargetID == 43 && r.Details == "fields: lastName,email"
+	})).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.AdminUpdateUser(ctx, token, &payload)
+	assert.Nil(t, err)
+	userDao.AssertExpectations(t)
+}
+
+func TestAuthService_AdminUpdateUser_DuplicateEmail(t *testing.T) {
+	admin := createTestUser()
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+	payload := st.User{ID: 43, Email: "test@email.com"}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("Update", &payload).Return(dao.ErrDuplicateEmail)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.AdminUpdateUser(ctx, token, &payload)
+	assert.Equal(t, st.AuthError{Msg: "Email already exists", Status: 409}, err)
+	userDao.AssertNotCalled(t, "SaveAuditRecord", mock.Anything)
+}
+
+func TestAuthService_AdminSetPassword(t *testing.T) {
+	admin := createTestUser()
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+
+	target := createAnotherTestUser()
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("Get", target.ID).Return(&target, nil)
+	userDao.On("ResetPassword", target.ID, mock.MatchedBy(func(hash string) bool { return hash != "" && hash != "secret" })).Return(nil)
+	userDao.On("RevokeTokens", target.ID, mock.AnythingOfType("time.Time")).Return(nil)
+	userDao.On("SaveAuditRecord", mock.Anything).Return(nil)
+
+	conf := createTestConfig()
+	conf.PasswordMinLength = 6
+	s := AuthService{&mailer, &userDao, conf}
+
+	err := s.AdminSetPassword(ctx, token, target.ID, "secret")
+	assert.Nil(t, err)
+
+	err = s.AdminSetPassword(ctx, token, target.ID, "")
+	assert.Equal(t, st.AuthError{Msg: "Password is missing", Status: 400}, err)
+	err = s.AdminSetPassword(ctx, token, target.ID, "short")
+	assert.Equal(t, st.AuthError{Msg: "Password must be at least 6 characters long", Status: 400}, err)
+	err = s.AdminSetPassword(ctx, token, target.ID, target.Email)
+	assert.Equal(t, st.AuthError{Msg: "Password must not match username or email", Status: 400}, err)
+	userDao.AssertNumberOfCalls(t, "ResetPassword", 1)
+	userDao.AssertNumberOfCalls(t, "RevokeTokens", 1)
+}
+
+func TestAuthService_AdminForcePasswordReset(t *testing.T) {
+	admin := createTestUser()
+	target := createAnotherTestUser()
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("Get", target.ID).Return(&target, nil)
+	userDao.On("ResetPassword", target.ID, "").Return(nil)
+	userDao.On("RevokeTokens", target.ID, mock.AnythingOfType("time.Time")).Return(nil)
+	userDao.On("SetRecoveryCode", target.ID, mock.MatchedBy(func(hash string) bool { return hash != "" }), mock.Anything).Return(nil)
+	userDao.On("SaveAuditRecord", mock.Anything).Return(nil)
+	mailer.On("SendRecoveryCode", target.Email, mock.MatchedBy(func(code string) bool { return len(code) == 6 })).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.AdminForcePasswordReset(ctx, token, target.ID)
+	assert.Nil(t, err)
+	userDao.AssertExpectations(t)
+}
+
+func TestAuthService_AdminSetStatus(t *testing.T) {
+	admin := createTestUser()
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+	until := time.Now().Add(time.Hour)
+	suspension := st.AccountStatus{Status: st.StatusSuspended, Reason: "spam", Until: &until}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("SetStatus", 43, st.AccountStatus{Status: st.StatusDisabled}).Return(nil)
+	userDao.On("SetStatus", 43, suspension).Return(nil)
+	userDao.On("SetStatus", 44, st.AccountStatus{Status: st.StatusActive}).Return(dao.ErrNotFound)
+	userDao.On("SaveAuditRecord", mock.MatchedBy(func(r *st.AuditRecord) bool {
+		return r.Action == st.AuditDisableUser && r.TargetID == 43
+	})).Return(nil)
+	userDao.On("SaveAuditRecord", mock.MatchedBy(func(r *st.AuditRecord) bool {
+		return r.Action == st.AuditSuspendUser && r.TargetID == 43 && strings.HasSuffix(r.Details, " spam")
+	})).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.AdminSetStatus(ctx, token, 43, st.AccountStatus{Status: st.StatusDisabled, Reason: "ignored"})
+	assert.Nil(t, err)
+
+	err = s.AdminSetStatus(ctx, token, 43, suspension)
+	assert.Nil(t, err)
+
+	err = s.AdminSetStatus(ctx, token, 44, st.AccountStatus{Status: st.StatusActive})
+	assert.Equal(t, st.AuthError{Msg: "User does not exist", Status: 404}, err)
+
+	past := time.Now().Add(-time.Hour)
+	err = s.AdminSetStatus(ctx, token, 43, st.AccountStatus{Status: st.StatusSuspended, Until: &past})
+	assert.Equal(t, st.AuthError{Msg: "Suspension end must be in the future", Status: 400}, err)
+
+	err = s.AdminSetStatus(ctx, token, 43, st.AccountStatus{Status: "banned"})
+	assert.Equal(t, st.AuthError{Msg: "Unknown status", Status: 400}, err)
+
+	err = s.AdminSetStatus(ctx, token, admin.ID, st.AccountStatus{Status: st.StatusDisabled})
+	assert.Equal(t, st.AuthError{Msg: "Admin can not block themselves", Status: 400}, err)
+	userDao.AssertNumberOfCalls(t, "SaveAuditRecord", 2)
+}
+
+func TestAuthService_AdminDeleteUser_AuditFailure(t *testing.T) {
+	admin := createTestUser()
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("DeleteById", 43).Return(nil)
+	userDao.On("SaveAuditRecord", mock.Anything).Return(dao.ErrTimeout)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.AdminDeleteUser(ctx, token, 43)
+	assert.Nil(t, err)
+	userDao.AssertExpectations(t)
+}
+
+func TestAuthService_BasicAuthToken_Disabled(t *testing.T) {
+	user := createTestUser()
+	user.Status = st.StatusDisabled
+	disabledErr := st.AuthError{Msg: "User is disabled", Status: 403, Code: st.CodeAccountDisabled}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	_, _, err := s.BasicAuthToken(ctx, user.Username, "oakheart")
+	assert.Equal(t, disabledErr, err)
+
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+	_, err = s.RefreshToken(ctx, token)
+	assert.Equal(t, disabledErr, err)
+}
+
+func TestAuthService_Suspended(t *testing.T) {
+	user := createTestUser()
+	until := time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC)
+	user.AccountStatus = st.AccountStatus{Status: st.StatusSuspended, Reason: "spam", Until: &until}
+	suspendedErr := st.AuthError{Msg: "User is suspended until 2100-01-02T03:04:05Z: spam", Status: 403, Code: st.CodeAccountSuspended}
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	_, _, err := s.BasicAuthToken(ctx, user.Username, "oakheart")
+	assert.Equal(t, suspendedErr, err)
+
+	_, err = s.RefreshToken(ctx, token)
+	assert.Equal(t, suspendedErr, err)
+
+	_, err = s.GetUserById(ctx, 43, token)
+	assert.Equal(t, suspendedErr, err)
+
+	_, _, err = s.BasicAuthToken(ctx, user.Username, "wrong")
+	assert.Equal(t, st.AuthError{Msg: "Username or password is wrong", Status: 403}, err)
+}
+
+func TestAuthService_SuspensionExpired(t *testing.T) {
+	user := createTestUser()
+	until := time.Now().Add(-time.Minute)
+	user.AccountStatus = st.AccountStatus{Status: st.StatusSuspended, Until: &until}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	accessToken, _, err := s.BasicAuthToken(ctx, user.Username, "oakheart")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, accessToken)
+}
+
+func TestAuthService_AdminRestoreUser(t *testing.T) {
+	admin := createTestUser()
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("Restore", 43).Return(nil)
+	userDao.On("Restore", 44).Return(dao.ErrNotFound)
+	userDao.On("SaveAuditRecord", mock.MatchedBy(func(r *st.AuditRecord) bool {
+		return r.Action == st.AuditRestoreUser && r.TargetID == 43
+	})).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.AdminRestoreUser(ctx, token, 43)
+	assert.Nil(t, err)
+
+	err = s.AdminRestoreUser(ctx, token, 44)
+	assert.Equal(t, st.AuthError{Msg: "Deleted user does not exist", Status: 404}, err)
+	userDao.AssertExpectations(t)
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"ruslanlesko/brightonum/src/crypto"
 	"ruslanlesko/brightonum/src/dao"
 	"ruslanlesko/brightonum/src/email"
 	s "ruslanlesko/brightonum/src/structs"
@@ -57,6 +64,13 @@ type Config struct {
 	// Enable email verification
 	EmailVerification bool `long:"emailVerification" required:"false" description:"Enable email verification"`
 
+	// Email verification codes
+	VerificationExpiration     time.Duration `long:"verificationExpiration" required:"false" default:"24h" description:"Time after which verification code expires, 0 disables expiration"`
+	VerificationMaxAttempts    int           `long:"verificationMaxAttempts" required:"false" default:"5" description:"Number of wrong codes after which verification code can not be used, 0 disables the limit"`
+	VerificationResendInterval time.Duration `long:"verificationResendInterval" required:"false" default:"1m" description:"Minimal time between verification codes sent to the same user"`
+	VerificationLinkURL        string        `long:"verificationLinkURL" required:"false" description:"URL of verification link sent along with the code, username and code are added as query parameters"`
+	VerificationRedirectURL    string        `long:"verificationRedirectURL" required:"false" description:"Page to redirect to after verification by GET /v1/users/verify, with verified or error query parameter"`
+
 	// Email Server
 	EmailServer string `long:"emailServer" required:"true" description:"Email Server (such as smtp.office365.com)"`
 
@@ -65,6 +79,76 @@ type Config struct {
 
 	// Site Name
 	SiteName string `long:"siteName" required:"false" description:"Site Name used in email subjects"`
+
+	// Database operation timeout
+	DBTimeout time.Duration `long:"dbTimeout" required:"false" default:"5s" description:"Timeout for a single database operation"`
+
+	// Apply pending migrations on start
+	Migrate bool `long:"migrate" required:"false" description:"Apply pending database migrations on start"`
+
+	// Return all users at once from user info listing without query parameters
+	UnpaginatedUserList bool `long:"unpaginatedUserList" required:"false" description:"Return all users from /v1/userinfo when no query parameters are given"`
+
+	// Invite expiration
+	InviteExpiration time.Duration `long:"inviteExpiration" required:"false" default:"168h" description:"Time after which unused invites expire, 0 disables expiration"`
+
+	// Password recovery codes
+	RecoveryCodeTTL        time.Duration `long:"recoveryCodeTTL" required:"false" default:"15m" description:"Time after which emailed password recovery code expires, 0 disables expiration"`
+	ResettingCodeTTL       time.Duration `long:"resettingCodeTTL" required:"false" default:"15m" description:"Time after which password resetting code expires, 0 disables expiration"`
+	RecoveryMaxAttempts    int           `long:"recoveryMaxAttempts" required:"false" default:"5" description:"Number of attempts to enter recovery or resetting code after which the code can not be used, 0 disables the limit"`
+	RecoveryResendInterval time.Duration `long:"recoveryResendInterval" required:"false" default:"1m" description:"Minimal time between recovery codes sent to the same user, 0 disables the limit"`
+
+	// Password policy
+	PasswordMinLength int `long:"passwordMinLength" required:"false" default:"8" description:"Minimal length of a new password"`
+
+	// Username reservation
+	UsernameReservation time.Duration `long:"usernameReservation" required:"false" default:"2160h" description:"Time during which changed username can not be taken by another user"`
+
+	// Email change expiration
+	EmailChangeExpiration time.Duration `long:"emailChangeExpiration" required:"false" default:"24h" description:"Time during which email change can be confirmed"`
+
+	// Deleted user retention
+	DeletedUserRetention time.Duration `long:"deletedUserRetention" required:"false" default:"720h" description:"Time after which deleted users are removed permanently"`
+
+	// Purge job interval
+	PurgeInterval time.Duration `long:"purgeInterval" required:"false" default:"1h" description:"Interval between runs of the job removing deleted users permanently"`
+
+	// Service tokens for metadata access
+	ServiceTokens []string `long:"serviceToken" required:"false" description:"Token of a service and metadata namespaces it can access, as token:namespace1,namespace2"`
+
+	// Metadata size limit
+	MetadataMaxBytes int `long:"metadataMaxBytes" required:"false" default:"16384" description:"Maximal size of user metadata in a single namespace"`
+
+	// Compatibility window for tokens issued with username as subject
+	LegacyTokensUntil string `long:"legacyTokensUntil" required:"false" description:"Date (YYYY-MM-DD) from which tokens with username subject are rejected, a year after UUID migration if empty"`
+
+	// Registration policy for users registering without invite
+	AllowedDomains        []string `long:"allowedDomain" required:"false" description:"Email domain allowed for registration, any domain is allowed if none given"`
+	BlockedDomains        []string `long:"blockedDomain" required:"false" description:"Email domain not allowed for registration"`
+	DisposableDomainsFile string   `long:"disposableDomainsFile" required:"false" description:"File with disposable email domains, one per line, not allowed for registration"`
+	RequireApproval       bool     `long:"requireApproval" required:"false" description:"Keep accounts registered without invite pending until approved by admin"`
+
+	// Hashing of passwords and codes, password hashes of other algorithm or weaker parameters are replaced on login
+	PasswordHash      string `long:"passwordHash" required:"false" default:"argon2id" description:"Algorithm of new hashes, argon2id or bcrypt"`
+	BcryptCost        int    `long:"bcryptCost" required:"false" default:"10" description:"Bcrypt cost of new hashes"`
+	Argon2Memory      uint32 `long:"argon2Memory" required:"false" default:"65536" description:"Memory in KiB used by Argon2id for a new hash"`
+	Argon2Time        uint32 `long:"argon2Time" required:"false" default:"3" description:"Number of Argon2id passes over the memory"`
+	Argon2Threads     uint8  `long:"argon2Threads" required:"false" default:"4" description:"Argon2id parallelism"`
+	Argon2Concurrency int    `long:"argon2Concurrency" required:"false" default:"4" description:"Number of Argon2id hashes computed at once, others wait, so memory taken is bounded"`
+	CodeSecretPath    string `long:"codeSecret" required:"false" description:"Path to a secret keying hashes of emailed codes, private key is used if not given"`
+
+	// Public endpoints respond the same way whether the user exists or not
+	AntiEnumeration bool `long:"antiEnumeration" required:"false" description:"Do not reveal whether username or email is registered"`
+
+	// Formats of generated codes
+	CodeFormats []string `long:"codeFormat" required:"false" description:"Alphabet and length of codes of a type, as type:alphabet:length, e.g. verification:numeric:6"`
+
+	// disposableDomains are loaded from DisposableDomainsFile on start
+	disposableDomains map[string]bool
+	// codeFormats are parsed from CodeFormats on start
+	codeFormats map[string]codeFormat
+	// serviceTokens are parsed from ServiceTokens on start
+	serviceTokens []serviceToken
 }
 
 // RecoveryEmailPayload represents payload of password recovery email request
@@ -78,6 +162,11 @@ type ExchangeCodeRequestPayload struct {
 	Code     string `json:"code"`
 }
 
+// VerificationResendPayload represents payload of verification code resend request
+type VerificationResendPayload struct {
+	Username string `json:"username"`
+}
+
 // PasswordResetPayload represents request payload for password reset request
 type PasswordResetPayload struct {
 	Username string `json:"username"`
@@ -104,18 +193,15 @@ func (a *Auth) inviteUser(w http.ResponseWriter, r *http.Request) {
 
 	token := headerItems[1]
 
-	var payload struct {
-		Email string `json:"email"`
-	}
-
-	err := json.NewDecoder(r.Body).Decode(&payload)
+	var invite s.Invite
+	err := json.NewDecoder(r.Body).Decode(&invite)
 	if err != nil {
 		logger.Logf("ERROR Cannot decode JSON payload")
 		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
 		return
 	}
 
-	err = a.AuthService.InviteUser(payload.Email, token)
+	err = a.AuthService.InviteUser(r.Context(), &invite, token)
 	if err != nil {
 		authErr, isAuthErr := err.(s.AuthError)
 		if isAuthErr {
@@ -147,7 +233,7 @@ func (a *Auth) createUser(w http.ResponseWriter, r *http.Request) {
 		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
 		return
 	}
-	err = a.AuthService.CreateUser(&newUser)
+	err = a.AuthService.CreateUser(r.Context(), &newUser)
 	if err != nil {
 		authErr, isAuthErr := err.(s.AuthError)
 		if isAuthErr {
@@ -158,8 +244,14 @@ func (a *Auth) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Registration with taken username or email looks successful, so id can not be given
+	if a.AuthService.Config.AntiEnumeration {
+		w.WriteHeader(202)
+		return
+	}
+
 	w.WriteHeader(201)
-	w.Write(s.ID2JSON(&s.IDResp{ID: newUser.ID}))
+	w.Write(s.ID2JSON(&s.IDResp{ID: newUser.ID, Status: newUser.Status}))
 }
 
 func (a *Auth) updateUser(w http.ResponseWriter, r *http.Request) {
@@ -204,7 +296,7 @@ func (a *Auth) updateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = a.AuthService.UpdateUser(&updatedUser, token)
+	err = a.AuthService.UpdateUser(r.Context(), &updatedUser, token)
 	if err != nil {
 		authErr, isAuthErr := err.(s.AuthError)
 		if isAuthErr {
@@ -232,11 +324,60 @@ func (a *Auth) verifyUser(w http.ResponseWriter, r *http.Request) {
 		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
 		return
 	}
-	err = a.AuthService.VerifyUser(payload.Username, payload.Code)
+	err = a.AuthService.VerifyUser(r.Context(), payload.Username, payload.Code)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+}
+
+// verifyUserByLink handles verification link from email. With VerificationRedirectURL the user is redirected
+// to that page with verified=true or error query parameter, otherwise the response is the same as of POST request.
+func (a *Auth) verifyUserByLink(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+
+	params := r.URL.Query()
+	err := a.AuthService.VerifyUser(r.Context(), params.Get("username"), params.Get("code"))
+
+	redirect := a.AuthService.Config.VerificationRedirectURL
+	if redirect != "" {
+		target, parseErr := url.Parse(redirect)
+		if parseErr == nil {
+			query := target.Query()
+			if err != nil {
+				query.Set("error", err.Error())
+			} else {
+				query.Set("verified", "true")
+			}
+			target.RawQuery = query.Encode()
+			http.Redirect(w, r, target.String(), http.StatusFound)
+			return
+		}
+		logger.Logf("ERROR Invalid verification redirect URL: %s", parseErr.Error())
+	}
+
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
 	if err != nil {
 		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) resendVerificationCode(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	var payload VerificationResendPayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil || payload.Username == "" {
+		logger.Logf("ERROR Invalid payload")
+		writeError(w, s.AuthError{Msg: "Username is missing", Status: 400})
 		return
 	}
+
+	err = a.AuthService.ResendVerificationCode(r.Context(), payload.Username)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
 }
 
 func (a *Auth) deleteUser(w http.ResponseWriter, r *http.Request) {
@@ -266,7 +407,7 @@ func (a *Auth) deleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = a.AuthService.DeleteUser(userID, token)
+	err = a.AuthService.DeleteUser(r.Context(), userID, token)
 	if err != nil {
 		authErr, isAuthErr := err.(s.AuthError)
 		if isAuthErr {
@@ -285,7 +426,7 @@ func (a *Auth) getToken(w http.ResponseWriter, r *http.Request) {
 	if t == "refresh_token" {
 		logger.Logf("INFO Refreshing token")
 		refToken := strings.Split(r.Header.Get("Authorization"), " ")[1]
-		token, err := a.AuthService.RefreshToken(refToken)
+		token, err := a.AuthService.RefreshToken(r.Context(), refToken)
 		if err != nil {
 			logger.Logf("WARN Cannot refresh token: %s", err.Error())
 			authErr, isAuthErr := err.(s.AuthError)
@@ -301,7 +442,7 @@ func (a *Auth) getToken(w http.ResponseWriter, r *http.Request) {
 	}
 	u, p, ok := r.BasicAuth()
 	if ok {
-		accessToken, refreshToken, err := a.AuthService.BasicAuthToken(u, p)
+		accessToken, refreshToken, err := a.AuthService.BasicAuthToken(r.Context(), u, p)
 		if err != nil {
 			logger.Logf("WARN Cannot issue token: %s", err.Error())
 			writeError(w, err.(s.AuthError))
@@ -328,12 +469,120 @@ func (a *Auth) getUsers(w http.ResponseWriter, r *http.Request) {
 
 	token := headerItems[1]
 
-	users, err := a.AuthService.GetUsers(token)
+	if a.AuthService.Config.UnpaginatedUserList && r.URL.RawQuery == "" {
+		users, err := a.AuthService.GetUsers(r.Context(), token)
+		if err != nil {
+			writeError(w, err.(s.AuthError))
+			return
+		}
+		w.Write(s.UL2JSON(users))
+		return
+	}
+
+	query, role, err := parseUserQuery(r)
+	if err != nil {
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	page, err := a.AuthService.ListUsers(r.Context(), token, query, role)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	setNextLink(w, r, page.NextCursor)
+	w.Write(s.UIP2JSON(page))
+}
+
+func (a *Auth) searchUsers(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	params := r.URL.Query()
+	query := dao.SearchQuery{Text: params.Get("q"), Cursor: params.Get("cursor")}
+	if limit := params.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 {
+			writeError(w, s.AuthError{Msg: "Limit must be a positive number", Status: 400})
+			return
+		}
+		query.Limit = value
+	}
+
+	page, err := a.AuthService.SearchUsers(r.Context(), token, query)
 	if err != nil {
 		writeError(w, err.(s.AuthError))
 		return
 	}
-	w.Write(s.UL2JSON(users))
+	setNextLink(w, r, page.NextCursor)
+	w.Write(s.UIP2JSON(page))
+}
+
+// setNextLink advertises the next page of the request in Link header
+func setNextLink(w http.ResponseWriter, r *http.Request, cursor string) {
+	if cursor == "" {
+		return
+	}
+	next := *r.URL
+	params := next.Query()
+	params.Set("cursor", cursor)
+	next.RawQuery = params.Encode()
+	w.Header().Set("Access-Control-Expose-Headers", "Link")
+	w.Header().Set("Link", "<"+next.RequestURI()+">; rel=\"next\"")
+}
+
+// parseUserQuery reads user listing parameters: limit, cursor, sort, order,
+// usernamePrefix, emailDomain, verified and role
+func parseUserQuery(r *http.Request) (dao.UserQuery, string, error) {
+	params := r.URL.Query()
+	query := dao.UserQuery{
+		Cursor:         params.Get("cursor"),
+		SortBy:         params.Get("sort"),
+		UsernamePrefix: params.Get("usernamePrefix"),
+		EmailDomain:    params.Get("emailDomain"),
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 {
+			return query, "", errors.New("Limit must be a positive number")
+		}
+		query.Limit = value
+	}
+
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, "", errors.New("Order must be asc or desc")
+	}
+
+	switch query.SortBy {
+	case "", dao.SortByID, dao.SortByUsername, dao.SortByCreated:
+	default:
+		return query, "", errors.New("Sort must be id, username or created")
+	}
+
+	if verified := params.Get("verified"); verified != "" {
+		value, err := strconv.ParseBool(verified)
+		if err != nil {
+			return query, "", errors.New("Verified must be true or false")
+		}
+		query.Verified = &value
+	}
+
+	return query, params.Get("role"), nil
 }
 
 func (a *Auth) getUserByUsername(w http.ResponseWriter, r *http.Request) {
@@ -351,7 +600,7 @@ func (a *Auth) getUserByUsername(w http.ResponseWriter, r *http.Request) {
 	token := headerItems[1]
 
 	username := chi.URLParam(r, "username")
-	user, err := a.AuthService.GetUserByUsername(username, token)
+	user, err := a.AuthService.GetUserByUsername(r.Context(), username, token)
 	if err != nil {
 		writeError(w, err.(s.AuthError))
 		return
@@ -384,7 +633,7 @@ func (a *Auth) getUserById(w http.ResponseWriter, r *http.Request) {
 		writeError(w, s.AuthError{Msg: "Cannot parse user ID", Status: 400})
 		return
 	}
-	user, err := a.AuthService.GetUserById(userID, token)
+	user, err := a.AuthService.GetUserById(r.Context(), userID, token)
 	if err != nil {
 		writeError(w, err.(s.AuthError))
 		return
@@ -414,7 +663,7 @@ func (a *Auth) emailRecoveryCode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = a.AuthService.SendRecoveryEmail(payload.Username)
+	err = a.AuthService.SendRecoveryEmail(r.Context(), payload.Username)
 	if err != nil {
 		writeError(w, err.(s.AuthError))
 		return
@@ -439,7 +688,7 @@ func (a *Auth) exchangeRecoveryCode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	code, err := a.AuthService.ExchangeRecoveryCode(payload.Username, payload.Code)
+	code, err := a.AuthService.ExchangeRecoveryCode(r.Context(), payload.Username, payload.Code)
 	if err != nil {
 		writeError(w, err.(s.AuthError))
 		return
@@ -465,79 +714,830 @@ func (a *Auth) resetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = a.AuthService.ResetPassword(payload.Username, payload.Code, payload.Password)
+	err = a.AuthService.ResetPassword(r.Context(), payload.Username, payload.Code, payload.Password)
 	if err != nil {
 		writeError(w, err.(s.AuthError))
 		return
 	}
 }
 
-func (a *Auth) options(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "authorization, content-type")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PATCH, DELETE, OPTIONS")
+// PasswordChangePayload represents payload of password change request
+type PasswordChangePayload struct {
+	CurrentPassword     string `json:"currentPassword"`
+	NewPassword         string `json:"newPassword"`
+	RevokeOtherSessions bool   `json:"revokeOtherSessions"`
 }
 
-func writeError(w http.ResponseWriter, err s.AuthError) {
-	w.WriteHeader(err.Status)
-	w.Write(s.ER2JSON(&s.ErrorResp{Error: err.Error()}))
+func (a *Auth) changePassword(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var payload PasswordChangePayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	accessToken, refreshToken, err := a.AuthService.ChangePassword(r.Context(), token, userID, payload.CurrentPassword, payload.NewPassword, payload.RevokeOtherSessions)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	if accessToken != "" {
+		w.Write(s.ARR2JSON(&s.AccessAndRefreshTokenResp{AccessToken: accessToken, RefreshToken: refreshToken}))
+	}
 }
 
-func (a *Auth) start() {
-	r := chi.NewRouter()
+// UsernameChangePayload represents payload of username change request
+type UsernameChangePayload struct {
+	Username string `json:"username"`
+}
 
-	r.Use(func(h http.Handler) http.Handler {
-		return loggerHandler(h)
-	})
+func (a *Auth) changeUsername(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
 
-	r.Route("/v1", func(r chi.Router) {
-		r.Options("/*", a.options)
-		r.Post("/invite", a.inviteUser)
-		r.Post("/users", a.createUser)
-		r.Patch("/users/{userID}", a.updateUser)
-		r.Delete("/users/{userID}", a.deleteUser)
-		r.Post("/users/verify", a.verifyUser)
-		r.Post("/token", a.getToken)
-		r.Get("/userinfo/byid/{userID}", a.getUserById)
-		r.Get("/userinfo/byusername/{username}", a.getUserByUsername)
-		r.Get("/userinfo", a.getUsers)
-		r.Post("/password-recovery/email", a.emailRecoveryCode)
-		r.Post("/password-recovery/exchange", a.exchangeRecoveryCode)
-		r.Post("/password-recovery/reset", a.resetPassword)
-	})
-	http.ListenAndServe(":2525", r)
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var payload UsernameChangePayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	err = a.AuthService.ChangeUsername(r.Context(), token, userID, payload.Username)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
 }
 
-func loggerHandler(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		t1 := time.Now()
-		ww := middleware.NewWrapResponseWriter(rw, r.ProtoMajor)
-		logfmt := "INFO %s %s %d %d - %d ms"
-		defer func() {
-			if r.Method != "OPTIONS" {
-				logger.Logf(logfmt, r.Method, r.URL, ww.Status(), ww.BytesWritten(), time.Since(t1).Milliseconds())
-			}
-		}()
-		h.ServeHTTP(ww, r)
-	})
+// EmailChangePayload represents payload of email change request
+type EmailChangePayload struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
 }
 
-func main() {
-	conf := Config{}
+// EmailChangeConfirmationPayload represents payload of email change confirmation
+type EmailChangeConfirmationPayload struct {
+	Code string `json:"code"`
+}
 
-	_, err := flags.Parse(&conf)
+func (a *Auth) requestEmailChange(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
 
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var payload EmailChangePayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
 	if err != nil {
-		logger.Logf("FATAL Cannot parse arguments: %s", err.Error())
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
 	}
 
-	if conf.Debug {
-		logger = lgr.New(lgr.Debug, loggerFormat)
+	err = a.AuthService.RequestEmailChange(r.Context(), token, userID, payload.Email, payload.Password)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) confirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var payload EmailChangeConfirmationPayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	err = a.AuthService.ConfirmEmailChange(r.Context(), token, userID, payload.Code)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+// AdminPasswordPayload represents payload for password set by admin
+type AdminPasswordPayload struct {
+	Password string `json:"password"`
+}
+
+// SuspensionPayload represents payload for user suspension, suspension without end lasts until user is enabled
+type SuspensionPayload struct {
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until"`
+}
+
+func (a *Auth) adminCreateUser(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+
+	var newUser s.User
+	err := json.NewDecoder(r.Body).Decode(&newUser)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	err = a.AuthService.AdminCreateUser(r.Context(), token, &newUser)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
 	}
 
-	dao := dao.NewMongoUserDao(conf.MongoDBURL, conf.DatabaseName)
+	w.WriteHeader(201)
+	w.Write(s.ID2JSON(&s.IDResp{ID: newUser.ID}))
+}
+
+func (a *Auth) adminUpdateUser(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var updatedUser s.User
+	err := json.NewDecoder(r.Body).Decode(&updatedUser)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+	if updatedUser.ID != 0 && updatedUser.ID != userID {
+		writeError(w, s.AuthError{Msg: "User IDs are not matching", Status: 400})
+		return
+	}
+	updatedUser.ID = userID
+
+	err = a.AuthService.AdminUpdateUser(r.Context(), token, &updatedUser)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) adminSetPassword(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var payload AdminPasswordPayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	err = a.AuthService.AdminSetPassword(r.Context(), token, userID, payload.Password)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) adminForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	a.adminAction(w, r, a.AuthService.AdminForcePasswordReset)
+}
+
+func (a *Auth) adminVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	a.adminAction(w, r, a.AuthService.AdminVerifyEmail)
+}
+
+func (a *Auth) adminSuspendUser(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var payload SuspensionPayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	status := s.AccountStatus{Status: s.StatusSuspended, Reason: payload.Reason, Until: payload.Until}
+	err = a.AuthService.AdminSetStatus(r.Context(), token, userID, status)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) adminDisableUser(w http.ResponseWriter, r *http.Request) {
+	a.adminAction(w, r, func(ctx context.Context, token string, id int) error {
+		return a.AuthService.AdminSetStatus(ctx, token, id, s.AccountStatus{Status: s.StatusDisabled})
+	})
+}
+
+func (a *Auth) adminApproveUser(w http.ResponseWriter, r *http.Request) {
+	a.adminAction(w, r, a.AuthService.AdminApproveUser)
+}
+
+func (a *Auth) adminListPendingUsers(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+
+	query, _, err := parseUserQuery(r)
+	if err != nil {
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	page, err := a.AuthService.AdminListPendingUsers(r.Context(), token, query)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	setNextLink(w, r, page.NextCursor)
+	w.Write(s.UIP2JSON(page))
+}
+
+func (a *Auth) adminEnableUser(w http.ResponseWriter, r *http.Request) {
+	a.adminAction(w, r, func(ctx context.Context, token string, id int) error {
+		return a.AuthService.AdminSetStatus(ctx, token, id, s.AccountStatus{Status: s.StatusActive})
+	})
+}
+
+func (a *Auth) adminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	a.adminAction(w, r, a.AuthService.AdminDeleteUser)
+}
+
+func (a *Auth) adminRestoreUser(w http.ResponseWriter, r *http.Request) {
+	a.adminAction(w, r, a.AuthService.AdminRestoreUser)
+}
+
+func (a *Auth) getProfileSchema(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+
+	schema, err := a.AuthService.GetProfileSchema(r.Context(), token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.PS2JSON(schema))
+}
+
+func (a *Auth) updateProfileSchema(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+
+	var schema s.ProfileSchema
+	err := json.NewDecoder(r.Body).Decode(&schema)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	err = a.AuthService.UpdateProfileSchema(r.Context(), token, &schema)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.PS2JSON(&schema))
+}
+
+func (a *Auth) getMetadata(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	m, err := a.AuthService.GetMetadata(r.Context(), token, userID, chi.URLParam(r, "namespace"))
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+
+	etag := versionETag(m.Version)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(304)
+		return
+	}
+	w.Write([]byte(m.Data))
+}
+
+func (a *Auth) putMetadata(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+	expected, ok := expectedVersion(w, r)
+	if !ok {
+		return
+	}
+	if r.Body == nil {
+		writeError(w, s.AuthError{Msg: "Request body is missing", Status: 400})
+		return
+	}
+
+	// One byte over the limit is enough for the service to reject the body
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(a.AuthService.Config.MetadataMaxBytes)+1))
+	if err != nil {
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	version, err := a.AuthService.PutMetadata(r.Context(), token, userID, chi.URLParam(r, "namespace"), data, expected)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Header().Set("ETag", versionETag(version))
+	w.WriteHeader(204)
+}
+
+func (a *Auth) deleteMetadata(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+	expected, ok := expectedVersion(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.AuthService.DeleteMetadata(r.Context(), token, userID, chi.URLParam(r, "namespace"), expected)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func versionETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// expectedVersion reads expected metadata version from conditional headers, writes error if it is malformed.
+// "If-None-Match: *" expects no metadata, request without conditional headers is unconditional.
+func expectedVersion(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	if r.Header.Get("If-None-Match") == "*" {
+		return dao.NoVersion, true
+	}
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return dao.AnyVersion, true
+	}
+	version, err := strconv.ParseInt(strings.Trim(ifMatch, `"`), 10, 64)
+	if err != nil || version <= 0 {
+		writeError(w, s.AuthError{Msg: "Metadata version does not match", Status: 412})
+		return 0, false
+	}
+	return version, true
+}
+
+func (a *Auth) listInvites(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	query := dao.InviteQuery{Status: params.Get("status"), Cursor: params.Get("cursor")}
+	if limit := params.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 {
+			writeError(w, s.AuthError{Msg: "Limit must be a positive number", Status: 400})
+			return
+		}
+		query.Limit = value
+	}
+
+	page, err := a.AuthService.ListInvites(r.Context(), token, query)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	setNextLink(w, r, page.NextCursor)
+	w.Write(s.IP2JSON(page))
+}
+
+func (a *Auth) resendInvite(w http.ResponseWriter, r *http.Request) {
+	a.inviteAction(w, r, a.AuthService.ResendInvite)
+}
+
+func (a *Auth) revokeInvite(w http.ResponseWriter, r *http.Request) {
+	a.inviteAction(w, r, a.AuthService.RevokeInvite)
+}
+
+// inviteAction handles admin request without payload which targets invite from the path
+func (a *Auth) inviteAction(w http.ResponseWriter, r *http.Request, action func(context.Context, string, string) error) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+
+	err := action(r.Context(), token, chi.URLParam(r, "inviteID"))
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) createInviteLink(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+
+	var link s.InviteLink
+	err := json.NewDecoder(r.Body).Decode(&link)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	created, err := a.AuthService.CreateInviteLink(r.Context(), token, &link)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+
+	w.WriteHeader(201)
+	w.Write(s.IL2JSON(created))
+}
+
+func (a *Auth) listInviteLinks(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	query := dao.InviteLinkQuery{Cursor: params.Get("cursor")}
+	if limit := params.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 {
+			writeError(w, s.AuthError{Msg: "Limit must be a positive number", Status: 400})
+			return
+		}
+		query.Limit = value
+	}
+
+	page, err := a.AuthService.ListInviteLinks(r.Context(), token, query)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	setNextLink(w, r, page.NextCursor)
+	w.Write(s.ILP2JSON(page))
+}
+
+func (a *Auth) revokeInviteLink(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.AuthService.RevokeInviteLink(r.Context(), token, chi.URLParam(r, "linkID"))
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+// adminAction handles admin request without payload which targets user from the path
+func (a *Auth) adminAction(w http.ResponseWriter, r *http.Request, action func(context.Context, string, int) error) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := action(r.Context(), token, userID)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+// bearerToken extracts token from Authorization header, writes error if it is missing
+func bearerToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	headerItems := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return "", false
+	}
+	return headerItems[1], true
+}
+
+// userIDParam extracts user ID from the path, writes error if it is malformed
+func userIDParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		logger.Logf("ERROR Cannot parse user ID: %s", chi.URLParam(r, "userID"))
+		writeError(w, s.AuthError{Msg: "Cannot parse user ID", Status: 400})
+		return 0, false
+	}
+	return userID, true
+}
+
+func (a *Auth) options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "authorization, content-type, if-match, if-none-match")
+	w.Header().Set("Access-Control-Expose-Headers", "etag")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, PATCH, DELETE, OPTIONS")
+}
+
+func writeError(w http.ResponseWriter, err s.AuthError) {
+	w.WriteHeader(err.Status)
+	w.Write(s.ER2JSON(&s.ErrorResp{Error: err.Error(), Code: err.Code}))
+}
+
+func (a *Auth) start() {
+	r := chi.NewRouter()
+
+	r.Use(func(h http.Handler) http.Handler {
+		return loggerHandler(h)
+	})
+
+	r.Route("/v1", func(r chi.Router) {
+		r.Options("/*", a.options)
+		r.Post("/invite", a.inviteUser)
+		r.Post("/users", a.createUser)
+		r.Patch("/users/{userID}", a.updateUser)
+		r.Delete("/users/{userID}", a.deleteUser)
+		r.Post("/users/verify", a.verifyUser)
+		r.Get("/users/verify", a.verifyUserByLink)
+		r.Post("/users/verify/resend", a.resendVerificationCode)
+		r.Post("/users/{userID}/password", a.changePassword)
+		r.Post("/users/{userID}/username", a.changeUsername)
+		r.Post("/users/{userID}/email", a.requestEmailChange)
+		r.Post("/users/{userID}/email/confirm", a.confirmEmailChange)
+		r.Get("/users/search", a.searchUsers)
+		r.Get("/users/{userID}/metadata/{namespace}", a.getMetadata)
+		r.Put("/users/{userID}/metadata/{namespace}", a.putMetadata)
+		r.Delete("/users/{userID}/metadata/{namespace}", a.deleteMetadata)
+		r.Post("/token", a.getToken)
+		r.Get("/userinfo/byid/{userID}", a.getUserById)
+		r.Get("/userinfo/byusername/{username}", a.getUserByUsername)
+		r.Get("/userinfo", a.getUsers)
+		r.Post("/password-recovery/email", a.emailRecoveryCode)
+		r.Post("/password-recovery/exchange", a.exchangeRecoveryCode)
+		r.Post("/password-recovery/reset", a.resetPassword)
+
+		r.Route("/admin/users", func(r chi.Router) {
+			r.Post("/", a.adminCreateUser)
+			r.Get("/pending", a.adminListPendingUsers)
+			r.Patch("/{userID}", a.adminUpdateUser)
+			r.Delete("/{userID}", a.adminDeleteUser)
+			r.Put("/{userID}/password", a.adminSetPassword)
+			r.Post("/{userID}/password-reset", a.adminForcePasswordReset)
+			r.Post("/{userID}/verify", a.adminVerifyEmail)
+			r.Post("/{userID}/suspend", a.adminSuspendUser)
+			r.Post("/{userID}/disable", a.adminDisableUser)
+			r.Post("/{userID}/enable", a.adminEnableUser)
+			r.Post("/{userID}/approve", a.adminApproveUser)
+			r.Post("/{userID}/restore", a.adminRestoreUser)
+		})
+		r.Route("/admin/invites", func(r chi.Router) {
+			r.Get("/", a.listInvites)
+			r.Post("/{inviteID}/resend", a.resendInvite)
+			r.Delete("/{inviteID}", a.revokeInvite)
+		})
+		r.Route("/admin/invite-links", func(r chi.Router) {
+			r.Post("/", a.createInviteLink)
+			r.Get("/", a.listInviteLinks)
+			r.Delete("/{linkID}", a.revokeInviteLink)
+		})
+		r.Get("/admin/profile-schema", a.getProfileSchema)
+		r.Put("/admin/profile-schema", a.updateProfileSchema)
+	})
+	http.ListenAndServe(":2525", r)
+}
+
+func loggerHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		t1 := time.Now()
+		ww := middleware.NewWrapResponseWriter(rw, r.ProtoMajor)
+		logfmt := "INFO %s %s %d %d - %d ms"
+		defer func() {
+			if r.Method != "OPTIONS" {
+				logger.Logf(logfmt, r.Method, r.URL, ww.Status(), ww.BytesWritten(), time.Since(t1).Milliseconds())
+			}
+		}()
+		h.ServeHTTP(ww, r)
+	})
+}
+
+// setCodeSecret keys hashes of emailed codes with the code secret, or with the private key if it is not given,
+// so every instance sharing the key matches codes issued by others
+func setCodeSecret(conf Config) error {
+	path := conf.CodeSecretPath
+	if path == "" {
+		path = conf.PrivKeyPath
+	}
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return crypto.SetCodeKey(secret)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := runMigrate(os.Args[2:])
+		if err != nil {
+			logger.Logf("FATAL Migration failed: %s", err.Error())
+		}
+		return
+	}
+
+	conf := Config{}
+
+	_, err := flags.Parse(&conf)
+
+	if err != nil {
+		logger.Logf("FATAL Cannot parse arguments: %s", err.Error())
+	}
+
+	if conf.Debug {
+		logger = lgr.New(lgr.Debug, loggerFormat)
+	}
+
+	conf.serviceTokens, err = parseServiceTokens(conf.ServiceTokens)
+	if err != nil {
+		logger.Logf("FATAL Cannot parse service tokens: %s", err.Error())
+	}
+
+	err = crypto.SetCost(conf.BcryptCost)
+	if err != nil {
+		logger.Logf("FATAL Invalid bcrypt cost: %s", err.Error())
+	}
+	err = crypto.SetArgon2Params(conf.Argon2Memory, conf.Argon2Time, conf.Argon2Threads)
+	if err != nil {
+		logger.Logf("FATAL Invalid argon2 parameters: %s", err.Error())
+	}
+	err = crypto.SetArgon2Concurrency(conf.Argon2Concurrency)
+	if err != nil {
+		logger.Logf("FATAL Invalid argon2 concurrency: %s", err.Error())
+	}
+	err = crypto.Use(conf.PasswordHash)
+	if err != nil {
+		logger.Logf("FATAL Cannot use password hash: %s", err.Error())
+	}
+	err = setCodeSecret(conf)
+	if err != nil {
+		logger.Logf("FATAL Cannot set code secret: %s", err.Error())
+	}
+
+	conf.codeFormats, err = parseCodeFormats(conf.CodeFormats)
+	if err != nil {
+		logger.Logf("FATAL Cannot parse code formats: %s", err.Error())
+	}
+
+	if conf.DisposableDomainsFile != "" {
+		conf.disposableDomains, err = loadDomainList(conf.DisposableDomainsFile)
+		if err != nil {
+			logger.Logf("FATAL Cannot load disposable domains: %s", err.Error())
+		}
+	}
+
+	if conf.LegacyTokensUntil != "" {
+		_, err = time.Parse(legacyTokensLayout, conf.LegacyTokensUntil)
+		if err != nil {
+			logger.Logf("FATAL Cannot parse legacy tokens date: %s", err.Error())
+		}
+	}
+
+	dao := dao.NewMongoUserDao(conf.MongoDBURL, conf.DatabaseName, conf.DBTimeout)
+	err = dao.Bootstrap()
+	if err != nil {
+		logger.Logf("FATAL Cannot bootstrap database: %s", err.Error())
+	}
+	if conf.Migrate {
+		_, err = dao.MigrateUp()
+		if err != nil {
+			logger.Logf("FATAL Cannot apply migrations: %s", err.Error())
+		}
+	}
 	mailer := email.EmailMailer{Email: conf.Email, Password: conf.EmailPassword, Server: conf.EmailServer, Port: conf.EmailPort, SiteName: conf.SiteName}
 	service := AuthService{UserDao: dao, Mailer: &mailer, Config: conf}
+	go service.RunPurgeJob(dao.Ctx, conf.PurgeInterval)
 	auth := Auth{AuthService: &service}
 	logger.Logf("INFO BrightonUM 1.9.1 is starting")
 	auth.start()
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
 	"ruslanlesko/brightonum/src/dao"
 	"ruslanlesko/brightonum/src/email"
@@ -21,15 +23,17 @@ const baseURL string = "http://localhost:2525/"
 
 var user = s.User{
 	ID:        42,
+	UUID:      "9b2f6c1e-4a7d-4e3b-8c5f-2d1a0e9f7b63",
 	Username:  "alle",
 	FirstName: "test",
 	LastName:  "user",
 	Email:     "test@email.com",
 	Password:  "$2a$04$Mhlu1.a4QchlVgGQFc/0N.qAw9tsXqm1OMwjJRaPRCWn47bpsRa4S",
 }
-var updatedUser = s.User{ID: 42, Email: "updated@email.com"}
+var updatedUser = s.User{ID: 42, FirstName: "updated"}
 var user2 = s.User{ID: -1, Username: "sarah", FirstName: "Sarah", LastName: "Lynn", Email: "sarah@email.com", Password: "oakheart"}
 var userInfo = s.UserInfo{ID: 42, Username: "alle", FirstName: "test", LastName: "user", Email: "test@email.com"}
+var invitedEmail = "bojack@horseman.com"
 var code = "267483"
 var hashedCode = "$2a$04$c12NAkAi9nOxkYM5vO7eUur2fd9M23M4roKPbroOvNhsBVF0mOmS."
 
@@ -48,7 +52,7 @@ type TokenResponse struct {
 func TestFunctional_InviteUser(t *testing.T) {
 	var client = &http.Client{}
 	var token = issueTestToken(user.ID, user.Username, "../test_data/private.pem")
-	req, err := http.NewRequest(http.MethodPost, baseURL+"v1/invite", bytes.NewReader([]byte("{\"email\":\""+user.Email+"\"}")))
+	req, err := http.NewRequest(http.MethodPost, baseURL+"v1/invite", bytes.NewReader([]byte("{\"email\":\""+invitedEmail+"\"}")))
 	assert.Nil(t, err)
 	req.Header.Add("Authorization", "Bearer "+token)
 	resp, err := client.Do(req)
@@ -88,11 +92,29 @@ func TestFunctional_GetById(t *testing.T) {
 	assert.Equal(t, userInfo, resultUserInfo)
 }
 
+func TestFunctional_ListUsers(t *testing.T) {
+	var client = &http.Client{}
+	var token = issueTestToken(user.ID, user.Username, "../test_data/private.pem")
+	req, err := http.NewRequest(http.MethodGet, baseURL+"v1/userinfo?limit=1&sort=username", nil)
+	assert.Nil(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "</v1/userinfo?cursor=next&limit=1&sort=username>; rel=\"next\"", resp.Header.Get("Link"))
+
+	defer resp.Body.Close()
+
+	var page s.UserInfoPage
+	json.NewDecoder(resp.Body).Decode(&page)
+	assert.Equal(t, s.UserInfoPage{Users: []s.UserInfo{userInfo}, NextCursor: "next"}, page)
+}
+
 func TestFunctional_CreateUser(t *testing.T) {
 	resp, err := http.Post(baseURL+"v1/users", "application/json", bytes.NewReader(s.U2JSON(&user)))
 	assert.Nil(t, err)
 
-	assert.Equal(t, 400, resp.StatusCode)
+	assert.Equal(t, 409, resp.StatusCode)
 
 	resp, err = http.Post(baseURL+"v1/users", "application/json", bytes.NewReader(s.U2JSON(&user2)))
 	assert.Nil(t, err)
@@ -226,47 +248,96 @@ func TestFunctional_Delete(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 }
 
+func TestFunctional_AdminUsers(t *testing.T) {
+	client := &http.Client{}
+	token := issueTestToken(user.ID, user.Username, "../test_data/private.pem")
+
+	req, err := http.NewRequest(http.MethodPost, baseURL+"v1/admin/users", bytes.NewReader(s.U2JSON(&user2)))
+	assert.Nil(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.JSONEq(t, "{ \"id\" : 43}", string(body))
+
+	req, err = http.NewRequest(http.MethodPost, baseURL+"v1/admin/users/42/verify", nil)
+	assert.Nil(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	req, err = http.NewRequest(http.MethodPost, baseURL+"v1/admin/users/abc/verify", nil)
+	assert.Nil(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
 func setup() {
-	dao := dao.MockUserDao{}
-	dao.On("GetByUsername", user.Username).Return(&user, nil)
-	dao.On("GetByUsername", user2.Username).Return(nil, nil)
-	dao.On("Get", user.ID).Return(&user, nil)
-	dao.On("Save", mock.MatchedBy(
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetByUsername", user2.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("Get", user.ID).Return(&user, nil)
+	userDao.On("GetByUUID", user.UUID).Return(&user, nil)
+	userDao.On("GetProfileSchema").Return(&s.ProfileSchema{}, nil)
+	userDao.On("Find", dao.UserQuery{Limit: 1, SortBy: dao.SortByUsername}).Return(&dao.UserPage{Users: []s.User{user}, NextCursor: "next"}, nil)
+	userDao.On("Save", mock.MatchedBy(
 		func(u *s.User) bool {
 			return u.Username == user2.Username && u.FirstName == user2.FirstName && u.LastName == user2.LastName
-		})).Return(43)
-	dao.On("Save", mock.MatchedBy(
-		func(u *s.User) bool {
-			return u.Email == user.Email && len(u.InviteCode) == 32
-		})).Return(99)
-	dao.On("Update", &updatedUser).Return(nil)
-	dao.On("SetRecoveryCode", user.ID,
-		mock.MatchedBy(func(hashedCode string) bool { return hashedCode != "" })).Return(nil)
-	dao.On("GetRecoveryCode", user.ID).Return(hashedCode, nil)
-	dao.On(
+		})).Return(43, nil)
+	userDao.On("GetByEmail", invitedEmail).Return(nil, dao.ErrNotFound)
+	userDao.On("SaveInvite", mock.MatchedBy(
+		func(i *s.Invite) bool {
+			return i.Email == invitedEmail && i.CodeHash != "" && i.InviterID == user.ID
+		})).Return(&s.Invite{ID: "invite-1", Email: invitedEmail, Status: s.InviteStatusPending}, nil)
+	userDao.On("Update", &updatedUser).Return(nil)
+	userDao.On("SetRecoveryCode", user.ID,
+		mock.MatchedBy(func(hashedCode string) bool { return hashedCode != "" }), mock.Anything).Return(nil)
+	userDao.On("GetRecoveryCode", user.ID).Return(&s.IssuedCode{Hash: hashedCode}, nil)
+	userDao.On(
 		"SetResettingCode",
 		user.ID,
 		mock.MatchedBy(func(hashedResettingCode string) bool { return hashedResettingCode != "" })).Return(nil)
-	dao.On("GetResettingCode", user.ID).Return(hashedCode, nil)
-	dao.On(
+	userDao.On("GetResettingCode", user.ID).Return(&s.IssuedCode{Hash: hashedCode}, nil)
+	userDao.On(
 		"ResetPassword",
 		user.ID,
 		mock.MatchedBy(func(hashedPassword string) bool { return hashedPassword != "" })).Return(nil)
-	dao.On("DeleteById", user.ID).Return(nil)
+	userDao.On("DeleteById", user.ID).Return(nil)
+	userDao.On("ClearVerificationCode", user.ID).Return(nil)
+	userDao.On("SaveAuditRecord", mock.Anything).Return(nil)
 
 	mailer := email.MailerMock{}
 	mailer.On("SendRecoveryCode", user.Email, mock.MatchedBy(
 		func(code string) bool {
 			return len(code) == 6
 		})).Return(nil)
-	mailer.On("SendInviteCode", user.Email, mock.MatchedBy(
+	mailer.On("SendInviteCode", invitedEmail, mock.MatchedBy(
 		func(code string) bool {
 			return len(code) == 32
 		})).Return(nil)
 
-	conf := Config{PrivKeyPath: "../test_data/private.pem", PubKeyPath: "../test_data/public.pem", AdminIDs: []int{user.ID}}
-	service := AuthService{UserDao: &dao, Mailer: &mailer, Config: conf}
+	conf := Config{PrivKeyPath: "../test_data/private.pem", PubKeyPath: "../test_data/public.pem", AdminIDs: []int{user.ID}, LegacyTokensUntil: "2100-01-01"}
+	service := AuthService{UserDao: &userDao, Mailer: &mailer, Config: conf}
 
 	auth := Auth{AuthService: &service}
 	go auth.start()
+	waitForServer()
+}
+
+func waitForServer() {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", "localhost:2525")
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
 }
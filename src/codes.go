@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+// Alphabets of generated codes. Numeric codes are typed by people, URL-safe ones are passed in links.
+const (
+	numericAlphabet = "0123456789"
+	urlSafeAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+)
+
+var alphabets = map[string]string{
+	"numeric": numericAlphabet,
+	"urlsafe": urlSafeAlphabet,
+}
+
+// Types of generated codes
+const (
+	codeVerification = "verification"
+	codeRecovery     = "recovery"
+	codeResetting    = "resetting"
+	codeInvite       = "invite"
+	codeInviteLink   = "inviteLink"
+	codeEmailChange  = "emailChange"
+)
+
+type codeFormat struct {
+	alphabet string
+	length   int
+}
+
+// defaultCodeFormats are used for code types without --codeFormat
+var defaultCodeFormats = map[string]codeFormat{
+	codeVerification: {numericAlphabet, 4},
+	codeRecovery:     {numericAlphabet, 6},
+	codeResetting:    {numericAlphabet, 10},
+	codeInvite:       {numericAlphabet, 32},
+	codeInviteLink:   {urlSafeAlphabet, 32},
+	codeEmailChange:  {numericAlphabet, 6},
+}
+
+// parseCodeFormats parses code formats given as "type:alphabet:length"
+func parseCodeFormats(entries []string) (map[string]codeFormat, error) {
+	formats := map[string]codeFormat{}
+	for _, entry := range entries {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("code format %q must be type:alphabet:length", entry)
+		}
+		if _, known := defaultCodeFormats[parts[0]]; !known {
+			return nil, fmt.Errorf("unknown code type %q", parts[0])
+		}
+		alphabet, known := alphabets[parts[1]]
+		if !known {
+			return nil, fmt.Errorf("unknown alphabet %q, must be numeric or urlsafe", parts[1])
+		}
+		length, err := strconv.Atoi(parts[2])
+		if err != nil || length < 4 || length > 128 {
+			return nil, fmt.Errorf("length of %s codes must be between 4 and 128", parts[0])
+		}
+		formats[parts[0]] = codeFormat{alphabet, length}
+	}
+	return formats, nil
+}
+
+// newCode generates random code of the type in its configured format
+func (s *AuthService) newCode(codeType string) (string, error) {
+	format, ok := s.Config.codeFormats[codeType]
+	if !ok {
+		format = defaultCodeFormats[codeType]
+	}
+	code, err := randomCode(format.alphabet, format.length)
+	if err != nil {
+		logger.Logf("ERROR Failed to generate code, %s", err.Error())
+		return "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return code, nil
+}
+
+// randomCode returns code of given length with characters picked uniformly from the alphabet by crypto/rand
+func randomCode(alphabet string, length int) (string, error) {
+	size := big.NewInt(int64(len(alphabet)))
+	code := make([]byte, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
+		}
+		code[i] = alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
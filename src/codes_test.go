@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chiSquare returns chi-square statistic of symbol counts against uniform distribution over the alphabet
+func chiSquare(alphabet string, codes []string) float64 {
+	counts := map[rune]int{}
+	total := 0
+	for _, code := range codes {
+		for _, c := range code {
+			counts[c]++
+			total++
+		}
+	}
+	expected := float64(total) / float64(len(alphabet))
+	sum := 0.0
+	for _, c := range alphabet {
+		diff := float64(counts[c]) - expected
+		sum += diff * diff / expected
+	}
+	return sum
+}
+
+func generateCodes(t *testing.T, alphabet string, length int, count int) []string {
+	codes := make([]string, count)
+	for i := range codes {
+		code, err := randomCode(alphabet, length)
+		assert.Nil(t, err)
+		codes[i] = code
+	}
+	return codes
+}
+
+func TestRandomCode_Format(t *testing.T) {
+	code, err := randomCode(numericAlphabet, 6)
+	assert.Nil(t, err)
+	assert.Len(t, code, 6)
+	assert.True(t, isDigits(code))
+
+	code, err = randomCode(urlSafeAlphabet, 32)
+	assert.Nil(t, err)
+	assert.Len(t, code, 32)
+	for _, c := range code {
+		assert.True(t, strings.ContainsRune(urlSafeAlphabet, c), code)
+	}
+}
+
+// Critical values of chi-square distribution for p = 1e-6 keep false failures negligible
+func TestRandomCode_Uniformity(t *testing.T) {
+	numeric := generateCodes(t, numericAlphabet, 10, 10000)
+	assert.Less(t, chiSquare(numericAlphabet, numeric), 46.0)
+
+	urlSafe := generateCodes(t, urlSafeAlphabet, 32, 5000)
+	assert.Less(t, chiSquare(urlSafeAlphabet, urlSafe), 132.0)
+}
+
+func TestRandomCode_PositionUniformity(t *testing.T) {
+	codes := generateCodes(t, numericAlphabet, 4, 20000)
+	for position := 0; position < 4; position++ {
+		column := make([]string, len(codes))
+		for i, code := range codes {
+			column[i] = code[position : position+1]
+		}
+		assert.Less(t, chiSquare(numericAlphabet, column), 46.0, "position %d", position)
+	}
+}
+
+func TestRandomCode_NoRepeats(t *testing.T) {
+	seen := map[string]bool{}
+	for _, code := range generateCodes(t, urlSafeAlphabet, 16, 10000) {
+		assert.False(t, seen[code], code)
+		seen[code] = true
+	}
+}
+
+func TestParseCodeFormats(t *testing.T) {
+	formats, err := parseCodeFormats([]string{"verification:numeric:6", "invite:urlsafe:24"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]codeFormat{
+		codeVerification: {numericAlphabet, 6},
+		codeInvite:       {urlSafeAlphabet, 24},
+	}, formats)
+
+	for _, entry := range []string{"verification", "unknown:numeric:6", "recovery:hex:6", "recovery:numeric:2", "recovery:numeric:x"} {
+		_, err = parseCodeFormats([]string{entry})
+		assert.NotNil(t, err, entry)
+	}
+}
+
+func TestAuthService_NewCode(t *testing.T) {
+	conf := createTestConfig()
+	conf.codeFormats = map[string]codeFormat{codeVerification: {urlSafeAlphabet, 8}}
+	s := AuthService{&mailer, nil, conf}
+
+	code, err := s.newCode(codeVerification)
+	assert.Nil(t, err)
+	assert.Len(t, code, 8)
+
+	code, err = s.newCode(codeRecovery)
+	assert.Nil(t, err)
+	assert.Len(t, code, 6)
+	assert.True(t, isDigits(code))
+}
@@ -0,0 +1,151 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2SaltBytes = 16
+	argon2KeyBytes  = 32
+
+	// maxArgon2PasswordBytes bounds passwords to a reasonable length, argon2 itself takes any
+	maxArgon2PasswordBytes = 1024
+
+	defaultArgon2Concurrency = 4
+)
+
+// argon2Slots bound Argon2id computations running at once, every one takes the configured memory
+var argon2Slots = make(chan struct{}, defaultArgon2Concurrency)
+
+// SetArgon2Concurrency sets how many Argon2id computations may run at once, others wait for a free slot.
+// It is meant to be called on start.
+func SetArgon2Concurrency(n int) error {
+	if n < 1 {
+		return errors.New("argon2 concurrency must be at least 1")
+	}
+	argon2Slots = make(chan struct{}, n)
+	return nil
+}
+
+// argon2Key derives key once a slot is free
+func argon2Key(password []byte, salt []byte, time uint32, memory uint32, threads uint8, keyLen uint32) []byte {
+	argon2Slots <- struct{}{}
+	defer func() { <-argon2Slots }()
+	return argon2.IDKey(password, salt, time, memory, threads, keyLen)
+}
+
+// argon2idHasher hashes with Argon2id, by default with parameters recommended in RFC 9106
+var argon2idHasher = &argon2Algorithm{memory: 64 * 1024, time: 3, threads: 4}
+
+type argon2Algorithm struct {
+	// memory in KiB
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// argon2Params are parameters of a stored hash along with its salt and key
+type argon2Params struct {
+	version int
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// SetArgon2Params sets memory in KiB, number of passes and parallelism of new Argon2id hashes, it is meant to be called on start.
+// Existing hashes keep their parameters until rehashed.
+func SetArgon2Params(memory uint32, time uint32, threads uint8) error {
+	if time < 1 || threads < 1 {
+		return errors.New("argon2 time and threads must be at least 1")
+	}
+	if memory < 8*uint32(threads) {
+		return fmt.Errorf("argon2 memory must be at least %d KiB for %d threads", 8*uint32(threads), threads)
+	}
+	argon2idHasher.memory = memory
+	argon2idHasher.time = time
+	argon2idHasher.threads = threads
+	return refreshDummyHash()
+}
+
+func (a *argon2Algorithm) Name() string {
+	return "argon2id"
+}
+
+func (a *argon2Algorithm) IDs() []string {
+	return []string{"argon2id"}
+}
+
+// Hash returns hash in PHC format: $argon2id$v=19$m=65536,t=3,p=4$salt$key
+func (a *argon2Algorithm) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltBytes)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2Key([]byte(password), salt, a.time, a.memory, a.threads, argon2KeyBytes)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.memory, a.time, a.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a *argon2Algorithm) Match(password, hash string) bool {
+	params, err := parseArgon2Hash(hash)
+	if err != nil || params.version != argon2.Version {
+		return false
+	}
+	key := argon2Key([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+	return subtle.ConstantTimeCompare(key, params.key) == 1
+}
+
+func (a *argon2Algorithm) Outdated(hash string) bool {
+	params, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+	return params.version != argon2.Version || params.memory < a.memory || params.time < a.time || len(params.key) < argon2KeyBytes
+}
+
+func (a *argon2Algorithm) MaxPasswordBytes() int {
+	return maxArgon2PasswordBytes
+}
+
+func parseArgon2Hash(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errors.New("invalid argon2id hash")
+	}
+
+	var params argon2Params
+	_, err := fmt.Sscanf(parts[2], "v=%d", &params.version)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return nil, err
+	}
+	if params.time < 1 || params.threads < 1 {
+		return nil, errors.New("invalid argon2id parameters")
+	}
+
+	params.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, err
+	}
+	params.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, err
+	}
+	if len(params.key) == 0 {
+		return nil, errors.New("invalid argon2id key")
+	}
+	return &params, nil
+}
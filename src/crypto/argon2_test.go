@@ -0,0 +1,78 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArgon2_Match(t *testing.T) {
+	hasher := &argon2Algorithm{memory: 64, time: 1, threads: 1}
+
+	hash, err := hasher.Hash("p@ssw0rd")
+	assert.Nil(t, err)
+	assert.True(t, hasher.Match("p@ssw0rd", hash))
+	assert.False(t, hasher.Match("password", hash))
+
+	anotherHash, err := hasher.Hash("p@ssw0rd")
+	assert.Nil(t, err)
+	assert.NotEqual(t, hash, anotherHash)
+}
+
+func TestArgon2_MatchMalformedHash(t *testing.T) {
+	for _, hash := range []string{
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=16$m=64,t=1,p=1$c29tZXNhbHQ$aGFzaA",
+		"$argon2id$v=19$m=64,t=0,p=1$c29tZXNhbHQ$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$aGFzaA",
+		"$argon2i$v=19$m=64,t=1,p=1$c29tZXNhbHQ$aGFzaA",
+	} {
+		assert.False(t, argon2idHasher.Match("password", hash), hash)
+	}
+}
+
+func TestArgon2_Outdated(t *testing.T) {
+	weak := &argon2Algorithm{memory: 64, time: 1, threads: 1}
+	strong := &argon2Algorithm{memory: 128, time: 2, threads: 1}
+
+	weakHash, err := weak.Hash("p@ssw0rd")
+	assert.Nil(t, err)
+	strongHash, err := strong.Hash("p@ssw0rd")
+	assert.Nil(t, err)
+
+	assert.True(t, strong.Outdated(weakHash))
+	assert.False(t, strong.Outdated(strongHash))
+	assert.False(t, weak.Outdated(strongHash))
+}
+
+func TestSetArgon2Params(t *testing.T) {
+	defer SetArgon2Params(64*1024, 3, 4)
+
+	assert.NotNil(t, SetArgon2Params(64, 0, 1))
+	assert.NotNil(t, SetArgon2Params(64, 1, 0))
+	assert.NotNil(t, SetArgon2Params(16, 1, 4))
+	assert.Nil(t, SetArgon2Params(64, 1, 1))
+	assert.Equal(t, uint32(64), argon2idHasher.memory)
+}
+
+func TestSetArgon2Concurrency(t *testing.T) {
+	defer SetArgon2Concurrency(defaultArgon2Concurrency)
+
+	assert.NotNil(t, SetArgon2Concurrency(0))
+	assert.Nil(t, SetArgon2Concurrency(1))
+	assert.Equal(t, 1, cap(argon2Slots))
+
+	hasher := &argon2Algorithm{memory: 64, time: 1, threads: 1}
+	hashes := make(chan string, 4)
+	for i := 0; i < cap(hashes); i++ {
+		go func() {
+			hash, _ := hasher.Hash("p@ssw0rd")
+			hashes <- hash
+		}()
+	}
+	for i := 0; i < cap(hashes); i++ {
+		assert.True(t, hasher.Match("p@ssw0rd", <-hashes))
+	}
+	assert.Len(t, argon2Slots, 0)
+}
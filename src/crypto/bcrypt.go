@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptHasher hashes with bcrypt, which is the only algorithm of hashes made by previous versions
+var bcryptHasher = &bcryptAlgorithm{cost: bcrypt.MinCost}
+
+type bcryptAlgorithm struct {
+	// cost is the work factor of new hashes
+	cost int
+}
+
+// SetCost sets bcrypt work factor of new hashes, it is meant to be called on start.
+// Existing hashes keep their cost until rehashed.
+func SetCost(cost int) error {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	bcryptHasher.cost = cost
+	return refreshDummyHash()
+}
+
+func (a *bcryptAlgorithm) Name() string {
+	return "bcrypt"
+}
+
+func (a *bcryptAlgorithm) IDs() []string {
+	return []string{"2a", "2b", "2y"}
+}
+
+func (a *bcryptAlgorithm) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), a.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (a *bcryptAlgorithm) Match(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (a *bcryptAlgorithm) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost < a.cost
+}
+
+// MaxPasswordBytes of bcrypt is 72, the rest of the password is ignored
+func (a *bcryptAlgorithm) MaxPasswordBytes() int {
+	return 72
+}
@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// codeMACPrefix marks codes stored as HMAC-SHA256, so they are told apart from salted hashes made by previous versions
+const codeMACPrefix = "$hmac-sha256$"
+
+// codeKey keys MACs of codes. It is random until server secret is set, so codes do not outlive the process then.
+var codeKey = randomKey()
+
+func randomKey() []byte {
+	key := make([]byte, sha256.Size)
+	_, _ = rand.Read(key)
+	return key
+}
+
+// SetCodeKey derives key of code MACs from server secret, it is meant to be called on start.
+// Codes issued with another key stop matching.
+func SetCodeKey(secret []byte) error {
+	if len(secret) == 0 {
+		return errors.New("code secret is empty")
+	}
+	sum := sha256.Sum256(secret)
+	codeKey = sum[:]
+	return nil
+}
+
+// HashCode returns HMAC-SHA256 of short random code keyed with server secret. Unlike Digest every possible code
+// can not be tried against it without the secret, unlike Hash it is cheap enough for codes anyone can request.
+func HashCode(code string) string {
+	mac := hmac.New(sha256.New, codeKey)
+	mac.Write([]byte(code))
+	return codeMACPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// MatchCode compares code with stored MAC in constant time.
+// Codes stored by previous versions as salted hashes are matched with their algorithm.
+func MatchCode(code, stored string) bool {
+	if !strings.HasPrefix(stored, codeMACPrefix) {
+		return Match(code, stored)
+	}
+	return subtle.ConstantTimeCompare([]byte(HashCode(code)), []byte(stored)) == 1
+}
+
+// dummyCodeMAC is a MAC nobody knows code of
+var dummyCodeMAC = HashCode(dummyPassword)
+
+// DummyMatchCode compares code with a MAC nobody knows code of, like DummyMatch does with hashes
+func DummyMatchCode(code string) {
+	MatchCode(code, dummyCodeMAC)
+}
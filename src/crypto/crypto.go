@@ -1,24 +1,130 @@
 package crypto
 
 import (
-	"golang.org/x/crypto/bcrypt"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
 )
 
-// Hash salts password and hashes it, returning salted hash
-func Hash(password string) (string, error) {
-	hash, er := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
-	if er != nil {
-		return "", er
+// Hasher hashes passwords with one algorithm. Hashes are strings in PHC format starting with $id$ of the algorithm,
+// followed by its parameters, salt and hash, so hashes made with any parameters can be matched.
+type Hasher interface {
+	// Name identifies the algorithm in configuration
+	Name() string
+	// IDs are identifiers of the algorithm in hashes
+	IDs() []string
+	// Hash salts password and hashes it with current parameters
+	Hash(password string) (string, error)
+	// Match compares password with the hash
+	Match(password, hash string) bool
+	// Outdated tells whether the hash is weaker than the ones made with current parameters
+	Outdated(hash string) bool
+	// MaxPasswordBytes is the longest password the algorithm takes into account
+	MaxPasswordBytes() int
+}
+
+var (
+	// hashers by identifiers of their algorithms in hashes
+	hashers = map[string]Hasher{}
+	// preferred hasher makes new hashes
+	preferred Hasher = bcryptHasher
+)
+
+func init() {
+	Register(bcryptHasher)
+	Register(argon2idHasher)
+}
+
+// Register adds hasher, so hashes of its algorithm can be matched and it can be preferred
+func Register(h Hasher) {
+	for _, id := range h.IDs() {
+		hashers[id] = h
 	}
-	return string(hash), nil
 }
 
-// Match compares password with salted hashed value
+// Use makes hasher of the algorithm preferred for new hashes, it is meant to be called on start.
+// Hashes of other algorithms still match and can be replaced once password is known.
+func Use(name string) error {
+	for _, h := range hashers {
+		if h.Name() == name {
+			preferred = h
+			return refreshDummyHash()
+		}
+	}
+	return fmt.Errorf("unknown hashing algorithm %s", name)
+}
+
+// Hash salts password and hashes it with the preferred algorithm, returning salted hash
+func Hash(password string) (string, error) {
+	return preferred.Hash(password)
+}
+
+// Match compares password with salted hash of any registered algorithm
 func Match(password, hash string) bool {
-	byteHash := []byte(hash)
-	err := bcrypt.CompareHashAndPassword(byteHash, []byte(password))
-	if err != nil {
+	h := hasherOf(hash)
+	return h != nil && h.Match(password, hash)
+}
+
+// NeedsRehash tells whether the hash is made by other than preferred algorithm or with weaker parameters,
+// so it should be replaced by a new hash of the matched password. Password longer than the algorithm takes into account
+// is not confirmed entirely, so it is not rehashed.
+func NeedsRehash(password, hash string) bool {
+	h := hasherOf(hash)
+	if h == nil || len(password) > h.MaxPasswordBytes() {
 		return false
 	}
-	return true
+	return h != preferred || h.Outdated(hash)
+}
+
+// MaxPasswordBytes is the longest password the preferred algorithm takes into account
+func MaxPasswordBytes() int {
+	return preferred.MaxPasswordBytes()
+}
+
+// hasherOf finds hasher by algorithm id at the start of the hash, nil is returned for unknown algorithms
+func hasherOf(hash string) Hasher {
+	if !strings.HasPrefix(hash, "$") {
+		return nil
+	}
+	id := strings.SplitN(hash[1:], "$", 2)[0]
+	return hashers[id]
+}
+
+const dummyPassword = "dummy password"
+
+// dummyHash is made like new hashes, matching against it takes as long as matching a real one
+var dummyHash, _ = Hash(dummyPassword)
+
+// refreshDummyHash makes dummy hash again after preferred algorithm or its parameters change
+func refreshDummyHash() error {
+	hash, err := Hash(dummyPassword)
+	if err != nil {
+		return err
+	}
+	dummyHash = hash
+	return nil
+}
+
+// DummyMatch compares password with a hash nobody knows password of.
+// It is used when there is no real hash to compare with, so response time does not tell that.
+func DummyMatch(password string) {
+	Match(password, dummyHash)
+}
+
+// Digest returns hex encoded SHA-256 of the value. Unlike Hash it is deterministic,
+// so it suits long random tokens which are looked up by their digest.
+func Digest(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// MatchDigest compares long random token with stored digest in constant time.
+// Tokens stored by previous versions as salted hashes are matched with their algorithm.
+func MatchDigest(value, digest string) bool {
+	if hasherOf(digest) != nil {
+		return Match(value, digest)
+	}
+	return subtle.ConstantTimeCompare([]byte(Digest(value)), []byte(digest)) == 1
 }
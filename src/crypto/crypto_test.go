@@ -1,9 +1,11 @@
 package crypto
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestCrypto(t *testing.T) {
@@ -19,3 +21,95 @@ func TestCrypto(t *testing.T) {
 	matchFail := Match(wrongPassword, hash)
 	assert.False(t, matchFail)
 }
+
+func TestSetCost(t *testing.T) {
+	defer SetCost(bcrypt.MinCost)
+
+	weakHash, err := Hash("p@ssw0rd")
+	assert.Nil(t, err)
+	assert.False(t, NeedsRehash("p@ssw0rd", weakHash))
+
+	assert.NotNil(t, SetCost(bcrypt.MinCost-1))
+	assert.NotNil(t, SetCost(bcrypt.MaxCost+1))
+	assert.Nil(t, SetCost(bcrypt.MinCost+1))
+
+	hash, err := Hash("p@ssw0rd")
+	assert.Nil(t, err)
+	hashCost, _ := bcrypt.Cost([]byte(hash))
+	assert.Equal(t, bcrypt.MinCost+1, hashCost)
+	assert.False(t, NeedsRehash("p@ssw0rd", hash))
+	assert.True(t, NeedsRehash("p@ssw0rd", weakHash))
+	assert.True(t, Match("p@ssw0rd", weakHash))
+	assert.False(t, NeedsRehash("p@ssw0rd", "not a hash"))
+}
+
+func TestUse(t *testing.T) {
+	defer Use("bcrypt")
+	assert.Nil(t, SetArgon2Params(64, 1, 1))
+	defer SetArgon2Params(64*1024, 3, 4)
+
+	bcryptHash, err := Hash("p@ssw0rd")
+	assert.Nil(t, err)
+
+	assert.NotNil(t, Use("md5"))
+	assert.Nil(t, Use("argon2id"))
+	assert.Equal(t, maxArgon2PasswordBytes, MaxPasswordBytes())
+
+	argon2Hash, err := Hash("p@ssw0rd")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(argon2Hash, "$argon2id$v=19$m=64,t=1,p=1$"))
+	assert.True(t, strings.HasPrefix(dummyHash, "$argon2id$"))
+
+	assert.True(t, Match("p@ssw0rd", bcryptHash))
+	assert.True(t, Match("p@ssw0rd", argon2Hash))
+	assert.False(t, Match("password", argon2Hash))
+	assert.False(t, Match("p@ssw0rd", "$scrypt$ln=16,r=8,p=1$c2FsdA$aGFzaA"))
+
+	assert.True(t, NeedsRehash("p@ssw0rd", bcryptHash))
+	assert.False(t, NeedsRehash("p@ssw0rd", argon2Hash))
+	assert.False(t, NeedsRehash(strings.Repeat("p", 73), bcryptHash))
+}
+
+func TestDummyMatch(t *testing.T) {
+	assert.NotEmpty(t, dummyHash)
+	assert.False(t, Match("dummy", dummyHash))
+	DummyMatch("p@ssw0rd")
+}
+
+func TestDigest(t *testing.T) {
+	assert.Equal(t, Digest("token"), Digest("token"))
+	assert.NotEqual(t, Digest("token"), Digest("token2"))
+	assert.Len(t, Digest("token"), 64)
+}
+
+func TestMatchDigest(t *testing.T) {
+	legacyHash, err := Hash("267483")
+	assert.Nil(t, err)
+
+	assert.True(t, MatchDigest("267483", Digest("267483")))
+	assert.False(t, MatchDigest("267484", Digest("267483")))
+	assert.False(t, MatchDigest("267483", ""))
+	assert.True(t, MatchDigest("267483", legacyHash))
+	assert.False(t, MatchDigest("267484", legacyHash))
+}
+
+func TestMatchCode(t *testing.T) {
+	defer SetCodeKey([]byte("secret"))
+	assert.NotNil(t, SetCodeKey(nil))
+	assert.Nil(t, SetCodeKey([]byte("secret")))
+
+	legacyHash, err := Hash("267483")
+	assert.Nil(t, err)
+	hash := HashCode("267483")
+
+	assert.True(t, strings.HasPrefix(hash, codeMACPrefix))
+	assert.NotEqual(t, codeMACPrefix+Digest("267483"), hash)
+	assert.True(t, MatchCode("267483", hash))
+	assert.False(t, MatchCode("267484", hash))
+	assert.False(t, MatchCode("267483", ""))
+	assert.True(t, MatchCode("267483", legacyHash))
+	assert.False(t, MatchCode("267484", legacyHash))
+
+	assert.Nil(t, SetCodeKey([]byte("another secret")))
+	assert.False(t, MatchCode("267483", hash))
+}
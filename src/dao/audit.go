@@ -0,0 +1,24 @@
+package dao
+
+import (
+	"context"
+
+	s "ruslanlesko/brightonum/src/structs"
+)
+
+const auditCollectionName = "audit"
+
+// SaveAuditRecord appends admin action to the audit log
+func (d *MongoUserDao) SaveAuditRecord(ctx context.Context, r *s.AuditRecord) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(auditCollectionName)
+
+	_, err := collection.InsertOne(ctx, r)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return classifyError(err)
+	}
+	return nil
+}
@@ -1,50 +1,168 @@
 package dao
 
-import "ruslanlesko/brightonum/src/structs"
+import (
+	"context"
+	"time"
 
-// UserDao provides interface to persisting operations
+	"ruslanlesko/brightonum/src/structs"
+)
+
+// UserDao provides interface to persisting operations.
+// Every operation is bound to the passed context and reports failures with sentinel errors:
+// ErrNotFound if the user does not exist, ErrTimeout or ErrUnavailable if database cannot serve it.
 type UserDao interface {
 
 	// Save Returns generated id (> 0) on success.
-	// Returns -1 on internal failure.
-	Save(*structs.User) int
+	// Returns ErrDuplicateUsername or ErrDuplicateEmail if username or email is taken,
+	// usernames reserved after a change count as taken.
+	Save(context.Context, *structs.User) (int, error)
+
+	// GetByUsername returns user by username
+	GetByUsername(context.Context, string) (*structs.User, error)
+
+	// GetByEmail returns user by email
+	GetByEmail(context.Context, string) (*structs.User, error)
 
-	// GetByUsername returns nil when user is not found
-	// Returns error if data access error occured
-	GetByUsername(string) (*structs.User, error)
+	// GetByUUID returns user by immutable identifier
+	GetByUUID(context.Context, string) (*structs.User, error)
 
-	// GetByEmail returns nil when user is not found
-	// Returns error if data access error occured
-	GetByEmail(string) (*structs.User, error)
+	// AssignUUID gives user id created before UUIDs were introduced its own one and returns the UUID user has
+	AssignUUID(context.Context, int) (string, error)
 
-	// Get returns nil when user is not found
-	// Returns error if data access error occured
-	Get(int) (*structs.User, error)
+	// GetMigrationAppliedAt returns time migration of the version was applied, ErrNotFound if it is pending
+	GetMigrationAppliedAt(context.Context, int) (time.Time, error)
+
+	// Get returns user by id
+	Get(context.Context, int) (*structs.User, error)
 
 	// GetAll returns all users or empty list
-	GetAll() (*[]structs.User, error)
+	GetAll(context.Context) (*[]structs.User, error)
+
+	// Find returns a page of registered users matching the query
+	// Returns ErrInvalidQuery if query or its cursor is malformed
+	Find(context.Context, UserQuery) (*UserPage, error)
+
+	// Search returns a page of registered users matching the text, most relevant first
+	// Returns ErrInvalidQuery if query or its cursor is malformed
+	Search(context.Context, SearchQuery) (*UserPage, error)
 
 	// Update updates user if exists
-	Update(*structs.User) error
+	// Returns ErrDuplicateEmail if email is taken
+	Update(context.Context, *structs.User) error
+
+	// SetRecoveryCode sets password recovery code for user id, issued now, if previous code was issued before given time
+	// Returns ErrNotFound otherwise
+	SetRecoveryCode(context.Context, int, string, time.Time) error
 
-	// SetRecoveryCode sets password recovery code for user id
-	SetRecoveryCode(int, string) error
+	// GetRecoveryCode extracts recovery code for user id, hash is empty if not set
+	GetRecoveryCode(context.Context, int) (*structs.IssuedCode, error)
 
-	// GetRecoveryCode extracts recovery code for user id
-	GetRecoveryCode(int) (string, error)
+	// SetResettingCode sets resetting code, issued now, and removes recovery one
+	SetResettingCode(context.Context, int, string) error
 
-	// SetResettingCode sets resetting code and removes recovery one
-	SetResettingCode(int, string) error
+	// GetResettingCode extracts resetting code for user id, hash is empty if not set
+	GetResettingCode(context.Context, int) (*structs.IssuedCode, error)
 
-	// GetResettingCode extracts resetting code for user id
-	GetResettingCode(int) (string, error)
+	// TakeCodeAttempt counts attempt to enter code of the kind for user id unless max attempts were taken
+	TakeCodeAttempt(context.Context, int, string, int) error
 
 	// ResetPassword updates password and removes resetting code
-	ResetPassword(int, string) error
+	ResetPassword(context.Context, int, string) error
+
+	// RehashPassword replaces password hash of user id with a new hash of the same password.
+	// Returns ErrNotFound if the password was changed since the old hash was read.
+	RehashPassword(context.Context, int, string, string) error
+
+	// DeleteById marks user as deleted, deleted users are not returned by other operations
+	DeleteById(context.Context, int) error
 
-	// DeleteById deletes user by id
-	DeleteById(int) error
+	// Restore brings back deleted user, returns ErrNotFound if there is no deleted user with id
+	Restore(context.Context, int) error
+
+	// PurgeDeleted permanently removes users deleted before the given time and returns their number
+	PurgeDeleted(context.Context, time.Time) (int, error)
 
 	// ClearVerificationCode clears verification code for user id
-	ClearVerificationCode(int) error
+	ClearVerificationCode(context.Context, int) error
+
+	// ReplaceVerificationCode stores new verification code hash and expiry for user id and resets attempts if previous code was sent before given time
+	ReplaceVerificationCode(context.Context, int, string, *time.Time, time.Time) error
+
+	// TakeVerificationAttempt counts attempt to verify email of user id unless max attempts were taken
+	TakeVerificationAttempt(context.Context, int, int) error
+
+	// SetEmailChange stores pending email change for user id
+	SetEmailChange(context.Context, int, *structs.EmailChange) error
+
+	// ChangeEmail sets confirmed email for user id, removing pending change and verification code
+	// Returns ErrDuplicateEmail if email is taken
+	ChangeEmail(context.Context, int, string) error
+
+	// RevokeTokens invalidates tokens of user id issued before the given time
+	RevokeTokens(context.Context, int, time.Time) error
+
+	// ChangeUsername changes username of user id and reserves previous one for that user until the given time
+	// Returns ErrDuplicateUsername if username is taken or reserved by another user
+	ChangeUsername(context.Context, int, string, time.Time) error
+
+	// GetUsernameHolder returns id of the user who reserved username by changing it
+	// Returns ErrNotFound if username is not reserved
+	GetUsernameHolder(context.Context, string) (int, error)
+
+	// SetStatus replaces account status for user id
+	SetStatus(context.Context, int, structs.AccountStatus) error
+
+	// ApproveUser activates pending account of user id
+	ApproveUser(context.Context, int) error
+
+	// SaveAuditRecord appends admin action to the audit log
+	SaveAuditRecord(context.Context, *structs.AuditRecord) error
+
+	// GetProfileSchema returns schema of custom profile attributes
+	GetProfileSchema(context.Context) (*structs.ProfileSchema, error)
+
+	// SaveProfileSchema replaces schema of custom profile attributes
+	SaveProfileSchema(context.Context, *structs.ProfileSchema) error
+
+	// GetMetadata returns metadata of user id in the namespace
+	GetMetadata(context.Context, int, string) (*structs.Metadata, error)
+
+	// PutMetadata replaces metadata of user id in the namespace if it has expected version, returns the new version
+	PutMetadata(context.Context, int, string, string, int64) (int64, error)
+
+	// DeleteMetadata removes metadata of user id in the namespace if it has expected version
+	DeleteMetadata(context.Context, int, string, int64) error
+
+	// SaveInvite stores pending invite, reusing pending invite of the same email, and returns stored one
+	SaveInvite(context.Context, *structs.Invite) (*structs.Invite, error)
+
+	// GetInvite returns invite by id
+	GetInvite(context.Context, string) (*structs.Invite, error)
+
+	// GetPendingInvite returns pending invite of the email
+	GetPendingInvite(context.Context, string) (*structs.Invite, error)
+
+	// ListInvites returns a page of invites matching the query
+	ListInvites(context.Context, InviteQuery) (*InvitePage, error)
+
+	// SetInviteStatus moves invite with id from one status to another, recording positive id of accepting user
+	SetInviteStatus(context.Context, string, string, string, int) error
+
+	// SaveInviteLink stores new invite link, assigning its id
+	SaveInviteLink(context.Context, *structs.InviteLink) error
+
+	// GetInviteLinkByTokenHash returns invite link by digest of its token
+	GetInviteLinkByTokenHash(context.Context, string) (*structs.InviteLink, error)
+
+	// ListInviteLinks returns a page of invite links, newest first
+	ListInviteLinks(context.Context, InviteLinkQuery) (*InviteLinkPage, error)
+
+	// UseInviteLink atomically takes one use of usable invite link with id
+	UseInviteLink(context.Context, string) error
+
+	// ReleaseInviteLink gives back one use of invite link with id
+	ReleaseInviteLink(context.Context, string) error
+
+	// RevokeInviteLink makes invite link with id unusable
+	RevokeInviteLink(context.Context, string) error
 }
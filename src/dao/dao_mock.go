@@ -1,21 +1,25 @@
 package dao
 
 import (
+	"context"
 	"ruslanlesko/brightonum/src/structs"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 )
 
-// MockUserDao for testing only
+// MockUserDao for testing only.
+// Context is not recorded, so expectations are set without it.
 type MockUserDao struct {
 	mock.Mock
 }
 
-func (m *MockUserDao) Save(u *structs.User) int {
-	return m.Called(u).Int(0)
+func (m *MockUserDao) Save(ctx context.Context, u *structs.User) (int, error) {
+	args := m.Called(u)
+	return args.Int(0), args.Error(1)
 }
 
-func (m *MockUserDao) GetByUsername(uname string) (*structs.User, error) {
+func (m *MockUserDao) GetByUsername(ctx context.Context, uname string) (*structs.User, error) {
 	provided := m.Called(uname).Get(0)
 	err := m.Called(uname).Get(1)
 	var castedErr error = nil
@@ -28,7 +32,7 @@ func (m *MockUserDao) GetByUsername(uname string) (*structs.User, error) {
 	return provided.(*structs.User), castedErr
 }
 
-func (m *MockUserDao) GetByEmail(uname string) (*structs.User, error) {
+func (m *MockUserDao) GetByEmail(ctx context.Context, uname string) (*structs.User, error) {
 	provided := m.Called(uname).Get(0)
 	err := m.Called(uname).Get(1)
 	var castedErr error = nil
@@ -41,7 +45,30 @@ func (m *MockUserDao) GetByEmail(uname string) (*structs.User, error) {
 	return provided.(*structs.User), castedErr
 }
 
-func (m *MockUserDao) Get(id int) (*structs.User, error) {
+func (m *MockUserDao) AssignUUID(ctx context.Context, id int) (string, error) {
+	args := m.Called(id)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockUserDao) GetMigrationAppliedAt(ctx context.Context, version int) (time.Time, error) {
+	args := m.Called(version)
+	return args.Get(0).(time.Time), args.Error(1)
+}
+
+func (m *MockUserDao) GetByUUID(ctx context.Context, uuid string) (*structs.User, error) {
+	provided := m.Called(uuid).Get(0)
+	err := m.Called(uuid).Get(1)
+	var castedErr error = nil
+	if err != nil {
+		castedErr = err.(error)
+	}
+	if provided == nil {
+		return nil, castedErr
+	}
+	return provided.(*structs.User), castedErr
+}
+
+func (m *MockUserDao) Get(ctx context.Context, id int) (*structs.User, error) {
 	provided := m.Called(id).Get(0)
 	err := m.Called(id).Get(1)
 	var castedErr error = nil
@@ -54,7 +81,7 @@ func (m *MockUserDao) Get(id int) (*structs.User, error) {
 	return provided.(*structs.User), castedErr
 }
 
-func (m *MockUserDao) GetAll() (*[]structs.User, error) {
+func (m *MockUserDao) GetAll(ctx context.Context) (*[]structs.User, error) {
 	provided := m.Called().Get(0)
 	err := m.Called().Get(1)
 	var castedErr error = nil
@@ -67,7 +94,25 @@ func (m *MockUserDao) GetAll() (*[]structs.User, error) {
 	return provided.(*[]structs.User), castedErr
 }
 
-func (m *MockUserDao) Update(u *structs.User) error {
+func (m *MockUserDao) Find(ctx context.Context, q UserQuery) (*UserPage, error) {
+	args := m.Called(q)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*UserPage), args.Error(1)
+}
+
+func (m *MockUserDao) Search(ctx context.Context, q SearchQuery) (*UserPage, error) {
+	args := m.Called(q)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*UserPage), args.Error(1)
+}
+
+func (m *MockUserDao) Update(ctx context.Context, u *structs.User) error {
 	err := m.Called(u).Get(0)
 	var castedErr error = nil
 	if err != nil {
@@ -76,8 +121,8 @@ func (m *MockUserDao) Update(u *structs.User) error {
 	return castedErr
 }
 
-func (m *MockUserDao) SetRecoveryCode(id int, code string) error {
-	err := m.Called(id, code).Get(0)
+func (m *MockUserDao) SetRecoveryCode(ctx context.Context, id int, code string, issuedBefore time.Time) error {
+	err := m.Called(id, code, issuedBefore).Get(0)
 	var castedErr error = nil
 	if err != nil {
 		castedErr = err.(error)
@@ -85,28 +130,189 @@ func (m *MockUserDao) SetRecoveryCode(id int, code string) error {
 	return castedErr
 }
 
-func (m *MockUserDao) GetRecoveryCode(id int) (string, error) {
+func (m *MockUserDao) GetRecoveryCode(ctx context.Context, id int) (*structs.IssuedCode, error) {
 	args := m.Called(id)
-	return args.String(0), args.Error(1)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*structs.IssuedCode), args.Error(1)
 }
 
-func (m *MockUserDao) SetResettingCode(id int, code string) error {
+func (m *MockUserDao) SetResettingCode(ctx context.Context, id int, code string) error {
 	return m.Called(id, code).Error(0)
 }
 
-func (m *MockUserDao) GetResettingCode(id int) (string, error) {
+func (m *MockUserDao) GetResettingCode(ctx context.Context, id int) (*structs.IssuedCode, error) {
 	args := m.Called(id)
-	return args.String(0), args.Error(1)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*structs.IssuedCode), args.Error(1)
+}
+
+func (m *MockUserDao) TakeCodeAttempt(ctx context.Context, id int, kind string, maxAttempts int) error {
+	return m.Called(id, kind, maxAttempts).Error(0)
 }
 
-func (m *MockUserDao) ResetPassword(id int, passwordHash string) error {
+func (m *MockUserDao) ResetPassword(ctx context.Context, id int, passwordHash string) error {
 	return m.Called(id, passwordHash).Error(0)
 }
 
-func (m *MockUserDao) DeleteById(id int) error {
+func (m *MockUserDao) RehashPassword(ctx context.Context, id int, oldHash string, newHash string) error {
+	return m.Called(id, oldHash, newHash).Error(0)
+}
+
+func (m *MockUserDao) DeleteById(ctx context.Context, id int) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *MockUserDao) Restore(ctx context.Context, id int) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *MockUserDao) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	args := m.Called(before)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockUserDao) ReplaceVerificationCode(ctx context.Context, id int, codeHash string, expiresAt *time.Time, sentBefore time.Time) error {
+	return m.Called(id, codeHash, expiresAt, sentBefore).Error(0)
+}
+
+func (m *MockUserDao) TakeVerificationAttempt(ctx context.Context, id int, maxAttempts int) error {
+	return m.Called(id, maxAttempts).Error(0)
+}
+
+func (m *MockUserDao) ClearVerificationCode(ctx context.Context, id int) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *MockUserDao) SetEmailChange(ctx context.Context, id int, change *structs.EmailChange) error {
+	return m.Called(id, change).Error(0)
+}
+
+func (m *MockUserDao) ChangeEmail(ctx context.Context, id int, email string) error {
+	return m.Called(id, email).Error(0)
+}
+
+func (m *MockUserDao) RevokeTokens(ctx context.Context, id int, before time.Time) error {
+	return m.Called(id, before).Error(0)
+}
+
+func (m *MockUserDao) ChangeUsername(ctx context.Context, id int, username string, reserveUntil time.Time) error {
+	return m.Called(id, username, reserveUntil).Error(0)
+}
+
+func (m *MockUserDao) GetUsernameHolder(ctx context.Context, username string) (int, error) {
+	args := m.Called(username)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockUserDao) ApproveUser(ctx context.Context, id int) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *MockUserDao) SetStatus(ctx context.Context, id int, status structs.AccountStatus) error {
+	return m.Called(id, status).Error(0)
+}
+
+func (m *MockUserDao) SaveAuditRecord(ctx context.Context, r *structs.AuditRecord) error {
+	return m.Called(r).Error(0)
+}
+
+func (m *MockUserDao) GetProfileSchema(ctx context.Context) (*structs.ProfileSchema, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*structs.ProfileSchema), args.Error(1)
+}
+
+func (m *MockUserDao) SaveProfileSchema(ctx context.Context, schema *structs.ProfileSchema) error {
+	return m.Called(schema).Error(0)
+}
+
+func (m *MockUserDao) GetMetadata(ctx context.Context, userID int, namespace string) (*structs.Metadata, error) {
+	args := m.Called(userID, namespace)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*structs.Metadata), args.Error(1)
+}
+
+func (m *MockUserDao) PutMetadata(ctx context.Context, userID int, namespace string, data string, expected int64) (int64, error) {
+	args := m.Called(userID, namespace, data, expected)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockUserDao) DeleteMetadata(ctx context.Context, userID int, namespace string, expected int64) error {
+	return m.Called(userID, namespace, expected).Error(0)
+}
+
+func (m *MockUserDao) SaveInvite(ctx context.Context, invite *structs.Invite) (*structs.Invite, error) {
+	args := m.Called(invite)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*structs.Invite), args.Error(1)
+}
+
+func (m *MockUserDao) GetInvite(ctx context.Context, id string) (*structs.Invite, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*structs.Invite), args.Error(1)
+}
+
+func (m *MockUserDao) GetPendingInvite(ctx context.Context, email string) (*structs.Invite, error) {
+	args := m.Called(email)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*structs.Invite), args.Error(1)
+}
+
+func (m *MockUserDao) ListInvites(ctx context.Context, q InviteQuery) (*InvitePage, error) {
+	args := m.Called(q)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*InvitePage), args.Error(1)
+}
+
+func (m *MockUserDao) SetInviteStatus(ctx context.Context, id string, from string, to string, acceptedBy int) error {
+	return m.Called(id, from, to, acceptedBy).Error(0)
+}
+
+func (m *MockUserDao) SaveInviteLink(ctx context.Context, link *structs.InviteLink) error {
+	return m.Called(link).Error(0)
+}
+
+func (m *MockUserDao) GetInviteLinkByTokenHash(ctx context.Context, tokenHash string) (*structs.InviteLink, error) {
+	args := m.Called(tokenHash)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*structs.InviteLink), args.Error(1)
+}
+
+func (m *MockUserDao) ListInviteLinks(ctx context.Context, q InviteLinkQuery) (*InviteLinkPage, error) {
+	args := m.Called(q)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*InviteLinkPage), args.Error(1)
+}
+
+func (m *MockUserDao) UseInviteLink(ctx context.Context, id string) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *MockUserDao) ReleaseInviteLink(ctx context.Context, id string) error {
 	return m.Called(id).Error(0)
 }
 
-func (m *MockUserDao) ClearVerificationCode(id int) error {
+func (m *MockUserDao) RevokeInviteLink(ctx context.Context, id string) error {
 	return m.Called(id).Error(0)
 }
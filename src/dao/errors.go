@@ -0,0 +1,65 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+var (
+	// ErrNotFound is returned when requested user does not exist
+	ErrNotFound = errors.New("user does not exist")
+
+	// ErrDuplicateUsername is returned when username is taken by another user
+	ErrDuplicateUsername = errors.New("username already exists")
+
+	// ErrDuplicateEmail is returned when email is taken by another user
+	ErrDuplicateEmail = errors.New("email already exists")
+
+	// ErrInvalidQuery is returned when query parameters or cursor cannot be used
+	ErrInvalidQuery = errors.New("invalid query")
+
+	// ErrVersionMismatch is returned when conditional write expected another version of the document
+	ErrVersionMismatch = errors.New("version does not match")
+
+	// ErrTimeout is returned when database did not respond within operation deadline
+	ErrTimeout = errors.New("database operation timed out")
+
+	// ErrUnavailable is returned when database cannot be reached
+	ErrUnavailable = errors.New("database is unavailable")
+
+	// errDuplicateID is returned when another user got the same id, insertion should be retried
+	errDuplicateID = errors.New("id already exists")
+)
+
+// classifyError converts driver error into one of sentinel errors:
+// unique index violations into ErrDuplicateUsername, ErrDuplicateEmail or errDuplicateID,
+// timeouts into ErrTimeout and connectivity failures into ErrUnavailable.
+// Other errors are returned as is.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		msg := err.Error()
+		switch {
+		case strings.Contains(msg, usernameIndexName):
+			return ErrDuplicateUsername
+		case strings.Contains(msg, emailIndexName):
+			return ErrDuplicateEmail
+		}
+		return errDuplicateID
+	}
+	if errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err) {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	var selectionErr topology.ServerSelectionError
+	if mongo.IsNetworkError(err) || errors.As(err, &selectionErr) || errors.Is(err, mongo.ErrClientDisconnected) {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
+}
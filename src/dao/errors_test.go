@@ -0,0 +1,30 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func duplicateKeyError(index string) error {
+	return mongo.WriteException{WriteErrors: []mongo.WriteError{{
+		Code:    11000,
+		Message: "E11000 duplicate key error collection: db.users index: " + index + " dup key: { }",
+	}}}
+}
+
+func TestClassifyError(t *testing.T) {
+	assert.Nil(t, classifyError(nil))
+	assert.Equal(t, ErrDuplicateUsername, classifyError(duplicateKeyError(usernameIndexName)))
+	assert.Equal(t, ErrDuplicateEmail, classifyError(duplicateKeyError(emailIndexName)))
+	assert.Equal(t, errDuplicateID, classifyError(duplicateKeyError("_id_")))
+	assert.True(t, errors.Is(classifyError(fmt.Errorf("find: %w", context.DeadlineExceeded)), ErrTimeout))
+	assert.True(t, errors.Is(classifyError(mongo.ErrClientDisconnected), ErrUnavailable))
+
+	other := errors.New("boom")
+	assert.Equal(t, other, classifyError(other))
+}
@@ -0,0 +1,138 @@
+package dao
+
+import (
+	s "ruslanlesko/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	usernameIndexName     = "username_unique"
+	emailIndexName        = "email_unique"
+	inviteExpiryIndexName = "inviteExpiresAt_ttl"
+	createdAtIndexName    = "createdAt_id"
+	searchIndexName       = "search_text"
+	deletedAtIndexName    = "deletedAt"
+	uuidIndexName         = "uuid_unique"
+
+	reservationExpiryIndexName = "expiresAt_ttl"
+	metadataIndexName          = "userId_namespace_unique"
+	pendingInviteIndexName     = "email_pending_unique"
+	inviteCreatedAtIndexName   = "createdAt_id"
+	inviteLinkTokenIndexName   = "tokenHash_unique"
+)
+
+// Bootstrap creates indexes of users, username reservations, metadata, invites and invite links collections.
+// At most one invite of an email can be pending. Safe to call on every start.
+// Usernames and emails are stored in lower case, so plain unique indexes are case-insensitive.
+// Both unique indexes skip invite placeholders, which have no username yet,
+// but cover deleted users, so their usernames and emails stay reserved.
+func (d *MongoUserDao) Bootstrap() error {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	registered := bson.M{"username": bson.M{"$gt": ""}}
+
+	models := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetName(usernameIndexName).SetUnique(true).SetPartialFilterExpression(registered),
+		},
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetName(emailIndexName).SetUnique(true).SetPartialFilterExpression(registered),
+		},
+		{
+			Keys:    bson.D{{Key: "uuid", Value: 1}},
+			Options: options.Index().SetName(uuidIndexName).SetUnique(true).SetPartialFilterExpression(bson.M{"uuid": bson.M{"$type": "string"}}),
+		},
+		{
+			Keys:    bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName(createdAtIndexName),
+		},
+		{
+			Keys: bson.D{
+				{Key: "username", Value: "text"},
+				{Key: "firstName", Value: "text"},
+				{Key: "lastName", Value: "text"},
+				{Key: "email", Value: "text"},
+			},
+			Options: options.Index().
+				SetName(searchIndexName).
+				SetWeights(bson.M{"username": 10, "email": 5, "firstName": 3, "lastName": 3}).
+				SetDefaultLanguage("none"),
+		},
+		{
+			Keys:    bson.D{{Key: "deletedAt", Value: 1}},
+			Options: options.Index().SetName(deletedAtIndexName).SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "inviteExpiresAt", Value: 1}},
+			Options: options.Index().SetName(inviteExpiryIndexName).SetExpireAfterSeconds(0),
+		},
+	}
+
+	_, err := collection.Indexes().CreateMany(d.Ctx, models)
+	if err != nil {
+		logger.Logf("ERROR Failed to create indexes: %s", err)
+		return err
+	}
+
+	reservations := d.Client.Database(d.DatabaseName).Collection(usernamesCollectionName)
+	_, err = reservations.Indexes().CreateOne(d.Ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetName(reservationExpiryIndexName).SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		logger.Logf("ERROR Failed to create username reservation index: %s", err)
+		return err
+	}
+
+	metadata := d.Client.Database(d.DatabaseName).Collection(metadataCollectionName)
+	_, err = metadata.Indexes().CreateOne(d.Ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "namespace", Value: 1}},
+		Options: options.Index().SetName(metadataIndexName).SetUnique(true),
+	})
+	if err != nil {
+		logger.Logf("ERROR Failed to create metadata index: %s", err)
+		return err
+	}
+
+	invites := d.Client.Database(d.DatabaseName).Collection(invitesCollectionName)
+	_, err = invites.Indexes().CreateMany(d.Ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().
+				SetName(pendingInviteIndexName).
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"status": s.InviteStatusPending}),
+		},
+		{
+			Keys:    bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName(inviteCreatedAtIndexName),
+		},
+	})
+	if err != nil {
+		logger.Logf("ERROR Failed to create invite indexes: %s", err)
+		return err
+	}
+
+	links := d.Client.Database(d.DatabaseName).Collection(inviteLinksCollectionName)
+	_, err = links.Indexes().CreateMany(d.Ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tokenHash", Value: 1}},
+			Options: options.Index().SetName(inviteLinkTokenIndexName).SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName(inviteCreatedAtIndexName),
+		},
+	})
+	if err != nil {
+		logger.Logf("ERROR Failed to create invite link indexes: %s", err)
+		return err
+	}
+	logger.Logf("INFO Indexes are in place")
+	return nil
+}
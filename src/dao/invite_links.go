@@ -0,0 +1,155 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	s "ruslanlesko/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const inviteLinksCollectionName = "inviteLinks"
+
+// InviteLinkQuery describes a page of invite links, newest first
+type InviteLinkQuery struct {
+	// Limit is maximum number of links in the page, must be positive
+	Limit int
+	// Cursor is NextCursor of the previous page, empty for the first page
+	Cursor string
+}
+
+// InviteLinkPage is a page of invite links with cursor of the next one, which is empty for the last page
+type InviteLinkPage struct {
+	Links      []s.InviteLink
+	NextCursor string
+}
+
+// SaveInviteLink stores new invite link, assigning its id
+func (d *MongoUserDao) SaveInviteLink(ctx context.Context, link *s.InviteLink) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(inviteLinksCollectionName)
+
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	link.ID = id
+
+	_, err = collection.InsertOne(ctx, link)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return classifyError(err)
+	}
+	return nil
+}
+
+// GetInviteLinkByTokenHash returns invite link by digest of its token
+func (d *MongoUserDao) GetInviteLinkByTokenHash(ctx context.Context, tokenHash string) (*s.InviteLink, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(inviteLinksCollectionName)
+
+	result := &s.InviteLink{}
+	err := collection.FindOne(ctx, bson.M{"tokenHash": tokenHash}).Decode(result)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+	return result, nil
+}
+
+// ListInviteLinks returns a page of invite links
+func (d *MongoUserDao) ListInviteLinks(ctx context.Context, q InviteLinkQuery) (*InviteLinkPage, error) {
+	if q.Limit <= 0 {
+		return nil, ErrInvalidQuery
+	}
+	offset, err := decodeOffsetCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(inviteLinksCollectionName)
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(q.Limit + 1))
+
+	cur, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+	defer cur.Close(ctx)
+
+	links := []s.InviteLink{}
+	err = cur.All(ctx, &links)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+
+	page := &InviteLinkPage{Links: links}
+	if len(links) > q.Limit {
+		page.Links = links[:q.Limit]
+		page.NextCursor = encodeOffsetCursor(offset + q.Limit)
+	}
+	return page, nil
+}
+
+// UseInviteLink takes one use of the link in a single update, so concurrent registrations
+// can not exceed its maximum uses. ErrNotFound is returned if the link is revoked, expired or used up.
+func (d *MongoUserDao) UseInviteLink(ctx context.Context, id string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(inviteLinksCollectionName)
+
+	filter := bson.M{
+		"_id":      id,
+		"revoked":  false,
+		"usesLeft": bson.M{"$gt": 0},
+		"$or": bson.A{
+			bson.M{"expiresAt": bson.M{"$exists": false}},
+			bson.M{"expiresAt": bson.M{"$gt": time.Now().UTC()}},
+		},
+	}
+	res, err := collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"usesLeft": -1}})
+	return updateResultError(res, err)
+}
+
+// ReleaseInviteLink gives back the use taken by UseInviteLink
+func (d *MongoUserDao) ReleaseInviteLink(ctx context.Context, id string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(inviteLinksCollectionName)
+
+	filter := bson.M{"_id": id, "$expr": bson.M{"$lt": bson.A{"$usesLeft", "$maxUses"}}}
+	res, err := collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"usesLeft": 1}})
+	return updateResultError(res, err)
+}
+
+// RevokeInviteLink makes the link unusable, ErrNotFound is returned if there is no such link which is not revoked yet
+func (d *MongoUserDao) RevokeInviteLink(ctx context.Context, id string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(inviteLinksCollectionName)
+
+	update := bson.M{"$set": bson.M{"revoked": true, "revokedAt": time.Now().UTC()}}
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": id, "revoked": false}, update)
+	return updateResultError(res, err)
+}
@@ -0,0 +1,198 @@
+package dao
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	s "ruslanlesko/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const invitesCollectionName = "invites"
+
+// InviteQuery describes a page of invites, newest first
+type InviteQuery struct {
+	// Status limits the page to invites with the status, including derived expired one, empty for all
+	Status string
+	// Limit is maximum number of invites in the page, must be positive
+	Limit int
+	// Cursor is NextCursor of the previous page, empty for the first page
+	Cursor string
+}
+
+// InvitePage is a page of invites with cursor of the next one, which is empty for the last page
+type InvitePage struct {
+	Invites    []s.Invite
+	NextCursor string
+}
+
+// SaveInvite stores pending invite for the email. Pending invite of the same email, even expired one,
+// gets new code, inviter, expiry and profile instead of being duplicated. Returns stored invite.
+func (d *MongoUserDao) SaveInvite(ctx context.Context, invite *s.Invite) (*s.Invite, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(invitesCollectionName)
+
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	set := bson.M{
+		"codeHash":     invite.CodeHash,
+		"inviterId":    invite.InviterID,
+		"sentAt":       invite.SentAt,
+		"firstName":    invite.FirstName,
+		"lastName":     invite.LastName,
+		"roles":        invite.Roles,
+		"organization": invite.Organization,
+		"attributes":   invite.Attributes,
+	}
+	update := bson.M{
+		"$set":         set,
+		"$setOnInsert": bson.M{"_id": id, "createdAt": invite.SentAt},
+	}
+	if invite.ExpiresAt != nil {
+		set["expiresAt"] = invite.ExpiresAt
+	} else {
+		update["$unset"] = bson.M{"expiresAt": ""}
+	}
+
+	filter := bson.M{"email": strings.ToLower(invite.Email), "status": s.InviteStatusPending}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	result := &s.Invite{}
+	err = collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+	return result, nil
+}
+
+// GetInvite returns invite by id
+func (d *MongoUserDao) GetInvite(ctx context.Context, id string) (*s.Invite, error) {
+	return d.findInvite(ctx, bson.M{"_id": id})
+}
+
+// GetPendingInvite returns pending invite of the email
+func (d *MongoUserDao) GetPendingInvite(ctx context.Context, email string) (*s.Invite, error) {
+	return d.findInvite(ctx, bson.M{"email": strings.ToLower(email), "status": s.InviteStatusPending})
+}
+
+func (d *MongoUserDao) findInvite(ctx context.Context, filter bson.M) (*s.Invite, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(invitesCollectionName)
+
+	result := &s.Invite{}
+	err := collection.FindOne(ctx, filter).Decode(result)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+	return result, nil
+}
+
+// ListInvites returns a page of invites matching the query
+func (d *MongoUserDao) ListInvites(ctx context.Context, q InviteQuery) (*InvitePage, error) {
+	if q.Limit <= 0 {
+		return nil, ErrInvalidQuery
+	}
+	offset, err := decodeOffsetCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := inviteFilter(q.Status, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(invitesCollectionName)
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(q.Limit + 1))
+
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+	defer cur.Close(ctx)
+
+	invites := []s.Invite{}
+	err = cur.All(ctx, &invites)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+
+	page := &InvitePage{Invites: invites}
+	if len(invites) > q.Limit {
+		page.Invites = invites[:q.Limit]
+		page.NextCursor = encodeOffsetCursor(offset + q.Limit)
+	}
+	return page, nil
+}
+
+// inviteFilter matches invites with the status, pending ones are split into still valid and expired
+func inviteFilter(status string, now time.Time) (bson.M, error) {
+	switch status {
+	case "":
+		return bson.M{}, nil
+	case s.InviteStatusPending:
+		return bson.M{"status": s.InviteStatusPending, "$or": bson.A{
+			bson.M{"expiresAt": bson.M{"$exists": false}},
+			bson.M{"expiresAt": bson.M{"$gt": now}},
+		}}, nil
+	case s.InviteStatusExpired:
+		return bson.M{"status": s.InviteStatusPending, "expiresAt": bson.M{"$lte": now}}, nil
+	case s.InviteStatusAccepted, s.InviteStatusRevoked:
+		return bson.M{"status": status}, nil
+	}
+	return nil, ErrInvalidQuery
+}
+
+// SetInviteStatus moves invite from one status to another, ErrNotFound is returned if invite is not in the from status.
+// Positive acceptedBy records the user who registered with the invite.
+func (d *MongoUserDao) SetInviteStatus(ctx context.Context, id string, from string, to string, acceptedBy int) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(invitesCollectionName)
+
+	set := bson.M{"status": to}
+	update := bson.M{"$set": set}
+	switch {
+	case to == s.InviteStatusAccepted && acceptedBy > 0:
+		set["acceptedBy"] = acceptedBy
+	case to == s.InviteStatusAccepted:
+		set["acceptedAt"] = time.Now().UTC()
+	default:
+		update["$unset"] = bson.M{"acceptedAt": "", "acceptedBy": ""}
+	}
+
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": id, "status": from}, update)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return classifyError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
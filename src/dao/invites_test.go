@@ -0,0 +1,30 @@
+package dao
+
+import (
+	"testing"
+	"time"
+
+	s "ruslanlesko/brightonum/src/structs"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestInviteFilter(t *testing.T) {
+	now := time.Now()
+
+	filter, err := inviteFilter("", now)
+	assert.Nil(t, err)
+	assert.Empty(t, filter)
+
+	filter, err = inviteFilter(s.InviteStatusExpired, now)
+	assert.Nil(t, err)
+	assert.Equal(t, bson.M{"status": s.InviteStatusPending, "expiresAt": bson.M{"$lte": now}}, filter)
+
+	filter, err = inviteFilter(s.InviteStatusRevoked, now)
+	assert.Nil(t, err)
+	assert.Equal(t, bson.M{"status": s.InviteStatusRevoked}, filter)
+
+	_, err = inviteFilter("lost", now)
+	assert.Equal(t, ErrInvalidQuery, err)
+}
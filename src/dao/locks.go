@@ -0,0 +1,48 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const locksCollectionName = "locks"
+
+// newLockOwner returns identifier of the lock owner, unique across replicas
+func newLockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+}
+
+// tryLock takes named lock for the lease period and reports false if another owner holds it.
+// Lock expires after the lease, so a crashed replica does not hold it forever.
+func (d *MongoUserDao) tryLock(ctx context.Context, id string, owner string, lease time.Duration) (bool, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(locksCollectionName)
+
+	now := time.Now().UTC()
+	filter := bson.M{"_id": id, "lockedUntil": bson.M{"$lt": now}}
+	update := bson.M{"$set": bson.M{"owner": owner, "lockedUntil": now.Add(lease)}}
+
+	_, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err == nil {
+		return true, nil
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// releaseLock releases named lock if it is still held by the owner
+func (d *MongoUserDao) releaseLock(ctx context.Context, id string, owner string) {
+	collection := d.Client.Database(d.DatabaseName).Collection(locksCollectionName)
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": id, "owner": owner})
+	if err != nil {
+		logger.Logf("WARN Cannot release %s lock: %s", id, err)
+	}
+}
@@ -0,0 +1,118 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	s "ruslanlesko/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const metadataCollectionName = "metadata"
+
+// Expected versions of metadata for conditional writes, positive values require exactly that version
+const (
+	// AnyVersion makes write unconditional
+	AnyVersion int64 = -1
+	// NoVersion makes write succeed only if there is no metadata yet
+	NoVersion int64 = 0
+)
+
+func metadataFilter(userID int, namespace string) bson.M {
+	return bson.M{"userId": userID, "namespace": namespace}
+}
+
+// GetMetadata returns metadata of the user in the namespace
+func (d *MongoUserDao) GetMetadata(ctx context.Context, userID int, namespace string) (*s.Metadata, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(metadataCollectionName)
+
+	result := &s.Metadata{}
+	err := collection.FindOne(ctx, metadataFilter(userID, namespace)).Decode(result)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+	return result, nil
+}
+
+// PutMetadata replaces metadata of the user in the namespace if stored version is the expected one
+// and returns the new version
+func (d *MongoUserDao) PutMetadata(ctx context.Context, userID int, namespace string, data string, expected int64) (int64, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(metadataCollectionName)
+	now := time.Now().UTC()
+
+	if expected == NoVersion {
+		m := s.Metadata{UserID: userID, Namespace: namespace, Data: data, Version: 1, UpdatedAt: now}
+		_, err := collection.InsertOne(ctx, &m)
+		if mongo.IsDuplicateKeyError(err) {
+			return 0, ErrVersionMismatch
+		}
+		if err != nil {
+			logger.Logf("ERROR %s", err)
+			return 0, classifyError(err)
+		}
+		return m.Version, nil
+	}
+
+	filter := metadataFilter(userID, namespace)
+	if expected != AnyVersion {
+		filter["version"] = expected
+	}
+	update := bson.M{"$set": bson.M{"data": data, "updatedAt": now}, "$inc": bson.M{"version": 1}}
+	opts := options.FindOneAndUpdate().SetUpsert(expected == AnyVersion).SetReturnDocument(options.After)
+
+	result := &s.Metadata{}
+	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(result)
+	if err == mongo.ErrNoDocuments {
+		return 0, ErrVersionMismatch
+	}
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return 0, classifyError(err)
+	}
+	return result.Version, nil
+}
+
+// DeleteMetadata removes metadata of the user in the namespace if stored version is the expected one
+func (d *MongoUserDao) DeleteMetadata(ctx context.Context, userID int, namespace string, expected int64) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(metadataCollectionName)
+
+	filter := metadataFilter(userID, namespace)
+	if expected != AnyVersion {
+		filter["version"] = expected
+	}
+	res, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return classifyError(err)
+	}
+	if res.DeletedCount == 0 {
+		if expected == AnyVersion {
+			return ErrNotFound
+		}
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// deleteUsersMetadata removes metadata of all namespaces of the users
+func (d *MongoUserDao) deleteUsersMetadata(ctx context.Context, userIDs []int) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(metadataCollectionName)
+	_, err := collection.DeleteMany(ctx, bson.M{"userId": bson.M{"$in": userIDs}})
+	return err
+}
@@ -0,0 +1,308 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ruslanlesko/brightonum/src/crypto"
+	s "ruslanlesko/brightonum/src/structs"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	migrationsCollectionName = "migrations"
+	migrationLockID          = "migrations"
+	migrationLockLease       = 10 * time.Minute
+	migrationLockPoll        = time.Second
+
+	// UUIDMigration is version of the migration assigning UUIDs to all users
+	UUIDMigration = 3
+)
+
+// Migration transforms stored documents from previous schema version to the next one.
+// Migrations must be backward compatible with the previous release, because during
+// rolling deploy old replicas keep serving requests after migration is applied.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+}
+
+// MigrationStatus describes registered migration and when it was applied
+type MigrationStatus struct {
+	Version     int
+	Description string
+	AppliedAt   *time.Time
+}
+
+type appliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// migrations lists all known migrations. New ones are appended with the next version.
+var migrations = []Migration{
+	{Version: 1, Description: "Store emails in lower case", Up: lowerCaseEmails},
+	{Version: 2, Description: "Set unknown creation time to Unix epoch", Up: backfillCreatedAt},
+	{Version: UUIDMigration, Description: "Assign UUIDs to users", Up: assignUUIDs},
+	{Version: 4, Description: "Copy invite placeholders to invites", Up: copyInvitePlaceholders},
+}
+
+// MigrateUp applies all pending migrations in version order and returns number of applied ones.
+// Only one replica runs migrations at a time, others wait for the lock and then find nothing to apply.
+func (d *MongoUserDao) MigrateUp() (int, error) {
+	err := validateMigrations(migrations)
+	if err != nil {
+		return 0, err
+	}
+
+	owner, err := d.acquireMigrationLock()
+	if err != nil {
+		return 0, err
+	}
+	defer d.releaseMigrationLock(owner)
+
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	db := d.Client.Database(d.DatabaseName)
+	collection := db.Collection(migrationsCollectionName)
+
+	count := 0
+	for _, m := range pendingMigrations(migrations, applied) {
+		logger.Logf("INFO Applying migration %d: %s", m.Version, m.Description)
+		err = m.Up(d.Ctx, db)
+		if err != nil {
+			logger.Logf("ERROR Migration %d failed: %s", m.Version, err)
+			return count, fmt.Errorf("migration %d failed: %w", m.Version, err)
+		}
+
+		record := appliedMigration{Version: m.Version, Description: m.Description, AppliedAt: time.Now().UTC()}
+		_, err = collection.InsertOne(d.Ctx, &record)
+		if err != nil {
+			logger.Logf("ERROR Cannot record migration %d: %s", m.Version, err)
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// MigrationStatus lists registered migrations along with their application time
+func (d *MongoUserDao) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []MigrationStatus{}
+	for _, m := range sortedMigrations(migrations) {
+		status := MigrationStatus{Version: m.Version, Description: m.Description}
+		if record, ok := applied[m.Version]; ok {
+			appliedAt := record.AppliedAt
+			status.AppliedAt = &appliedAt
+		}
+		result = append(result, status)
+	}
+	return result, nil
+}
+
+// GetMigrationAppliedAt returns time migration of the version was applied, ErrNotFound if it is pending
+func (d *MongoUserDao) GetMigrationAppliedAt(ctx context.Context, version int) (time.Time, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(migrationsCollectionName)
+
+	record := appliedMigration{}
+	err := collection.FindOne(ctx, bson.M{"_id": version}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return time.Time{}, classifyError(err)
+	}
+	return record.AppliedAt, nil
+}
+
+func (d *MongoUserDao) appliedMigrations() (map[int]appliedMigration, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(migrationsCollectionName)
+
+	cur, err := collection.Find(d.Ctx, bson.M{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	defer cur.Close(d.Ctx)
+
+	result := map[int]appliedMigration{}
+	for cur.Next(d.Ctx) {
+		record := appliedMigration{}
+		err = cur.Decode(&record)
+		if err != nil {
+			logger.Logf("ERROR %s", err)
+			return nil, err
+		}
+		result[record.Version] = record
+	}
+	return result, nil
+}
+
+// acquireMigrationLock blocks until the lock is taken or lease period passes
+func (d *MongoUserDao) acquireMigrationLock() (string, error) {
+	owner := newLockOwner()
+	deadline := time.Now().Add(migrationLockLease)
+
+	for {
+		locked, err := d.tryLock(d.Ctx, migrationLockID, owner, migrationLockLease)
+		if err != nil {
+			logger.Logf("ERROR Cannot acquire migration lock: %s", err)
+			return "", err
+		}
+		if locked {
+			return owner, nil
+		}
+
+		if time.Now().After(deadline) {
+			return "", errors.New("migration lock is held by another process")
+		}
+		logger.Logf("INFO Migrations are running elsewhere, waiting")
+		time.Sleep(migrationLockPoll)
+	}
+}
+
+func (d *MongoUserDao) releaseMigrationLock(owner string) {
+	d.releaseLock(d.Ctx, migrationLockID, owner)
+}
+
+func validateMigrations(ms []Migration) error {
+	seen := map[int]bool{}
+	for _, m := range ms {
+		if m.Version <= 0 {
+			return fmt.Errorf("migration version must be positive, got %d", m.Version)
+		}
+		if seen[m.Version] {
+			return fmt.Errorf("migration version %d is registered twice", m.Version)
+		}
+		if m.Up == nil {
+			return fmt.Errorf("migration %d has no Up function", m.Version)
+		}
+		seen[m.Version] = true
+	}
+	return nil
+}
+
+func sortedMigrations(ms []Migration) []Migration {
+	result := make([]Migration, len(ms))
+	copy(result, ms)
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result
+}
+
+func pendingMigrations(ms []Migration, applied map[int]appliedMigration) []Migration {
+	result := []Migration{}
+	for _, m := range sortedMigrations(ms) {
+		if _, ok := applied[m.Version]; !ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func lowerCaseEmails(ctx context.Context, db *mongo.Database) error {
+	pipeline := mongo.Pipeline{{{Key: "$set", Value: bson.M{"email": bson.M{"$toLower": "$email"}}}}}
+	_, err := db.Collection(collectionName).UpdateMany(ctx, bson.M{"email": bson.M{"$type": "string"}}, pipeline)
+	return err
+}
+
+// backfillCreatedAt makes creation time present on every user, so listing sorted by it can be paged
+func backfillCreatedAt(ctx context.Context, db *mongo.Database) error {
+	update := bson.M{"$set": bson.M{"createdAt": time.Unix(0, 0).UTC()}}
+	_, err := db.Collection(collectionName).UpdateMany(ctx, bson.M{"createdAt": bson.M{"$exists": false}}, update)
+	return err
+}
+
+// assignUUIDs gives every user created before UUIDs were introduced its own one
+func assignUUIDs(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(collectionName)
+	missing := bson.M{"uuid": bson.M{"$exists": false}}
+
+	cursor, err := collection.Find(ctx, missing, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID int `bson:"_id"`
+		}
+		err = cursor.Decode(&doc)
+		if err != nil {
+			return err
+		}
+		id, err := newUUID()
+		if err != nil {
+			return err
+		}
+		_, err = collection.UpdateOne(ctx, bson.M{"_id": doc.ID, "uuid": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"uuid": id}})
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// copyInvitePlaceholders turns users created by invites of previous versions into pending invites.
+// Placeholders are kept for replicas of the previous release and expire by themselves if invite expiration was set.
+func copyInvitePlaceholders(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection(collectionName)
+	invites := db.Collection(invitesCollectionName)
+
+	placeholders := bson.M{"inviteCode": bson.M{"$gt": ""}, "username": bson.M{"$in": bson.A{"", nil}}}
+	cursor, err := users.Find(ctx, placeholders)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var u s.User
+		err = cursor.Decode(&u)
+		if err != nil {
+			return err
+		}
+		id, err := newUUID()
+		if err != nil {
+			return err
+		}
+		invite := s.Invite{
+			ID:        id,
+			Email:     u.Email,
+			CodeHash:  crypto.Digest(u.InviteCode),
+			CreatedAt: u.CreatedAt,
+			SentAt:    u.CreatedAt,
+			ExpiresAt: u.InviteExpiresAt,
+			Status:    s.InviteStatusPending,
+		}
+		_, err = invites.InsertOne(ctx, &invite)
+		// Email already has pending invite, copied by previous attempt or sent again since
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
@@ -0,0 +1,34 @@
+package dao
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func noop(ctx context.Context, db *mongo.Database) error {
+	return nil
+}
+
+func TestMigrations_Registered(t *testing.T) {
+	assert.Nil(t, validateMigrations(migrations))
+}
+
+func TestMigrations_Validate(t *testing.T) {
+	assert.NotNil(t, validateMigrations([]Migration{{Version: 0, Up: noop}}))
+	assert.NotNil(t, validateMigrations([]Migration{{Version: 1, Up: noop}, {Version: 1, Up: noop}}))
+	assert.NotNil(t, validateMigrations([]Migration{{Version: 1}}))
+	assert.Nil(t, validateMigrations([]Migration{{Version: 2, Up: noop}, {Version: 1, Up: noop}}))
+}
+
+func TestMigrations_Pending(t *testing.T) {
+	ms := []Migration{{Version: 3, Up: noop}, {Version: 1, Up: noop}, {Version: 2, Up: noop}}
+	applied := map[int]appliedMigration{2: {Version: 2}}
+
+	pending := pendingMigrations(ms, applied)
+	assert.Equal(t, 2, len(pending))
+	assert.Equal(t, 1, pending[0].Version)
+	assert.Equal(t, 3, pending[1].Version)
+}
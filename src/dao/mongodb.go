@@ -2,11 +2,13 @@ package dao
 
 import (
 	"context"
+	"errors"
 	"os"
 	"os/signal"
 	s "ruslanlesko/brightonum/src/structs"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-pkgz/lgr"
 
@@ -20,11 +22,31 @@ var logger = lgr.New(loggerFormat)
 
 const collectionName string = "users"
 
+// Kinds of password recovery codes, each kind is stored in the field of the same name
+const (
+	RecoveryCode  = "recoveryCode"
+	ResettingCode = "resettingCode"
+)
+
+const (
+	purgeLockID    = "purge"
+	purgeLockLease = 10 * time.Minute
+)
+
+// notDeleted adds condition which skips soft deleted users to the filter
+func notDeleted(filter bson.M) bson.M {
+	filter["deletedAt"] = bson.M{"$exists": false}
+	return filter
+}
+
 // MongoUserDao provides UserDao implementation via MongoDB
 type MongoUserDao struct {
 	Client       *mongo.Client
 	DatabaseName string
-	Ctx          context.Context
+	// Ctx lives until shutdown, used for startup tasks such as bootstrap and migrations
+	Ctx context.Context
+	// Timeout limits every UserDao operation, zero means no limit
+	Timeout time.Duration
 }
 
 // MaxIDResponse for response on pipe. Used for extracting current max id
@@ -34,7 +56,7 @@ type MaxIDResponse struct {
 }
 
 // NewMongoUserDao creates instance of MongoUserDao
-func NewMongoUserDao(URL string, databaseName string) *MongoUserDao {
+func NewMongoUserDao(URL string, databaseName string, timeout time.Duration) *MongoUserDao {
 	ctx, cancel := context.WithCancel(context.Background())
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(URL))
 
@@ -44,7 +66,7 @@ func NewMongoUserDao(URL string, databaseName string) *MongoUserDao {
 	}
 	logger.Logf("INFO Connected to MongoDB")
 
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	go func() {
 		for range sigChan {
 			logger.Logf("INFO disconnecting from MongoDB")
@@ -55,46 +77,79 @@ func NewMongoUserDao(URL string, databaseName string) *MongoUserDao {
 	}()
 	signal.Notify(sigChan, syscall.SIGTERM)
 
-	return &MongoUserDao{Client: client, DatabaseName: databaseName, Ctx: ctx}
+	return &MongoUserDao{Client: client, DatabaseName: databaseName, Ctx: ctx, Timeout: timeout}
+}
+
+// withTimeout derives context for a single operation from caller's one
+func (d *MongoUserDao) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d.Timeout)
 }
 
 // Save saves user in MongoDB.
 // Implemented to retry insertion several times if another thread inserts document between
 // calculation of new id and insertion into collection.
-func (d *MongoUserDao) Save(u *s.User) int {
+func (d *MongoUserDao) Save(ctx context.Context, u *s.User) (int, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
 	u.Username = strings.ToLower(u.Username)
-	return d.doSave(u, 5)
+	u.Email = strings.ToLower(u.Email)
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now().UTC()
+	}
+	if u.UUID == "" {
+		id, err := newUUID()
+		if err != nil {
+			return 0, err
+		}
+		u.UUID = id
+	}
+
+	if u.Username != "" {
+		_, err := d.usernameHolder(ctx, u.Username)
+		if err == nil {
+			return 0, ErrDuplicateUsername
+		}
+		if err != ErrNotFound {
+			return 0, err
+		}
+	}
+
+	return d.doSave(ctx, u, 5)
 }
 
-func (d *MongoUserDao) doSave(u *s.User, attemptsLeft int) int {
+func (d *MongoUserDao) doSave(ctx context.Context, u *s.User, attemptsLeft int) (int, error) {
 	if attemptsLeft == 0 {
-		return -1
+		return 0, errors.New("failed to allocate user id")
 	}
 
 	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
 
-	newID := findNextID(d.Ctx, collection)
-
-	if newID < 0 {
-		return -1
+	newID, err := findNextID(ctx, collection)
+	if err != nil {
+		return 0, classifyError(err)
 	}
 	u.ID = newID
 
-	_, err := collection.InsertOne(d.Ctx, &u)
+	_, err = collection.InsertOne(ctx, &u)
 	if err != nil {
 		logger.Logf("ERROR %s", err)
 
+		err = classifyError(err)
 		// Retry if another document was inserted at this moment
-		if strings.Contains(err.Error(), "duplicate") {
-			return d.doSave(u, attemptsLeft-1)
+		if err == errDuplicateID {
+			return d.doSave(ctx, u, attemptsLeft-1)
 		}
-		return -1
+		return 0, err
 	}
 
-	return newID
+	return newID, nil
 }
 
-func findNextID(ctx context.Context, collection *mongo.Collection) int {
+func findNextID(ctx context.Context, collection *mongo.Collection) (int, error) {
 	resp := &MaxIDResponse{}
 
 	cur, err := collection.Aggregate(ctx, []bson.M{
@@ -104,94 +159,104 @@ func findNextID(ctx context.Context, collection *mongo.Collection) int {
 		},
 		},
 	})
-	defer cur.Close(ctx)
-
 	if err != nil {
 		logger.Logf("ERROR %s", err.Error())
-		return -1
+		return -1, err
 	}
+	defer cur.Close(ctx)
 
 	if cur.Next(ctx) {
 		cur.Decode(resp)
-		return resp.MaxID + 1
+		return resp.MaxID + 1, nil
 	}
 
-	return 1
+	return 1, nil
 }
 
 // GetByUsername extracts user by username
-func (d *MongoUserDao) GetByUsername(username string) (*s.User, error) {
-	result := &s.User{}
+func (d *MongoUserDao) GetByUsername(ctx context.Context, username string) (*s.User, error) {
+	return d.findOne(ctx, bson.M{"username": strings.ToLower(username)})
+}
 
-	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
-	err := collection.FindOne(d.Ctx, bson.M{
-		"username": strings.ToLower(username),
-	}).Decode(result)
+// GetByEmail extracts user by email
+func (d *MongoUserDao) GetByEmail(ctx context.Context, email string) (*s.User, error) {
+	return d.findOne(ctx, bson.M{"email": strings.ToLower(email)})
+}
+
+// GetByUUID returns user by immutable identifier
+func (d *MongoUserDao) GetByUUID(ctx context.Context, uuid string) (*s.User, error) {
+	return d.findOne(ctx, bson.M{"uuid": uuid})
+}
 
+// AssignUUID gives user id created before UUIDs were introduced its own one, like migration 3 does.
+// UUID assigned meanwhile by another request or the migration is kept and returned.
+func (d *MongoUserDao) AssignUUID(ctx context.Context, id int) (string, error) {
+	uuid, err := newUUID()
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, nil
-		}
-		logger.Logf("ERROR %s", err)
-		return nil, err
+		return "", err
 	}
 
-	return result, nil
-}
-
-// GetByEmail returns nil when user is not found
-// Returns error if data access error occured
-func (d *MongoUserDao) GetByEmail(email string) (*s.User, error) {
-	result := &s.User{}
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
 	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
-	err := collection.FindOne(d.Ctx, bson.M{
-		"email": strings.ToLower(email),
-	}).Decode(result)
 
+	filter := bson.M{"_id": id, "uuid": bson.M{"$exists": false}}
+	res, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"uuid": uuid}})
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, nil
-		}
 		logger.Logf("ERROR %s", err)
-		return nil, err
+		return "", classifyError(err)
+	}
+	if res.ModifiedCount > 0 {
+		return uuid, nil
 	}
 
-	return result, nil
+	u, err := d.Get(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return u.UUID, nil
 }
 
 // Get returns user by id
-func (d *MongoUserDao) Get(id int) (*s.User, error) {
+func (d *MongoUserDao) Get(ctx context.Context, id int) (*s.User, error) {
+	return d.findOne(ctx, bson.M{"_id": id})
+}
+
+func (d *MongoUserDao) findOne(ctx context.Context, filter bson.M) (*s.User, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
 	result := &s.User{}
 
 	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
-
-	err := collection.FindOne(d.Ctx, bson.M{
-		"_id": id,
-	}).Decode(result)
+	err := collection.FindOne(ctx, notDeleted(filter)).Decode(result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, nil
+			return nil, ErrNotFound
 		}
 		logger.Logf("ERROR %s", err)
-		return nil, err
+		return nil, classifyError(err)
 	}
 
 	return result, nil
 }
 
 // GetAll extracts all users
-func (d *MongoUserDao) GetAll() (*[]s.User, error) {
+func (d *MongoUserDao) GetAll(ctx context.Context) (*[]s.User, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
 	result := []s.User{}
 
 	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
-	cur, err := collection.Find(d.Ctx, bson.M{})
+	cur, err := collection.Find(ctx, notDeleted(bson.M{}))
 	if err != nil {
 		logger.Logf("ERROR %s", err)
-		return nil, err
+		return nil, classifyError(err)
 	}
-	defer cur.Close(d.Ctx)
-	for cur.Next(d.Ctx) {
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
 		u := s.User{}
 		err = cur.Decode(&u)
 		if err != nil {
@@ -200,12 +265,104 @@ func (d *MongoUserDao) GetAll() (*[]s.User, error) {
 		}
 		result = append(result, u)
 	}
+	if err = cur.Err(); err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
 
 	return &result, nil
 }
 
+// Find returns a page of registered users matching the query
+func (d *MongoUserDao) Find(ctx context.Context, q UserQuery) (*UserPage, error) {
+	err := q.validate()
+	if err != nil {
+		return nil, err
+	}
+	filter, err := q.filter()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	// One extra document tells whether there is a next page
+	opts := options.Find().SetSort(q.sort()).SetLimit(int64(q.Limit + 1))
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+	defer cur.Close(ctx)
+
+	users := []s.User{}
+	err = cur.All(ctx, &users)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+
+	page := &UserPage{Users: users}
+	if len(users) > q.Limit {
+		page.Users = users[:q.Limit]
+		page.NextCursor = encodeCursor(q, &page.Users[q.Limit-1])
+	}
+	return page, nil
+}
+
+// Search returns a page of registered users matching the text, most relevant first
+func (d *MongoUserDao) Search(ctx context.Context, q SearchQuery) (*UserPage, error) {
+	if q.Text == "" || q.Limit <= 0 {
+		return nil, ErrInvalidQuery
+	}
+	offset, err := q.offset()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	filter := notDeleted(bson.M{"$text": bson.M{"$search": q.Text}, "username": bson.M{"$gt": ""}})
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "_id", Value: 1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(q.Limit + 1))
+
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+	defer cur.Close(ctx)
+
+	users := []s.User{}
+	err = cur.All(ctx, &users)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+
+	page := &UserPage{Users: users}
+	if len(users) > q.Limit {
+		page.Users = users[:q.Limit]
+		page.NextCursor = encodeOffsetCursor(offset + q.Limit)
+	}
+	return page, nil
+}
+
 // Update updates user if exists
-func (d *MongoUserDao) Update(u *s.User) error {
+func (d *MongoUserDao) Update(ctx context.Context, u *s.User) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
 	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
 
 	updateBody := bson.M{}
@@ -216,78 +373,371 @@ func (d *MongoUserDao) Update(u *s.User) error {
 		updateBody["lastName"] = u.LastName
 	}
 	if u.Email != "" {
-		updateBody["email"] = u.Email
+		updateBody["email"] = strings.ToLower(u.Email)
 	}
 	if u.Password != "" {
 		updateBody["password"] = u.Password
 	}
 
-	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": u.ID}, bson.M{"$set": updateBody})
-	return err
+	// Attributes are merged into stored ones, null value removes the attribute
+	unsetBody := bson.M{}
+	for name, value := range u.Attributes {
+		if value == nil {
+			unsetBody["attributes."+name] = ""
+		} else {
+			updateBody["attributes."+name] = value
+		}
+	}
+
+	update := bson.M{}
+	if len(updateBody) > 0 {
+		update["$set"] = updateBody
+	}
+	if len(unsetBody) > 0 {
+		update["$unset"] = unsetBody
+	}
+	if len(update) == 0 {
+		_, err := d.findOne(ctx, bson.M{"_id": u.ID})
+		return err
+	}
+
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": u.ID}), update)
+	return updateResultError(res, err)
 }
 
-// ClearVerificationCode clears verification code for user id
-func (d *MongoUserDao) ClearVerificationCode(id int) error {
+// ClearVerificationCode clears verification code for user id along with its expiry and attempts
+func (d *MongoUserDao) ClearVerificationCode(ctx context.Context, id int) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
 	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
 
-	updateBody := bson.M{"verificationCode": ""}
+	unset := bson.M{"verificationExpiresAt": "", "verificationSentAt": "", "verificationAttempts": ""}
+	update := bson.M{"$set": bson.M{"verificationCode": ""}, "$unset": unset}
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), update)
+	return updateResultError(res, err)
+}
+
+// ReplaceVerificationCode stores new verification code hash for unverified user id and resets attempts to enter it.
+// Code is replaced only if the previous one was sent before sentBefore, otherwise ErrNotFound is returned,
+// so concurrent requests can not send codes more often than allowed.
+func (d *MongoUserDao) ReplaceVerificationCode(ctx context.Context, id int, codeHash string, expiresAt *time.Time, sentBefore time.Time) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	filter := notDeleted(bson.M{
+		"_id":              id,
+		"verificationCode": bson.M{"$gt": ""},
+		"$or": bson.A{
+			bson.M{"verificationSentAt": bson.M{"$exists": false}},
+			bson.M{"verificationSentAt": bson.M{"$lt": sentBefore}},
+		},
+	})
+	set := bson.M{"verificationCode": codeHash, "verificationSentAt": time.Now().UTC()}
+	unset := bson.M{"verificationAttempts": ""}
+	if expiresAt != nil {
+		set["verificationExpiresAt"] = *expiresAt
+	} else {
+		unset["verificationExpiresAt"] = ""
+	}
+	update := bson.M{"$set": set, "$unset": unset}
+	res, err := collection.UpdateOne(ctx, filter, update)
+	return updateResultError(res, err)
+}
+
+// TakeVerificationAttempt counts attempt to enter verification code of user id before it is checked.
+// ErrNotFound is returned if the user is verified or maxAttempts were already taken.
+func (d *MongoUserDao) TakeVerificationAttempt(ctx context.Context, id int, maxAttempts int) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id}, bson.M{"$set": updateBody})
-	return err
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	filter := notDeleted(bson.M{"_id": id, "verificationCode": bson.M{"$gt": ""}, "verificationAttempts": bson.M{"$not": bson.M{"$gte": maxAttempts}}})
+	res, err := collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"verificationAttempts": 1}})
+	return updateResultError(res, err)
 }
 
-// SetRecoveryCode sets password recovery code for user id
-func (d *MongoUserDao) SetRecoveryCode(id int, code string) error {
-	return d.setFieldAndWipeOtherForId(id, "recoveryCode", code, "resettingCode")
+// SetRecoveryCode sets password recovery code for user id, issued now, and removes resetting one.
+// Code is replaced only if the previous one was issued before issuedBefore, otherwise ErrNotFound is returned,
+// so concurrent requests can not issue codes more often than allowed.
+func (d *MongoUserDao) SetRecoveryCode(ctx context.Context, id int, code string, issuedBefore time.Time) error {
+	condition := bson.M{"$or": bson.A{
+		bson.M{RecoveryCode + "IssuedAt": bson.M{"$exists": false}},
+		bson.M{RecoveryCode + "IssuedAt": bson.M{"$lt": issuedBefore}},
+	}}
+	return d.setCode(ctx, id, condition, RecoveryCode, code, ResettingCode)
 }
 
 // GetRecoveryCode extracts recovery code for user id
-func (d *MongoUserDao) GetRecoveryCode(id int) (string, error) {
-	return d.getStringFieldForId(id, "recoveryCode")
+func (d *MongoUserDao) GetRecoveryCode(ctx context.Context, id int) (*s.IssuedCode, error) {
+	return d.getCode(ctx, id, RecoveryCode)
 }
 
-// SetResettingCode sets resetting code and removes recovery one
-func (d *MongoUserDao) SetResettingCode(id int, code string) error {
-	return d.setFieldAndWipeOtherForId(id, "resettingCode", code, "recoveryCode")
+// SetResettingCode sets resetting code for user id, issued now, and removes recovery one
+func (d *MongoUserDao) SetResettingCode(ctx context.Context, id int, code string) error {
+	return d.setCode(ctx, id, bson.M{}, ResettingCode, code, RecoveryCode)
 }
 
 // GetResettingCode extracts resetting code for user id
-func (d *MongoUserDao) GetResettingCode(id int) (string, error) {
-	return d.getStringFieldForId(id, "resettingCode")
+func (d *MongoUserDao) GetResettingCode(ctx context.Context, id int) (*s.IssuedCode, error) {
+	return d.getCode(ctx, id, ResettingCode)
+}
+
+// TakeCodeAttempt counts attempt to enter recovery or resetting code of user id before it is checked.
+// ErrNotFound is returned if the code is absent or maxAttempts were already taken, so the code is unusable.
+func (d *MongoUserDao) TakeCodeAttempt(ctx context.Context, id int, kind string, maxAttempts int) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	filter := notDeleted(bson.M{"_id": id, kind: bson.M{"$gt": ""}, kind + "Attempts": bson.M{"$not": bson.M{"$gte": maxAttempts}}})
+	res, err := collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{kind + "Attempts": 1}})
+	return updateResultError(res, err)
 }
 
 // ResetPassword updates password and removes resetting code
-func (d *MongoUserDao) ResetPassword(id int, passwordHash string) error {
-	return d.setFieldAndWipeOtherForId(id, "password", passwordHash, "resettingCode")
+func (d *MongoUserDao) ResetPassword(ctx context.Context, id int, passwordHash string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	update := bson.M{"$set": bson.M{"password": passwordHash}, "$unset": codeFields(ResettingCode)}
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), update)
+	return updateResultError(res, err)
 }
 
-// DeleteById deletes user by id
-func (d *MongoUserDao) DeleteById(id int) error {
+// RehashPassword replaces password hash unless the password was changed since oldHash was read.
+// Sessions and codes are not affected as the password stays the same.
+func (d *MongoUserDao) RehashPassword(ctx context.Context, id int, oldHash string, newHash string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
 	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
-	_, err := collection.DeleteOne(d.Ctx, bson.M{"_id": id})
-	return err
+
+	filter := notDeleted(bson.M{"_id": id, "password": oldHash})
+	res, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"password": newHash}})
+	return updateResultError(res, err)
 }
 
-func (d *MongoUserDao) getStringFieldForId(id int, field string) (string, error) {
+// DeleteById marks user as deleted. Deleted user is hidden from lookups,
+// but keeps username and email reserved until restored or purged.
+func (d *MongoUserDao) DeleteById(ctx context.Context, id int) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
 	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
 
-	var result bson.M
+	update := bson.M{"$set": bson.M{"deletedAt": time.Now().UTC()}}
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), update)
+	return updateResultError(res, err)
+}
 
-	opt := options.FindOne().SetProjection(bson.M{"_id": 0, field: 1})
-	err := collection.FindOne(d.Ctx, bson.M{"_id": id}, opt).Decode(&result)
+// Restore brings back deleted user
+func (d *MongoUserDao) Restore(ctx context.Context, id int) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	filter := bson.M{"_id": id, "deletedAt": bson.M{"$exists": true}}
+	res, err := collection.UpdateOne(ctx, filter, bson.M{"$unset": bson.M{"deletedAt": ""}})
+	return updateResultError(res, err)
+}
+
+// PurgeDeleted permanently removes users deleted before the given time together with their metadata.
+// Only one replica purges at a time, others skip the run and return zero.
+func (d *MongoUserDao) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	owner := newLockOwner()
+	locked, err := d.tryLock(ctx, purgeLockID, owner, purgeLockLease)
 	if err != nil {
-		return "", err
+		logger.Logf("ERROR Cannot acquire purge lock: %s", err)
+		return 0, classifyError(err)
+	}
+	if !locked {
+		return 0, nil
+	}
+	defer d.releaseLock(ctx, purgeLockID, owner)
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	expired := bson.M{"deletedAt": bson.M{"$lt": before}}
+
+	var purged []struct {
+		ID int `bson:"_id"`
+	}
+	cursor, err := collection.Find(ctx, expired, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err == nil {
+		err = cursor.All(ctx, &purged)
+	}
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return 0, classifyError(err)
+	}
+	if len(purged) == 0 {
+		return 0, nil
+	}
+	ids := make([]int, 0, len(purged))
+	for _, p := range purged {
+		ids = append(ids, p.ID)
+	}
+
+	res, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}, "deletedAt": bson.M{"$lt": before}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return 0, classifyError(err)
 	}
 
-	return result[field].(string), nil
+	// Removing metadata does not undo purge, so failure only leaves orphaned documents behind
+	err = d.deleteUsersMetadata(ctx, ids)
+	if err != nil {
+		logger.Logf("ERROR Failed to remove metadata of purged users: %s", err)
+	}
+	return int(res.DeletedCount), nil
+}
+
+// SetEmailChange stores pending email change for user id
+func (d *MongoUserDao) SetEmailChange(ctx context.Context, id int, change *s.EmailChange) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	pending := *change
+	pending.Email = strings.ToLower(pending.Email)
+
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), bson.M{"$set": bson.M{"emailChange": pending}})
+	return updateResultError(res, err)
+}
+
+// ChangeEmail sets confirmed email for user id, removing pending change and verification code
+func (d *MongoUserDao) ChangeEmail(ctx context.Context, id int, email string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	update := bson.M{
+		"$set":   bson.M{"email": strings.ToLower(email), "verificationCode": ""},
+		"$unset": bson.M{"emailChange": "", "verificationExpiresAt": "", "verificationSentAt": "", "verificationAttempts": ""},
+	}
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), update)
+	return updateResultError(res, err)
 }
 
-func (d *MongoUserDao) setFieldAndWipeOtherForId(id int, fieldToSet string, value string, fieldToWipe string) error {
+// RevokeTokens invalidates tokens of user id issued before the given time
+func (d *MongoUserDao) RevokeTokens(ctx context.Context, id int, before time.Time) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
 	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
 
-	updateBody := bson.M{fieldToSet: value, fieldToWipe: ""}
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), bson.M{"$set": bson.M{"tokensRevokedAt": before.UTC()}})
+	return updateResultError(res, err)
+}
+
+// SetStatus replaces account status for user id, reason and expiry of previous status are removed
+func (d *MongoUserDao) SetStatus(ctx context.Context, id int, status s.AccountStatus) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id}, bson.M{"$set": updateBody})
-	return err
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	set := bson.M{"status": status.Status}
+	unset := bson.M{}
+	if status.Reason != "" {
+		set["statusReason"] = status.Reason
+	} else {
+		unset["statusReason"] = ""
+	}
+	if status.Until != nil {
+		set["statusUntil"] = *status.Until
+	} else {
+		unset["statusUntil"] = ""
+	}
+
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), bson.M{"$set": set, "$unset": unset})
+	return updateResultError(res, err)
+}
+
+// ApproveUser activates pending account of user id, ErrNotFound is returned if the account is not pending
+func (d *MongoUserDao) ApproveUser(ctx context.Context, id int) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	filter := notDeleted(bson.M{"_id": id, "status": s.StatusPending})
+	res, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"status": s.StatusActive}})
+	return updateResultError(res, err)
+}
+
+// setCode stores hash of the code of given kind, issued now, and removes the other kind.
+// User has to match the condition as well.
+func (d *MongoUserDao) setCode(ctx context.Context, id int, condition bson.M, kind string, codeHash string, kindToWipe string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	unset := codeFields(kindToWipe)
+	unset[kind+"Attempts"] = ""
+	update := bson.M{
+		"$set":   bson.M{kind: codeHash, kind + "IssuedAt": time.Now().UTC()},
+		"$unset": unset,
+	}
+	condition["_id"] = id
+	res, err := collection.UpdateOne(ctx, notDeleted(condition), update)
+	return updateResultError(res, err)
+}
+
+// getCode returns code of given kind, with empty hash if it is not set
+func (d *MongoUserDao) getCode(ctx context.Context, id int, kind string) (*s.IssuedCode, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	var result bson.Raw
+	opt := options.FindOne().SetProjection(bson.M{"_id": 0, kind: 1, kind + "IssuedAt": 1, kind + "Attempts": 1})
+	err := collection.FindOne(ctx, notDeleted(bson.M{"_id": id}), opt).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, classifyError(err)
+	}
+
+	code := &s.IssuedCode{}
+	code.Hash, _ = result.Lookup(kind).StringValueOK()
+	if issuedAt, ok := result.Lookup(kind + "IssuedAt").TimeOK(); ok {
+		t := issuedAt.UTC()
+		code.IssuedAt = &t
+	}
+	if attempts, ok := result.Lookup(kind + "Attempts").AsInt64OK(); ok {
+		code.Attempts = int(attempts)
+	}
+	return code, nil
+}
+
+// codeFields lists fields of the code of given kind to be unset
+func codeFields(kind string) bson.M {
+	return bson.M{kind: "", kind + "IssuedAt": "", kind + "Attempts": ""}
+}
+
+// updateResultError returns ErrNotFound if update matched no document
+func updateResultError(res *mongo.UpdateResult, err error) error {
+	if err != nil {
+		return classifyError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
@@ -0,0 +1,51 @@
+package dao
+
+import (
+	"context"
+
+	s "ruslanlesko/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	settingsCollectionName = "settings"
+	profileSchemaID        = "profileSchema"
+)
+
+// GetProfileSchema returns profile schema, empty one if it was never saved
+func (d *MongoUserDao) GetProfileSchema(ctx context.Context) (*s.ProfileSchema, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(settingsCollectionName)
+
+	result := &s.ProfileSchema{}
+	err := collection.FindOne(ctx, bson.M{"_id": profileSchemaID}).Decode(result)
+	if err == mongo.ErrNoDocuments {
+		return &s.ProfileSchema{Fields: []s.ProfileField{}}, nil
+	}
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, classifyError(err)
+	}
+	return result, nil
+}
+
+// SaveProfileSchema replaces profile schema
+func (d *MongoUserDao) SaveProfileSchema(ctx context.Context, schema *s.ProfileSchema) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	collection := d.Client.Database(d.DatabaseName).Collection(settingsCollectionName)
+
+	update := bson.M{"$set": bson.M{"fields": schema.Fields, "updatedAt": schema.UpdatedAt}}
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": profileSchemaID}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return classifyError(err)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package dao
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"ruslanlesko/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Sort orders supported by UserQuery
+const (
+	SortByID       = "id"
+	SortByUsername = "username"
+	SortByCreated  = "created"
+)
+
+// UserQuery describes a page of registered users to fetch.
+// Empty fields do not restrict the result.
+type UserQuery struct {
+	// Limit is maximum number of users in the page, must be positive
+	Limit int
+	// Cursor is NextCursor of the previous page, empty for the first page
+	Cursor string
+	// SortBy is one of SortByID, SortByUsername or SortByCreated, id by default
+	SortBy     string
+	Descending bool
+
+	UsernamePrefix string
+	EmailDomain    string
+	Verified       *bool
+	// Status matches account status, empty status of active accounts is not matched by StatusActive
+	Status string
+	// Roles matches users having all of the roles
+	Roles      []string
+	IDs        []int
+	ExcludeIDs []int
+}
+
+// UserPage is a single page of users
+type UserPage struct {
+	Users []structs.User
+	// NextCursor is empty when there are no more users
+	NextCursor string
+}
+
+type cursor struct {
+	SortBy    string    `json:"s"`
+	Username  string    `json:"u,omitempty"`
+	CreatedAt time.Time `json:"c"`
+	ID        int       `json:"i"`
+}
+
+func encodeCursor(q UserQuery, u *structs.User) string {
+	c := cursor{SortBy: q.sortBy(), ID: u.ID}
+	switch c.SortBy {
+	case SortByUsername:
+		c.Username = u.Username
+	case SortByCreated:
+		c.CreatedAt = u.CreatedAt
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(q UserQuery) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrInvalidQuery
+	}
+	c := &cursor{}
+	err = json.Unmarshal(data, c)
+	if err != nil || c.SortBy != q.sortBy() {
+		return nil, ErrInvalidQuery
+	}
+	return c, nil
+}
+
+func (q UserQuery) sortBy() string {
+	if q.SortBy == "" {
+		return SortByID
+	}
+	return q.SortBy
+}
+
+func (q UserQuery) sortField() string {
+	switch q.sortBy() {
+	case SortByUsername:
+		return "username"
+	case SortByCreated:
+		return "createdAt"
+	}
+	return "_id"
+}
+
+func (q UserQuery) direction() int {
+	if q.Descending {
+		return -1
+	}
+	return 1
+}
+
+// validate checks that query can be executed
+func (q UserQuery) validate() error {
+	if q.Limit <= 0 {
+		return ErrInvalidQuery
+	}
+	switch q.sortBy() {
+	case SortByID, SortByUsername, SortByCreated:
+		return nil
+	}
+	return ErrInvalidQuery
+}
+
+// filter builds MongoDB filter for the query, including position after the cursor.
+// Invite placeholders and deleted users are never listed.
+func (q UserQuery) filter() (bson.M, error) {
+	conditions := []bson.M{notDeleted(bson.M{"username": bson.M{"$gt": ""}})}
+
+	if q.UsernamePrefix != "" {
+		prefix := "^" + regexp.QuoteMeta(strings.ToLower(q.UsernamePrefix))
+		conditions = append(conditions, bson.M{"username": bson.M{"$regex": prefix}})
+	}
+	if q.EmailDomain != "" {
+		domain := "@" + regexp.QuoteMeta(strings.ToLower(q.EmailDomain)) + "$"
+		conditions = append(conditions, bson.M{"email": bson.M{"$regex": domain}})
+	}
+	if q.Verified != nil {
+		if *q.Verified {
+			conditions = append(conditions, bson.M{"verificationCode": bson.M{"$in": []interface{}{"", nil}}})
+		} else {
+			conditions = append(conditions, bson.M{"verificationCode": bson.M{"$gt": ""}})
+		}
+	}
+	if q.Status != "" {
+		conditions = append(conditions, bson.M{"status": q.Status})
+	}
+	if len(q.Roles) > 0 {
+		conditions = append(conditions, bson.M{"roles": bson.M{"$all": q.Roles}})
+	}
+	if q.IDs != nil {
+		conditions = append(conditions, bson.M{"_id": bson.M{"$in": q.IDs}})
+	}
+	if len(q.ExcludeIDs) > 0 {
+		conditions = append(conditions, bson.M{"_id": bson.M{"$nin": q.ExcludeIDs}})
+	}
+
+	if q.Cursor != "" {
+		c, err := decodeCursor(q)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, q.after(c))
+	}
+
+	return bson.M{"$and": conditions}, nil
+}
+
+// after matches documents following the cursor in query sort order.
+// Ties on the sort field are broken by id.
+func (q UserQuery) after(c *cursor) bson.M {
+	op := "$gt"
+	if q.Descending {
+		op = "$lt"
+	}
+
+	var value interface{}
+	switch q.sortBy() {
+	case SortByID:
+		return bson.M{"_id": bson.M{op: c.ID}}
+	case SortByUsername:
+		value = c.Username
+	case SortByCreated:
+		value = c.CreatedAt
+	}
+
+	field := q.sortField()
+	return bson.M{"$or": []bson.M{
+		{field: bson.M{op: value}},
+		{field: value, "_id": bson.M{op: c.ID}},
+	}}
+}
+
+func (q UserQuery) sort() bson.D {
+	if q.sortBy() == SortByID {
+		return bson.D{{Key: "_id", Value: q.direction()}}
+	}
+	return bson.D{{Key: q.sortField(), Value: q.direction()}, {Key: "_id", Value: q.direction()}}
+}
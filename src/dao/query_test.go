@@ -0,0 +1,59 @@
+package dao
+
+import (
+	"testing"
+	"time"
+
+	"ruslanlesko/brightonum/src/structs"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUserQuery_Filter(t *testing.T) {
+	verified := false
+	q := UserQuery{Limit: 10, UsernamePrefix: "Al.", EmailDomain: "Mail.com", Verified: &verified, Status: "pending", Roles: []string{"editor"}, ExcludeIDs: []int{1}}
+
+	filter, err := q.filter()
+	assert.Nil(t, err)
+	assert.Equal(t, bson.M{"$and": []bson.M{
+		{"username": bson.M{"$gt": ""}, "deletedAt": bson.M{"$exists": false}},
+		{"username": bson.M{"$regex": `^al\.`}},
+		{"email": bson.M{"$regex": `@mail\.com$`}},
+		{"verificationCode": bson.M{"$gt": ""}},
+		{"status": "pending"},
+		{"roles": bson.M{"$all": []string{"editor"}}},
+		{"_id": bson.M{"$nin": []int{1}}},
+	}}, filter)
+}
+
+func TestUserQuery_CursorRoundTrip(t *testing.T) {
+	created := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	q := UserQuery{Limit: 10, SortBy: SortByCreated, Descending: true}
+	q.Cursor = encodeCursor(q, &structs.User{ID: 7, Username: "alle", CreatedAt: created})
+
+	filter, err := q.filter()
+	assert.Nil(t, err)
+	assert.Equal(t, bson.M{"$or": []bson.M{
+		{"createdAt": bson.M{"$lt": created}},
+		{"createdAt": created, "_id": bson.M{"$lt": 7}},
+	}}, filter["$and"].([]bson.M)[1])
+	assert.Equal(t, bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}, q.sort())
+}
+
+func TestUserQuery_InvalidCursor(t *testing.T) {
+	q := UserQuery{Limit: 10, Cursor: "not a cursor"}
+	_, err := q.filter()
+	assert.Equal(t, ErrInvalidQuery, err)
+
+	q = UserQuery{Limit: 10, SortBy: SortByUsername}
+	q.Cursor = encodeCursor(UserQuery{}, &structs.User{ID: 7})
+	_, err = q.filter()
+	assert.Equal(t, ErrInvalidQuery, err)
+}
+
+func TestUserQuery_Validate(t *testing.T) {
+	assert.Nil(t, UserQuery{Limit: 1}.validate())
+	assert.Equal(t, ErrInvalidQuery, UserQuery{}.validate())
+	assert.Equal(t, ErrInvalidQuery, UserQuery{Limit: 1, SortBy: "email"}.validate())
+}
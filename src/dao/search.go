@@ -0,0 +1,48 @@
+package dao
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// SearchQuery describes a page of full-text search results.
+// Results are ordered by relevance, best matches first.
+type SearchQuery struct {
+	// Text is matched against username, first name, last name and email
+	Text string
+	// Limit is maximum number of users in the page, must be positive
+	Limit int
+	// Cursor is NextCursor of the previous page, empty for the first page
+	Cursor string
+}
+
+// offsetCursor points to the next page of results which are paged by offset
+type offsetCursor struct {
+	Offset int `json:"o"`
+}
+
+// offset returns number of results already returned on previous pages
+func (q SearchQuery) offset() (int, error) {
+	return decodeOffsetCursor(q.Cursor)
+}
+
+func decodeOffsetCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidQuery
+	}
+	c := offsetCursor{}
+	err = json.Unmarshal(data, &c)
+	if err != nil || c.Offset <= 0 {
+		return 0, ErrInvalidQuery
+	}
+	return c.Offset, nil
+}
+
+func encodeOffsetCursor(offset int) string {
+	data, _ := json.Marshal(offsetCursor{Offset: offset})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
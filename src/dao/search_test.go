@@ -0,0 +1,23 @@
+package dao
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchQuery_Offset(t *testing.T) {
+	offset, err := SearchQuery{}.offset()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, offset)
+
+	offset, err = SearchQuery{Cursor: encodeOffsetCursor(40)}.offset()
+	assert.Nil(t, err)
+	assert.Equal(t, 40, offset)
+
+	_, err = SearchQuery{Cursor: "%%%"}.offset()
+	assert.Equal(t, ErrInvalidQuery, err)
+
+	_, err = SearchQuery{Cursor: encodeOffsetCursor(-1)}.offset()
+	assert.Equal(t, ErrInvalidQuery, err)
+}
@@ -0,0 +1,102 @@
+package dao
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	s "ruslanlesko/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// usernamesCollectionName keeps usernames released by a change, so nobody else takes them for a while.
+// Documents are removed by TTL index once reservation expires.
+const usernamesCollectionName = "usernames"
+
+type usernameReservation struct {
+	Username  string    `bson:"_id"`
+	UserID    int       `bson:"userId"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// ChangeUsername changes username of user id and reserves previous one for that user until the given time
+func (d *MongoUserDao) ChangeUsername(ctx context.Context, id int, username string, reserveUntil time.Time) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	username = strings.ToLower(username)
+	users := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	reservations := d.Client.Database(d.DatabaseName).Collection(usernamesCollectionName)
+
+	current := &s.User{}
+	opt := options.FindOne().SetProjection(bson.M{"username": 1})
+	err := users.FindOne(ctx, notDeleted(bson.M{"_id": id}), opt).Decode(current)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	if err != nil {
+		return classifyError(err)
+	}
+
+	holder, err := d.usernameHolder(ctx, username)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if err == nil && holder != id {
+		return ErrDuplicateUsername
+	}
+
+	_, err = reservations.UpdateOne(ctx,
+		bson.M{"_id": current.Username},
+		bson.M{"$set": bson.M{"userId": id, "expiresAt": reserveUntil.UTC()}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return classifyError(err)
+	}
+
+	change := s.UsernameChange{Username: current.Username, ChangedAt: time.Now().UTC()}
+	update := bson.M{"$set": bson.M{"username": username}, "$push": bson.M{"usernameHistory": change}}
+	res, err := users.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), update)
+	err = updateResultError(res, err)
+	if err != nil {
+		return err
+	}
+
+	// User takes back one of their previous usernames
+	if holder == id {
+		_, err = reservations.DeleteOne(ctx, bson.M{"_id": username, "userId": id})
+		if err != nil {
+			logger.Logf("WARN Cannot release username reservation: %s", err)
+		}
+	}
+	return nil
+}
+
+// GetUsernameHolder returns id of the user who reserved username by changing it
+func (d *MongoUserDao) GetUsernameHolder(ctx context.Context, username string) (int, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	return d.usernameHolder(ctx, strings.ToLower(username))
+}
+
+func (d *MongoUserDao) usernameHolder(ctx context.Context, username string) (int, error) {
+	reservations := d.Client.Database(d.DatabaseName).Collection(usernamesCollectionName)
+
+	// TTL index removes expired documents with a delay, so expiry is checked here too
+	result := usernameReservation{}
+	filter := bson.M{"_id": username, "expiresAt": bson.M{"$gt": time.Now().UTC()}}
+	err := reservations.FindOne(ctx, filter).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return 0, classifyError(err)
+	}
+	return result.UserID, nil
+}
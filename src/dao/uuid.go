@@ -0,0 +1,18 @@
+package dao
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// newUUID returns random (version 4) UUID in canonical text form
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,20 @@
+package dao
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUUID(t *testing.T) {
+	pattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	first, err := newUUID()
+	assert.Nil(t, err)
+	assert.Regexp(t, pattern, first)
+
+	second, err := newUUID()
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+}
@@ -10,7 +10,13 @@ import (
 type Mailer interface {
 	SendRecoveryCode(string, string) error
 	SendInviteCode(string, string) error
-	SendVerificationCode(string, string) error
+	SendVerificationCode(string, string, string) error
+	SendEmailChangeCode(string, string) error
+	SendEmailChangeNotice(string) error
+	SendPasswordChangedNotice(string) error
+	SendApprovalNotice(string) error
+	SendRegistrationAttemptNotice(string) error
+	SendUsernameTakenNotice(string, string) error
 }
 
 // EmailMailer sends emails
@@ -46,8 +52,8 @@ func (m *EmailMailer) SendInviteCode(to string, code string) error {
 	return m.send(to, msg)
 }
 
-// SendVerificationCode sends verification code
-func (m *EmailMailer) SendVerificationCode(to string, code string) error {
+// SendVerificationCode sends verification code along with verification link unless the link is empty
+func (m *EmailMailer) SendVerificationCode(to string, code string, link string) error {
 	msg := "To: " + to + "\r\n" +
 		"From: " + m.SiteName + "<" + m.Email + ">\r\n" +
 		"Subject: " + m.SiteName + " Verification Code\r\n" +
@@ -55,6 +61,79 @@ func (m *EmailMailer) SendVerificationCode(to string, code string) error {
 		"Your verification code: " +
 		code +
 		"\r\n"
+	if link != "" {
+		msg += "Or verify your email by opening " + link + "\r\n"
+	}
+	return m.send(to, msg)
+}
+
+// SendEmailChangeCode sends confirmation code to the new email address
+func (m *EmailMailer) SendEmailChangeCode(to string, code string) error {
+	msg := "To: " + to + "\r\n" +
+		"From: " + m.SiteName + "<" + m.Email + ">\r\n" +
+		"Subject: " + m.SiteName + " email change confirmation code\r\n" +
+		"\r\n" +
+		"Your email change confirmation code: " +
+		code +
+		"\r\n"
+	return m.send(to, msg)
+}
+
+// SendEmailChangeNotice warns the current email address that a change was requested
+func (m *EmailMailer) SendEmailChangeNotice(to string) error {
+	msg := "To: " + to + "\r\n" +
+		"From: " + m.SiteName + "<" + m.Email + ">\r\n" +
+		"Subject: " + m.SiteName + " email change requested\r\n" +
+		"\r\n" +
+		"A change of your account email address was requested. " +
+		"If it was not you, reset your password now." +
+		"\r\n"
+	return m.send(to, msg)
+}
+
+// SendPasswordChangedNotice tells user that their password was changed
+func (m *EmailMailer) SendPasswordChangedNotice(to string) error {
+	msg := "To: " + to + "\r\n" +
+		"From: " + m.SiteName + "<" + m.Email + ">\r\n" +
+		"Subject: " + m.SiteName + " password changed\r\n" +
+		"\r\n" +
+		"Your password was changed. " +
+		"If it was not you, reset your password now." +
+		"\r\n"
+	return m.send(to, msg)
+}
+
+// SendApprovalNotice tells user that their account was approved by admin
+func (m *EmailMailer) SendApprovalNotice(to string) error {
+	msg := "To: " + to + "\r\n" +
+		"From: " + m.SiteName + "<" + m.Email + ">\r\n" +
+		"Subject: " + m.SiteName + " account approved\r\n" +
+		"\r\n" +
+		"Your account was approved, you can log in now." +
+		"\r\n"
+	return m.send(to, msg)
+}
+
+// SendRegistrationAttemptNotice tells user that someone tried to register with their email
+func (m *EmailMailer) SendRegistrationAttemptNotice(to string) error {
+	msg := "To: " + to + "\r\n" +
+		"From: " + m.SiteName + "<" + m.Email + ">\r\n" +
+		"Subject: " + m.SiteName + " registration attempt\r\n" +
+		"\r\n" +
+		"Someone tried to register with your email, but you already have an account. " +
+		"If it was you, log in or recover your password. Otherwise you can ignore this email." +
+		"\r\n"
+	return m.send(to, msg)
+}
+
+// SendUsernameTakenNotice tells user that registration failed as the username is taken
+func (m *EmailMailer) SendUsernameTakenNotice(to string, username string) error {
+	msg := "To: " + to + "\r\n" +
+		"From: " + m.SiteName + "<" + m.Email + ">\r\n" +
+		"Subject: " + m.SiteName + " registration failed\r\n" +
+		"\r\n" +
+		"Username " + username + " is already taken, please register with another one." +
+		"\r\n"
 	return m.send(to, msg)
 }
 
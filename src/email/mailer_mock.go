@@ -20,6 +20,36 @@ func (m *MailerMock) SendInviteCode(to string, code string) error {
 }
 
 // SendVerificationCode mock sending verification code
-func (m *MailerMock) SendVerificationCode(to string, code string) error {
+func (m *MailerMock) SendVerificationCode(to string, code string, link string) error {
+	return m.Called(to, code, link).Error(0)
+}
+
+// SendEmailChangeCode mock sending email change confirmation code
+func (m *MailerMock) SendEmailChangeCode(to string, code string) error {
 	return m.Called(to, code).Error(0)
 }
+
+// SendEmailChangeNotice mock sending email change notice
+func (m *MailerMock) SendEmailChangeNotice(to string) error {
+	return m.Called(to).Error(0)
+}
+
+// SendPasswordChangedNotice mock sending password change notice
+func (m *MailerMock) SendPasswordChangedNotice(to string) error {
+	return m.Called(to).Error(0)
+}
+
+// SendApprovalNotice mock sending account approval notice
+func (m *MailerMock) SendApprovalNotice(to string) error {
+	return m.Called(to).Error(0)
+}
+
+// SendRegistrationAttemptNotice mock sending registration attempt notice
+func (m *MailerMock) SendRegistrationAttemptNotice(to string) error {
+	return m.Called(to).Error(0)
+}
+
+// SendUsernameTakenNotice mock sending username taken notice
+func (m *MailerMock) SendUsernameTakenNotice(to string, username string) error {
+	return m.Called(to, username).Error(0)
+}
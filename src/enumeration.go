@@ -0,0 +1,60 @@
+package main
+
+import (
+	"ruslanlesko/brightonum/src/crypto"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+// Errors of public endpoints in anti-enumeration mode, they do not tell whether the user exists
+var (
+	invalidRecoveryCodeError     = st.AuthError{Msg: "Provided recovery code is invalid or expired", Status: 403}
+	invalidVerificationCodeError = st.AuthError{Msg: "Verification code is invalid or expired", Status: 400}
+)
+
+// rejectCode returns err, or the uniform error in anti-enumeration mode.
+// Code not compared with a stored one yet is compared with a dummy one, so rejection takes the same time for any reason.
+func (s *AuthService) rejectCode(code string, compared bool, err st.AuthError, uniform st.AuthError) error {
+	if !s.Config.AntiEnumeration {
+		return err
+	}
+	if !compared {
+		crypto.DummyMatchCode(code)
+	}
+	return uniform
+}
+
+// deliver sends email by the send function. In anti-enumeration mode email is sent in background
+// and failure is only logged, so neither response time nor status depend on whether email is sent.
+func (s *AuthService) deliver(send func() error) error {
+	if !s.Config.AntiEnumeration {
+		err := send()
+		if err != nil {
+			logger.Logf("ERROR Email was not sent: " + err.Error())
+			return st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		return nil
+	}
+
+	go func() {
+		err := send()
+		if err != nil {
+			logger.Logf("ERROR Email was not sent: " + err.Error())
+		}
+	}()
+	return nil
+}
+
+// concealTakenUsername makes registration with taken username look successful in anti-enumeration mode.
+// Registering user is told about it by email instead.
+func (s *AuthService) concealTakenUsername(u *st.User) error {
+	if u.Email == "" {
+		return nil
+	}
+	return s.deliver(func() error { return s.Mailer.SendUsernameTakenNotice(u.Email, u.Username) })
+}
+
+// concealTakenEmail makes registration with taken email look successful in anti-enumeration mode.
+// Owner of the email is told about the attempt instead.
+func (s *AuthService) concealTakenEmail(u *st.User) error {
+	return s.deliver(func() error { return s.Mailer.SendRegistrationAttemptNotice(u.Email) })
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"ruslanlesko/brightonum/src/dao"
+	"ruslanlesko/brightonum/src/email"
+	st "ruslanlesko/brightonum/src/structs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func createAntiEnumerationTestConfig() Config {
+	conf := createTestConfig()
+	conf.AntiEnumeration = true
+	return conf
+}
+
+// awaitEmail waits for email sent in background
+func awaitEmail(t *testing.T, sent chan bool) {
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Email was not sent")
+	}
+}
+
+func TestAuthService_AntiEnumeration_BasicAuthToken(t *testing.T) {
+	user := createTestUser()
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "ghost").Return(nil, dao.ErrNotFound)
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := AuthService{&mailer, &userDao, createAntiEnumerationTestConfig()}
+
+	_, _, missingErr := s.BasicAuthToken(ctx, "ghost", "oakheart")
+	_, _, wrongErr := s.BasicAuthToken(ctx, user.Username, "wrong")
+	assert.Equal(t, st.AuthError{Msg: "Username or password is wrong", Status: 403}, missingErr)
+	assert.Equal(t, missingErr, wrongErr)
+}
+
+func TestAuthService_AntiEnumeration_SendRecoveryEmail(t *testing.T) {
+	user := createTestUser()
+	sent := make(chan bool, 1)
+
+	mailer := email.MailerMock{}
+	mailer.On("SendRecoveryCode", user.Email, mock.AnythingOfType("string")).Return(nil).Run(func(mock.Arguments) { sent <- true })
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "ghost").Return(nil, dao.ErrNotFound)
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("SetRecoveryCode", user.ID, mock.AnythingOfType("string"), mock.Anything).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createAntiEnumerationTestConfig()}
+
+	assert.Nil(t, s.SendRecoveryEmail(ctx, "ghost"))
+	assert.Nil(t, s.SendRecoveryEmail(ctx, user.Username))
+	awaitEmail(t, sent)
+	mailer.AssertNumberOfCalls(t, "SendRecoveryCode", 1)
+}
+
+func TestAuthService_AntiEnumeration_SendRecoveryEmail_MailerFailure(t *testing.T) {
+	user := createTestUser()
+	sent := make(chan bool, 1)
+
+	mailer := email.MailerMock{}
+	mailer.On("SendRecoveryCode", user.Email, mock.AnythingOfType("string")).Return(errors.New("smtp")).Run(func(mock.Arguments) { sent <- true })
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("SetRecoveryCode", user.ID, mock.AnythingOfType("string"), mock.Anything).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createAntiEnumerationTestConfig()}
+
+	assert.Nil(t, s.SendRecoveryEmail(ctx, user.Username))
+	awaitEmail(t, sent)
+}
+
+func TestAuthService_AntiEnumeration_SendRecoveryEmail_Throttled(t *testing.T) {
+	user := createTestUser()
+
+	mailer := email.MailerMock{}
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("SetRecoveryCode", user.ID, mock.AnythingOfType("string"), mock.Anything).Return(dao.ErrNotFound)
+
+	s := AuthService{&mailer, &userDao, createAntiEnumerationTestConfig()}
+
+	assert.Nil(t, s.SendRecoveryEmail(ctx, user.Username))
+	mailer.AssertNotCalled(t, "SendRecoveryCode", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_AntiEnumeration_ExchangeRecoveryCode(t *testing.T) {
+	user := createTestUser()
+	expiredUser := createAnotherTestUser()
+	issuedAt := time.Now().Add(-time.Hour)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "ghost").Return(nil, dao.ErrNotFound)
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetByUsername", expiredUser.Username).Return(&expiredUser, nil)
+	userDao.On("GetRecoveryCode", user.ID).Return(&st.IssuedCode{}, nil)
+	userDao.On("GetRecoveryCode", expiredUser.ID).Return(&st.IssuedCode{Hash: hashedCode, IssuedAt: &issuedAt}, nil)
+
+	conf := createAntiEnumerationTestConfig()
+	conf.RecoveryCodeTTL = 15 * time.Minute
+	s := AuthService{&mailer, &userDao, conf}
+
+	for _, username := range []string{"ghost", user.Username, expiredUser.Username} {
+		_, err := s.ExchangeRecoveryCode(ctx, username, code)
+		assert.Equal(t, invalidRecoveryCodeError, err, username)
+	}
+}
+
+func TestAuthService_AntiEnumeration_ResetPassword(t *testing.T) {
+	user := createTestUser()
+	issuedAt := time.Now()
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "ghost").Return(nil, dao.ErrNotFound)
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetResettingCode", user.ID).Return(&st.IssuedCode{Hash: hashedCode, IssuedAt: &issuedAt}, nil)
+
+	s := AuthService{&mailer, &userDao, createAntiEnumerationTestConfig()}
+
+	assert.Equal(t, invalidRecoveryCodeError, s.ResetPassword(ctx, "ghost", code, "newpassword"))
+	assert.Equal(t, invalidRecoveryCodeError, s.ResetPassword(ctx, user.Username, "000000", "newpassword"))
+}
+
+func TestAuthService_AntiEnumeration_VerifyUser(t *testing.T) {
+	verified := createTestUser()
+	unverified := createAnotherTestUser()
+	unverified.VerificationCode = hashedCode
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "ghost").Return(nil, dao.ErrNotFound)
+	userDao.On("GetByUsername", verified.Username).Return(&verified, nil)
+	userDao.On("GetByUsername", unverified.Username).Return(&unverified, nil)
+
+	s := AuthService{&mailer, &userDao, createAntiEnumerationTestConfig()}
+
+	assert.Equal(t, invalidVerificationCodeError, s.VerifyUser(ctx, "ghost", code))
+	assert.Equal(t, invalidVerificationCodeError, s.VerifyUser(ctx, verified.Username, code))
+	assert.Equal(t, invalidVerificationCodeError, s.VerifyUser(ctx, unverified.Username, "000000"))
+}
+
+func TestAuthService_AntiEnumeration_ResendVerificationCode(t *testing.T) {
+	verified := createTestUser()
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "ghost").Return(nil, dao.ErrNotFound)
+	userDao.On("GetByUsername", verified.Username).Return(&verified, nil)
+
+	s := AuthService{&mailer, &userDao, createAntiEnumerationTestConfig()}
+
+	assert.Nil(t, s.ResendVerificationCode(ctx, "ghost"))
+	assert.Nil(t, s.ResendVerificationCode(ctx, verified.Username))
+}
+
+func TestAuthService_AntiEnumeration_CreateUser_TakenUsername(t *testing.T) {
+	existing := createTestUser()
+	u := st.User{Username: existing.Username, Email: "sarah@example.com", Password: "pwd"}
+	sent := make(chan bool, 1)
+
+	mailer := email.MailerMock{}
+	mailer.On("SendUsernameTakenNotice", u.Email, u.Username).Return(nil).Run(func(mock.Arguments) { sent <- true })
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(&existing, nil)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+
+	s := AuthService{&mailer, &userDao, createAntiEnumerationTestConfig()}
+
+	assert.Nil(t, s.CreateUser(ctx, &u))
+	awaitEmail(t, sent)
+	userDao.AssertNotCalled(t, "Save", mock.Anything)
+}
+
+func TestAuthService_AntiEnumeration_CreateUser_TakenEmail(t *testing.T) {
+	u := st.User{Username: "sarah", Email: "alle@alle.com", Password: "pwd"}
+	sent := make(chan bool, 1)
+
+	mailer := email.MailerMock{}
+	mailer.On("SendRegistrationAttemptNotice", u.Email).Return(nil).Run(func(mock.Arguments) { sent <- true })
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("Save", &u).Return(0, dao.ErrDuplicateEmail)
+
+	s := AuthService{&mailer, &userDao, createAntiEnumerationTestConfig()}
+
+	assert.Nil(t, s.CreateUser(ctx, &u))
+	awaitEmail(t, sent)
+}
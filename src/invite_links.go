@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"ruslanlesko/brightonum/src/crypto"
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+const maxInviteLinkUses = 10000
+
+var domainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+
+// CreateInviteLink creates multi-use invite link and returns it with its token, which is not stored and can not be shown again.
+// Available only for admin.
+func (s *AuthService) CreateInviteLink(ctx context.Context, token string, link *st.InviteLink) (*st.InviteLink, error) {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if link.MaxUses <= 0 || link.MaxUses > maxInviteLinkUses {
+		return nil, st.AuthError{Msg: fmt.Sprintf("maxUses must be between 1 and %d", maxInviteLinkUses), Status: 400}
+	}
+	domain := strings.ToLower(strings.TrimPrefix(link.Domain, "@"))
+	if domain != "" && !domainPattern.MatchString(domain) {
+		return nil, st.AuthError{Msg: "Invalid domain", Status: 400}
+	}
+	err = validateMembership(link.Roles, link.Organization)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	expiresAt := link.ExpiresAt
+	if expiresAt == nil && s.Config.InviteExpiration > 0 {
+		defaultExpiry := now.Add(s.Config.InviteExpiration)
+		expiresAt = &defaultExpiry
+	}
+	if expiresAt != nil && !expiresAt.After(now) {
+		return nil, st.AuthError{Msg: "Expiry must be in the future", Status: 400}
+	}
+
+	linkToken, err := s.newCode(codeInviteLink)
+	if err != nil {
+		return nil, err
+	}
+	created := st.InviteLink{
+		TokenHash:    crypto.Digest(linkToken),
+		CreatorID:    admin.ID,
+		CreatedAt:    now,
+		ExpiresAt:    expiresAt,
+		MaxUses:      link.MaxUses,
+		UsesLeft:     link.MaxUses,
+		Domain:       domain,
+		Roles:        link.Roles,
+		Organization: link.Organization,
+	}
+	err = s.UserDao.SaveInviteLink(ctx, &created)
+	if err != nil {
+		logger.Logf("ERROR Cannot save invite link: %s", err.Error())
+		return nil, mapDaoError(err)
+	}
+
+	s.audit(ctx, admin, st.AuditCreateInviteLink, 0, "invite link "+created.ID)
+	created.Token = linkToken
+	return &created, nil
+}
+
+// ListInviteLinks returns a page of invite links, newest first. Available only for admin.
+func (s *AuthService) ListInviteLinks(ctx context.Context, token string, query dao.InviteLinkQuery) (*st.InviteLinkPage, error) {
+	_, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = defaultPageSize
+	}
+	if query.Limit > maxPageSize {
+		query.Limit = maxPageSize
+	}
+
+	page, err := s.UserDao.ListInviteLinks(ctx, query)
+	if errors.Is(err, dao.ErrInvalidQuery) {
+		return nil, st.AuthError{Msg: "Invalid query or cursor", Status: 400}
+	}
+	if err != nil {
+		return nil, mapDaoError(err)
+	}
+	return &st.InviteLinkPage{Links: page.Links, NextCursor: page.NextCursor}, nil
+}
+
+// RevokeInviteLink makes invite link unusable. Available only for admin.
+func (s *AuthService) RevokeInviteLink(ctx context.Context, token string, id string) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	err = s.UserDao.RevokeInviteLink(ctx, id)
+	if errors.Is(err, dao.ErrNotFound) {
+		return st.AuthError{Msg: "Invite link does not exist or is already revoked", Status: 404}
+	}
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	s.audit(ctx, admin, st.AuditRevokeInviteLink, 0, "invite link "+id)
+	return nil
+}
+
+// findInviteLink returns invite link of the token if it can be used to register the email
+func (s *AuthService) findInviteLink(ctx context.Context, token string, email string) (*st.InviteLink, error) {
+	link, err := s.UserDao.GetInviteLinkByTokenHash(ctx, crypto.Digest(token))
+	if errors.Is(err, dao.ErrNotFound) {
+		return nil, st.AuthError{Msg: "Invalid invite link", Status: 401}
+	}
+	if err != nil {
+		logger.Logf("ERROR Failed to fetch invite link, %s", err.Error())
+		return nil, mapDaoError(err)
+	}
+
+	switch {
+	case link.Revoked:
+		return nil, st.AuthError{Msg: "Invite link was revoked", Status: 401}
+	case link.Expired(time.Now()):
+		return nil, st.AuthError{Msg: "Invite link has expired", Status: 401}
+	case link.UsesLeft <= 0:
+		return nil, st.AuthError{Msg: "Invite link has no uses left", Status: 401}
+	case link.Domain != "" && !strings.HasSuffix(strings.ToLower(email), "@"+link.Domain):
+		return nil, st.AuthError{Msg: "Email domain is not allowed by the invite link", Status: 403}
+	}
+	return link, nil
+}
+
+// applyInviteLink assigns roles and organization of the link to the user
+func applyInviteLink(u *st.User, link *st.InviteLink) {
+	u.Roles = link.Roles
+	u.Organization = link.Organization
+}
+
+// useInviteLink takes one use of the link, failing if other registrations have used it up meanwhile
+func (s *AuthService) useInviteLink(ctx context.Context, link *st.InviteLink) error {
+	err := s.UserDao.UseInviteLink(ctx, link.ID)
+	if errors.Is(err, dao.ErrNotFound) {
+		return st.AuthError{Msg: "Invite link has no uses left", Status: 401}
+	}
+	if err != nil {
+		return mapDaoError(err)
+	}
+	return nil
+}
+
+// releaseInviteLink gives back the use of the link when the user could not be created
+func (s *AuthService) releaseInviteLink(ctx context.Context, link *st.InviteLink) {
+	err := s.UserDao.ReleaseInviteLink(ctx, link.ID)
+	if err != nil {
+		logger.Logf("ERROR Failed to release invite link %s: %s", link.ID, err.Error())
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"ruslanlesko/brightonum/src/crypto"
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+const linkToken = "48213377120954467718203395561047"
+
+func createTestInviteLink() st.InviteLink {
+	return st.InviteLink{
+		ID:           "link-1",
+		TokenHash:    crypto.Digest(linkToken),
+		CreatorID:    42,
+		MaxUses:      10,
+		UsesLeft:     3,
+		Domain:       "hollywoo.com",
+		Roles:        []string{"cast"},
+		Organization: "Hollywoo Stars",
+	}
+}
+
+func TestAuthService_CreateInviteLink(t *testing.T) {
+	admin := createTestUser()
+	conf := createTestConfig()
+	conf.InviteExpiration = time.Hour
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("SaveInviteLink", mock.MatchedBy(func(l *st.InviteLink) bool {
+		l.ID = "link-1"
+		return l.MaxUses == 5 && l.UsesLeft == 5 && l.Domain == "hollywoo.com" && l.CreatorID == admin.ID && l.ExpiresAt != nil
+	})).Return(nil)
+	userDao.On("SaveAuditRecord", mock.Anything).Return(nil)
+
+	s := AuthService{&mailer, &userDao, conf}
+	token := issueTestToken(admin.ID, admin.Username, conf.PrivKeyPath)
+
+	link, err := s.CreateInviteLink(ctx, token, &st.InviteLink{MaxUses: 5, Domain: "@Hollywoo.com", Roles: []string{"cast"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "link-1", link.ID)
+	assert.Len(t, link.Token, 32)
+	assert.Equal(t, crypto.Digest(link.Token), link.TokenHash)
+	userDao.AssertCalled(t, "SaveAuditRecord", mock.MatchedBy(func(r *st.AuditRecord) bool {
+		return r.Action == st.AuditCreateInviteLink && r.Details == "invite link link-1"
+	}))
+}
+
+func TestAuthService_CreateInviteLink_Invalid(t *testing.T) {
+	admin := createTestUser()
+	past := time.Now().Add(-time.Minute)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+
+	_, err := s.CreateInviteLink(ctx, token, &st.InviteLink{})
+	assert.Equal(t, st.AuthError{Msg: "maxUses must be between 1 and 10000", Status: 400}, err)
+
+	_, err = s.CreateInviteLink(ctx, token, &st.InviteLink{MaxUses: 5, Domain: "not a domain"})
+	assert.Equal(t, st.AuthError{Msg: "Invalid domain", Status: 400}, err)
+
+	_, err = s.CreateInviteLink(ctx, token, &st.InviteLink{MaxUses: 5, ExpiresAt: &past})
+	assert.Equal(t, st.AuthError{Msg: "Expiry must be in the future", Status: 400}, err)
+	userDao.AssertNotCalled(t, "SaveInviteLink", mock.Anything)
+}
+
+func TestAuthService_CreateUser_WithInviteLink(t *testing.T) {
+	link := createTestInviteLink()
+	u := st.User{Username: "sarah", Email: "Sarah@Hollywoo.com", Password: "oakheart", InviteToken: linkToken}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("GetInviteLinkByTokenHash", crypto.Digest(linkToken)).Return(&link, nil)
+	userDao.On("UseInviteLink", link.ID).Return(nil)
+	userDao.On("Save", mock.MatchedBy(func(saved *st.User) bool { return saved.InviteToken == "" })).Return(44, nil)
+
+	s := AuthService{&mailer, &userDao, createPrivateTestConfig()}
+
+	err := s.CreateUser(ctx, &u)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"cast"}, u.Roles)
+	assert.Equal(t, "Hollywoo Stars", u.Organization)
+	userDao.AssertExpectations(t)
+	userDao.AssertNotCalled(t, "GetPendingInvite", mock.Anything)
+}
+
+func TestAuthService_CreateUser_InviteLinkRejected(t *testing.T) {
+	expiredAt := time.Now().Add(-time.Minute)
+	revoked := createTestInviteLink()
+	revoked.Revoked = true
+	expired := createTestInviteLink()
+	expired.ExpiresAt = &expiredAt
+	usedUp := createTestInviteLink()
+	usedUp.UsesLeft = 0
+	raced := createTestInviteLink()
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "sarah").Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("GetInviteLinkByTokenHash", crypto.Digest("unknown")).Return(nil, dao.ErrNotFound)
+	userDao.On("GetInviteLinkByTokenHash", crypto.Digest("revoked")).Return(&revoked, nil)
+	userDao.On("GetInviteLinkByTokenHash", crypto.Digest("expired")).Return(&expired, nil)
+	userDao.On("GetInviteLinkByTokenHash", crypto.Digest("used")).Return(&usedUp, nil)
+	userDao.On("GetInviteLinkByTokenHash", crypto.Digest(linkToken)).Return(&raced, nil)
+	userDao.On("UseInviteLink", raced.ID).Return(dao.ErrNotFound)
+
+	s := AuthService{&mailer, &userDao, createPrivateTestConfig()}
+
+	cases := []struct {
+		email string
+		token string
+		err   st.AuthError
+	}{
+		{"sarah@hollywoo.com", "unknown", st.AuthError{Msg: "Invalid invite link", Status: 401}},
+		{"sarah@hollywoo.com", "revoked", st.AuthError{Msg: "Invite link was revoked", Status: 401}},
+		{"sarah@hollywoo.com", "expired", st.AuthError{Msg: "Invite link has expired", Status: 401}},
+		{"sarah@hollywoo.com", "used", st.AuthError{Msg: "Invite link has no uses left", Status: 401}},
+		{"sarah@nothollywoo.com", linkToken, st.AuthError{Msg: "Email domain is not allowed by the invite link", Status: 403}},
+		{"sarah@hollywoo.com", linkToken, st.AuthError{Msg: "Invite link has no uses left", Status: 401}},
+	}
+	for _, c := range cases {
+		u := st.User{Username: "sarah", Email: c.email, Password: "oakheart", InviteToken: c.token}
+		err := s.CreateUser(ctx, &u)
+		assert.Equal(t, c.err, err, c.token)
+	}
+	userDao.AssertNotCalled(t, "Save", mock.Anything)
+}
+
+func TestAuthService_CreateUser_InviteLinkReleasedOnFailure(t *testing.T) {
+	link := createTestInviteLink()
+	u := st.User{Username: "sarah", Email: "sarah@hollywoo.com", Password: "oakheart", InviteToken: linkToken}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("GetInviteLinkByTokenHash", crypto.Digest(linkToken)).Return(&link, nil)
+	userDao.On("UseInviteLink", link.ID).Return(nil)
+	userDao.On("Save", mock.Anything).Return(0, dao.ErrDuplicateEmail)
+	userDao.On("ReleaseInviteLink", link.ID).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createPrivateTestConfig()}
+
+	err := s.CreateUser(ctx, &u)
+	assert.Equal(t, 409, err.(st.AuthError).Status)
+	userDao.AssertCalled(t, "ReleaseInviteLink", link.ID)
+}
+
+func TestAuthService_RevokeInviteLink(t *testing.T) {
+	admin := createTestUser()
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("RevokeInviteLink", "link-1").Return(nil)
+	userDao.On("RevokeInviteLink", "missing").Return(dao.ErrNotFound)
+	userDao.On("SaveAuditRecord", mock.Anything).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+
+	assert.Nil(t, s.RevokeInviteLink(ctx, token, "link-1"))
+	err := s.RevokeInviteLink(ctx, token, "missing")
+	assert.Equal(t, st.AuthError{Msg: "Invite link does not exist or is already revoked", Status: 404}, err)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"ruslanlesko/brightonum/src/crypto"
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+const (
+	maxRoles              = 20
+	maxOrganizationLength = 128
+)
+
+var rolePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// reservedRoles filter user list by admin ids given in configuration, so they can not be assigned
+var reservedRoles = []string{"admin", "user"}
+
+// InviteUser sends invite code for email of the invite, which can carry profile of the invited user.
+// Inviting the same email again replaces code and profile of its pending invite.
+func (s *AuthService) InviteUser(ctx context.Context, invite *st.Invite, token string) error {
+	admin, err := s.validateToken(ctx, token)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	if admin == nil || !contains(s.Config.AdminIDs, admin.ID) {
+		return st.AuthError{Msg: "Available only for admin", Status: 403}
+	}
+
+	if invite.Email == "" {
+		return st.AuthError{Msg: "Email is missing", Status: 400}
+	}
+	err = s.validateInviteProfile(ctx, invite)
+	if err != nil {
+		return err
+	}
+	registered, err := s.UserDao.GetByEmail(ctx, invite.Email)
+	if err != nil && !errors.Is(err, dao.ErrNotFound) {
+		return mapDaoError(err)
+	}
+	// Invite placeholders of previous versions have no username
+	if registered != nil && registered.Username != "" {
+		return st.AuthError{Msg: "Email already exists", Status: 409}
+	}
+
+	saved, err := s.sendInvite(ctx, admin, invite)
+	if err != nil {
+		return err
+	}
+	s.audit(ctx, admin, st.AuditInviteUser, 0, "invite "+saved.ID)
+	return nil
+}
+
+// sendInvite stores pending invite with new code and emails the code
+func (s *AuthService) sendInvite(ctx context.Context, admin *st.User, profile *st.Invite) (*st.Invite, error) {
+	code, err := s.newCode(codeInvite)
+	if err != nil {
+		return nil, err
+	}
+
+	invite := st.Invite{
+		Email:        profile.Email,
+		CodeHash:     crypto.Digest(code),
+		InviterID:    admin.ID,
+		SentAt:       time.Now().UTC(),
+		FirstName:    profile.FirstName,
+		LastName:     profile.LastName,
+		Roles:        profile.Roles,
+		Organization: profile.Organization,
+		Attributes:   profile.Attributes,
+	}
+	if s.Config.InviteExpiration > 0 {
+		expiresAt := invite.SentAt.Add(s.Config.InviteExpiration)
+		invite.ExpiresAt = &expiresAt
+	}
+
+	saved, err := s.UserDao.SaveInvite(ctx, &invite)
+	if err != nil {
+		logger.Logf("ERROR Cannot save user invite: %s", err.Error())
+		return nil, mapDaoError(err)
+	}
+
+	err = s.Mailer.SendInviteCode(invite.Email, code)
+	if err != nil {
+		logger.Logf("ERROR Email was not sent: " + err.Error())
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return saved, nil
+}
+
+// ListInvites returns a page of invites, newest first. Available only for admin.
+func (s *AuthService) ListInvites(ctx context.Context, token string, query dao.InviteQuery) (*st.InvitePage, error) {
+	_, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = defaultPageSize
+	}
+	if query.Limit > maxPageSize {
+		query.Limit = maxPageSize
+	}
+
+	page, err := s.UserDao.ListInvites(ctx, query)
+	if errors.Is(err, dao.ErrInvalidQuery) {
+		return nil, st.AuthError{Msg: "Invalid query or cursor", Status: 400}
+	}
+	if err != nil {
+		return nil, mapDaoError(err)
+	}
+
+	now := time.Now()
+	for i := range page.Invites {
+		if page.Invites[i].Expired(now) {
+			page.Invites[i].Status = st.InviteStatusExpired
+		}
+	}
+	return &st.InvitePage{Invites: page.Invites, NextCursor: page.NextCursor}, nil
+}
+
+// ResendInvite emails new code of pending invite and extends its expiry, profile of the invite is kept. Available only for admin.
+func (s *AuthService) ResendInvite(ctx context.Context, token string, id string) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	invite, err := s.getInvite(ctx, id)
+	if err != nil {
+		return err
+	}
+	if invite.Status != st.InviteStatusPending {
+		return st.AuthError{Msg: "Invite is not pending", Status: 409}
+	}
+
+	_, err = s.sendInvite(ctx, admin, invite)
+	if err != nil {
+		return err
+	}
+	s.audit(ctx, admin, st.AuditResendInvite, 0, "invite "+id)
+	return nil
+}
+
+// RevokeInvite makes pending invite unusable. Available only for admin.
+func (s *AuthService) RevokeInvite(ctx context.Context, token string, id string) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	err = s.UserDao.SetInviteStatus(ctx, id, st.InviteStatusPending, st.InviteStatusRevoked, 0)
+	if errors.Is(err, dao.ErrNotFound) {
+		_, err = s.getInvite(ctx, id)
+		if err != nil {
+			return err
+		}
+		return st.AuthError{Msg: "Invite is not pending", Status: 409}
+	}
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	s.audit(ctx, admin, st.AuditRevokeInvite, 0, "invite "+id)
+	return nil
+}
+
+// validateInviteProfile checks roles, organization and attributes the invited user will get
+func (s *AuthService) validateInviteProfile(ctx context.Context, invite *st.Invite) error {
+	err := validateMembership(invite.Roles, invite.Organization)
+	if err != nil {
+		return err
+	}
+	if len(invite.Attributes) == 0 {
+		return nil
+	}
+
+	schema, err := s.UserDao.GetProfileSchema(ctx)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	err = validateAttributes(schema, invite.Attributes, false, true)
+	if err != nil {
+		return err
+	}
+	for name, value := range invite.Attributes {
+		if value == nil {
+			delete(invite.Attributes, name)
+		}
+	}
+	return nil
+}
+
+// validateMembership checks roles and organization assigned by admin
+func validateMembership(roles []string, organization string) error {
+	if len(roles) > maxRoles {
+		return st.AuthError{Msg: fmt.Sprintf("At most %d roles can be assigned", maxRoles), Status: 400}
+	}
+	for _, role := range roles {
+		if !rolePattern.MatchString(role) {
+			return st.AuthError{Msg: fmt.Sprintf("Invalid role %q", role), Status: 400}
+		}
+		if containsString(reservedRoles, role) {
+			return st.AuthError{Msg: fmt.Sprintf("Role %q is reserved", role), Status: 400}
+		}
+	}
+	if len(organization) > maxOrganizationLength {
+		return st.AuthError{Msg: fmt.Sprintf("Organization must not exceed %d characters", maxOrganizationLength), Status: 400}
+	}
+	return nil
+}
+
+func (s *AuthService) getInvite(ctx context.Context, id string) (*st.Invite, error) {
+	invite, err := s.UserDao.GetInvite(ctx, id)
+	if errors.Is(err, dao.ErrNotFound) {
+		return nil, st.AuthError{Msg: "Invite does not exist", Status: 404}
+	}
+	if err != nil {
+		return nil, mapDaoError(err)
+	}
+	return invite, nil
+}
+
+// findInvite returns pending invite of the email if the code matches and the invite has not expired
+func (s *AuthService) findInvite(ctx context.Context, email string, code string) (*st.Invite, error) {
+	invite, err := s.UserDao.GetPendingInvite(ctx, email)
+	if err != nil && !errors.Is(err, dao.ErrNotFound) {
+		logger.Logf("ERROR Failed to fetch invite, %s", err.Error())
+		return nil, mapDaoError(err)
+	}
+	if invite == nil || code == "" || !crypto.MatchDigest(code, invite.CodeHash) {
+		return nil, st.AuthError{Msg: "Wrong email or invite code", Status: 401}
+	}
+	if invite.Expired(time.Now()) {
+		return nil, st.AuthError{Msg: "Invite has expired", Status: 401}
+	}
+	return invite, nil
+}
+
+// applyInvite assigns roles and organization of the invite to the user, names of the invite are used unless the user gave own ones.
+// Attributes of the invite are applied with validation of user attributes.
+func applyInvite(u *st.User, invite *st.Invite) {
+	if u.FirstName == "" {
+		u.FirstName = invite.FirstName
+	}
+	if u.LastName == "" {
+		u.LastName = invite.LastName
+	}
+	u.Roles = invite.Roles
+	u.Organization = invite.Organization
+}
+
+// claimInvite marks the invite accepted, so it can not be used twice
+func (s *AuthService) claimInvite(ctx context.Context, invite *st.Invite) error {
+	err := s.UserDao.SetInviteStatus(ctx, invite.ID, st.InviteStatusPending, st.InviteStatusAccepted, 0)
+	if errors.Is(err, dao.ErrNotFound) {
+		return st.AuthError{Msg: "Invite was already used", Status: 401}
+	}
+	if err != nil {
+		return mapDaoError(err)
+	}
+	return nil
+}
+
+// releaseInvite makes claimed invite pending again when the user could not be created
+func (s *AuthService) releaseInvite(ctx context.Context, invite *st.Invite) {
+	err := s.UserDao.SetInviteStatus(ctx, invite.ID, st.InviteStatusAccepted, st.InviteStatusPending, 0)
+	if err != nil {
+		logger.Logf("ERROR Failed to release invite %s: %s", invite.ID, err.Error())
+	}
+}
+
+// recordInviteAcceptance links claimed invite to the created user. The user exists already, so failure is only logged.
+func (s *AuthService) recordInviteAcceptance(ctx context.Context, invite *st.Invite, userID int) {
+	err := s.UserDao.SetInviteStatus(ctx, invite.ID, st.InviteStatusAccepted, st.InviteStatusAccepted, userID)
+	if err != nil {
+		logger.Logf("ERROR Failed to record acceptance of invite %s: %s", invite.ID, err.Error())
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"ruslanlesko/brightonum/src/dao"
+	"ruslanlesko/brightonum/src/email"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+func createPrivateTestConfig() Config {
+	conf := createTestConfig()
+	conf.Private = true
+	return conf
+}
+
+func createTestInvite() st.Invite {
+	return st.Invite{ID: "invite-1", Email: "sarah@email.com", CodeHash: hashedCode, InviterID: 42, Status: st.InviteStatusPending}
+}
+
+func TestAuthService_InviteUser_RegisteredEmail(t *testing.T) {
+	admin := createTestUser()
+	registered := createAnotherTestUser()
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("GetByEmail", registered.Email).Return(&registered, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.InviteUser(ctx, &st.Invite{Email: registered.Email}, issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath))
+	assert.Equal(t, st.AuthError{Msg: "Email already exists", Status: 409}, err)
+	userDao.AssertNotCalled(t, "SaveInvite", mock.Anything)
+}
+
+func TestAuthService_CreateUser_WithInvite(t *testing.T) {
+	invite := createTestInvite()
+	u := st.User{Username: "sarah", Email: invite.Email, Password: "oakheart", InviteCode: code}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("GetPendingInvite", invite.Email).Return(&invite, nil)
+	userDao.On("SetInviteStatus", invite.ID, st.InviteStatusPending, st.InviteStatusAccepted, 0).Return(nil)
+	userDao.On("Save", mock.MatchedBy(func(saved *st.User) bool { return saved.InviteCode == "" })).Return(44, nil)
+	userDao.On("SetInviteStatus", invite.ID, st.InviteStatusAccepted, st.InviteStatusAccepted, 44).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createPrivateTestConfig()}
+
+	err := s.CreateUser(ctx, &u)
+	assert.Nil(t, err)
+	assert.Equal(t, 44, u.ID)
+	userDao.AssertExpectations(t)
+}
+
+func TestAuthService_CreateUser_AppliesInviteProfile(t *testing.T) {
+	invite := createTestInvite()
+	invite.FirstName = "Sarah"
+	invite.LastName = "Lynn"
+	invite.Roles = []string{"editor"}
+	invite.Organization = "Hollywoo Stars"
+	invite.Attributes = map[string]interface{}{"team": "cast", "tier": "gold", "removed": "x"}
+	schema := st.ProfileSchema{Fields: []st.ProfileField{
+		{Name: "team", Type: st.AttributeString, Visibility: st.VisibilityPublic},
+		{Name: "tier", Type: st.AttributeString, Required: true, Visibility: st.VisibilityAdmin},
+	}}
+	u := st.User{
+		Username:     "sarah",
+		LastName:     "Lynn-Sanchez",
+		Email:        invite.Email,
+		Password:     "oakheart",
+		InviteCode:   code,
+		Roles:        []string{"admin"},
+		Organization: "Self",
+	}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&schema, nil)
+	userDao.On("GetPendingInvite", invite.Email).Return(&invite, nil)
+	userDao.On("SetInviteStatus", invite.ID, st.InviteStatusPending, st.InviteStatusAccepted, 0).Return(nil)
+	userDao.On("Save", mock.Anything).Return(44, nil)
+	userDao.On("SetInviteStatus", invite.ID, st.InviteStatusAccepted, st.InviteStatusAccepted, 44).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createPrivateTestConfig()}
+
+	err := s.CreateUser(ctx, &u)
+	assert.Nil(t, err)
+	assert.Equal(t, "Sarah", u.FirstName)
+	assert.Equal(t, "Lynn-Sanchez", u.LastName)
+	assert.Equal(t, []string{"editor"}, u.Roles)
+	assert.Equal(t, "Hollywoo Stars", u.Organization)
+	assert.Equal(t, map[string]interface{}{"team": "cast", "tier": "gold"}, u.Attributes)
+}
+
+func TestAuthService_CreateUser_IgnoresSelfAssignedRoles(t *testing.T) {
+	u := st.User{Username: "sarah", Email: "sarah@email.com", Password: "oakheart", Roles: []string{"admin"}, Organization: "Self"}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("Save", mock.Anything).Return(44, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.CreateUser(ctx, &u)
+	assert.Nil(t, err)
+	assert.Nil(t, u.Roles)
+	assert.Equal(t, "", u.Organization)
+}
+
+func TestAuthService_InviteUser_InvalidProfile(t *testing.T) {
+	admin := createTestUser()
+	schema := st.ProfileSchema{Fields: []st.ProfileField{{Name: "team", Type: st.AttributeString}}}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("GetProfileSchema").Return(&schema, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+
+	err := s.InviteUser(ctx, &st.Invite{Email: invitedEmail, Roles: []string{"Bad Role"}}, token)
+	assert.Equal(t, st.AuthError{Msg: `Invalid role "Bad Role"`, Status: 400}, err)
+
+	for _, role := range []string{"admin", "user"} {
+		err = s.InviteUser(ctx, &st.Invite{Email: invitedEmail, Roles: []string{role}}, token)
+		assert.Equal(t, st.AuthError{Msg: fmt.Sprintf("Role %q is reserved", role), Status: 400}, err)
+	}
+
+	err = s.InviteUser(ctx, &st.Invite{Email: invitedEmail, Attributes: map[string]interface{}{"team": 7}}, token)
+	assert.Equal(t, st.AuthError{Msg: "Attribute team must be string matching the schema", Status: 400}, err)
+
+	err = s.InviteUser(ctx, &st.Invite{Email: invitedEmail, Attributes: map[string]interface{}{"unknown": "x"}}, token)
+	assert.Equal(t, st.AuthError{Msg: "Unknown attribute unknown", Status: 400}, err)
+	userDao.AssertNotCalled(t, "SaveInvite", mock.Anything)
+}
+
+func TestAuthService_CreateUser_InviteRejected(t *testing.T) {
+	invite := createTestInvite()
+	expired := createTestInvite()
+	expired.Email = "expired@email.com"
+	expiresAt := time.Now().Add(-time.Minute)
+	expired.ExpiresAt = &expiresAt
+	used := createTestInvite()
+	used.Email = "used@email.com"
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "sarah").Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("GetPendingInvite", invite.Email).Return(&invite, nil)
+	userDao.On("GetPendingInvite", expired.Email).Return(&expired, nil)
+	userDao.On("GetPendingInvite", used.Email).Return(&used, nil)
+	userDao.On("GetPendingInvite", "stranger@email.com").Return(nil, dao.ErrNotFound)
+	userDao.On("SetInviteStatus", used.ID, st.InviteStatusPending, st.InviteStatusAccepted, 0).Return(dao.ErrNotFound)
+
+	s := AuthService{&mailer, &userDao, createPrivateTestConfig()}
+
+	err := s.CreateUser(ctx, &st.User{Username: "sarah", Email: invite.Email, Password: "oakheart", InviteCode: "000000"})
+	assert.Equal(t, st.AuthError{Msg: "Wrong email or invite code", Status: 401}, err)
+
+	err = s.CreateUser(ctx, &st.User{Username: "sarah", Email: "stranger@email.com", Password: "oakheart", InviteCode: code})
+	assert.Equal(t, st.AuthError{Msg: "Wrong email or invite code", Status: 401}, err)
+
+	err = s.CreateUser(ctx, &st.User{Username: "sarah", Email: expired.Email, Password: "oakheart", InviteCode: code})
+	assert.Equal(t, st.AuthError{Msg: "Invite has expired", Status: 401}, err)
+
+	err = s.CreateUser(ctx, &st.User{Username: "sarah", Email: used.Email, Password: "oakheart", InviteCode: code})
+	assert.Equal(t, st.AuthError{Msg: "Invite was already used", Status: 401}, err)
+
+	userDao.AssertNotCalled(t, "Save", mock.Anything)
+}
+
+func TestAuthService_CreateUser_InviteReleasedOnFailure(t *testing.T) {
+	invite := createTestInvite()
+	u := st.User{Username: "sarah", Email: invite.Email, Password: "oakheart", InviteCode: code}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("GetPendingInvite", invite.Email).Return(&invite, nil)
+	userDao.On("SetInviteStatus", invite.ID, st.InviteStatusPending, st.InviteStatusAccepted, 0).Return(nil)
+	userDao.On("Save", mock.Anything).Return(0, dao.ErrDuplicateUsername)
+	userDao.On("SetInviteStatus", invite.ID, st.InviteStatusAccepted, st.InviteStatusPending, 0).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createPrivateTestConfig()}
+
+	err := s.CreateUser(ctx, &u)
+	assert.Equal(t, st.AuthError{Msg: "Username already exists", Status: 409}, err)
+	userDao.AssertExpectations(t)
+}
+
+func TestAuthService_ListInvites(t *testing.T) {
+	admin := createTestUser()
+	expiresAt := time.Now().Add(-time.Hour)
+	expired := createTestInvite()
+	expired.ExpiresAt = &expiresAt
+	accepted := createTestInvite()
+	accepted.Status = st.InviteStatusAccepted
+	accepted.ExpiresAt = &expiresAt
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("ListInvites", dao.InviteQuery{Limit: defaultPageSize}).
+		Return(&dao.InvitePage{Invites: []st.Invite{expired, accepted}, NextCursor: "next"}, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	page, err := s.ListInvites(ctx, issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath), dao.InviteQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, st.InviteStatusExpired, page.Invites[0].Status)
+	assert.Equal(t, st.InviteStatusAccepted, page.Invites[1].Status)
+	assert.Equal(t, "next", page.NextCursor)
+}
+
+func TestAuthService_ResendInvite(t *testing.T) {
+	admin := createTestUser()
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+	invite := createTestInvite()
+	accepted := createTestInvite()
+	accepted.ID = "invite-2"
+	accepted.Status = st.InviteStatusAccepted
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("GetInvite", invite.ID).Return(&invite, nil)
+	userDao.On("GetInvite", accepted.ID).Return(&accepted, nil)
+	userDao.On("GetInvite", "missing").Return(nil, dao.ErrNotFound)
+	userDao.On("SaveInvite", mock.MatchedBy(func(i *st.Invite) bool {
+		return i.Email == invite.Email && i.CodeHash != invite.CodeHash
+	})).Return(&invite, nil)
+	userDao.On("SaveAuditRecord", mock.MatchedBy(func(r *st.AuditRecord) bool {
+		return r.Action == st.AuditResendInvite && r.Details == "invite "+invite.ID
+	})).Return(nil)
+
+	mailer := email.MailerMock{}
+	mailer.On("SendInviteCode", invite.Email, mock.Anything).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	assert.Nil(t, s.ResendInvite(ctx, token, invite.ID))
+	assert.Equal(t, st.AuthError{Msg: "Invite is not pending", Status: 409}, s.ResendInvite(ctx, token, accepted.ID))
+	assert.Equal(t, st.AuthError{Msg: "Invite does not exist", Status: 404}, s.ResendInvite(ctx, token, "missing"))
+	userDao.AssertNumberOfCalls(t, "SaveInvite", 1)
+	mailer.AssertExpectations(t)
+}
+
+func TestAuthService_RevokeInvite(t *testing.T) {
+	admin := createTestUser()
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+	accepted := createTestInvite()
+	accepted.Status = st.InviteStatusAccepted
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("SetInviteStatus", "invite-1", st.InviteStatusPending, st.InviteStatusRevoked, 0).Return(nil)
+	userDao.On("SetInviteStatus", "invite-2", st.InviteStatusPending, st.InviteStatusRevoked, 0).Return(dao.ErrNotFound)
+	userDao.On("SetInviteStatus", "missing", st.InviteStatusPending, st.InviteStatusRevoked, 0).Return(dao.ErrNotFound)
+	userDao.On("GetInvite", "invite-2").Return(&accepted, nil)
+	userDao.On("GetInvite", "missing").Return(nil, dao.ErrNotFound)
+	userDao.On("SaveAuditRecord", mock.Anything).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	assert.Nil(t, s.RevokeInvite(ctx, token, "invite-1"))
+	assert.Equal(t, st.AuthError{Msg: "Invite is not pending", Status: 409}, s.RevokeInvite(ctx, token, "invite-2"))
+	assert.Equal(t, st.AuthError{Msg: "Invite does not exist", Status: 404}, s.RevokeInvite(ctx, token, "missing"))
+	userDao.AssertNumberOfCalls(t, "SaveAuditRecord", 1)
+}
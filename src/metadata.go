@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// serviceToken is a static token of an application which can access only metadata in its own namespaces
+type serviceToken struct {
+	token      string
+	namespaces []string
+}
+
+// parseServiceTokens parses service tokens given as "token:namespace1,namespace2"
+func parseServiceTokens(entries []string) ([]serviceToken, error) {
+	result := []serviceToken{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("service token must be given as token:namespace1,namespace2")
+		}
+		namespaces := strings.Split(parts[1], ",")
+		for _, ns := range namespaces {
+			if !namespacePattern.MatchString(ns) {
+				return nil, fmt.Errorf("invalid namespace %q of service token", ns)
+			}
+		}
+		result = append(result, serviceToken{token: parts[0], namespaces: namespaces})
+	}
+	return result, nil
+}
+
+// metadataAccess checks that the token can access metadata of user id in the namespace.
+// Service tokens are limited to their namespaces, user tokens to metadata of the owner, admins can access anyone's.
+func (s *AuthService) metadataAccess(ctx context.Context, token string, id int, namespace string) error {
+	if !namespacePattern.MatchString(namespace) {
+		return st.AuthError{Msg: "Invalid namespace", Status: 400}
+	}
+
+	for _, svc := range s.Config.serviceTokens {
+		if subtle.ConstantTimeCompare([]byte(svc.token), []byte(token)) != 1 {
+			continue
+		}
+		if !containsString(svc.namespaces, namespace) {
+			return st.AuthError{Msg: "Namespace is not available for the service", Status: 403}
+		}
+		_, err := s.UserDao.Get(ctx, id)
+		if err != nil {
+			return mapDaoError(err)
+		}
+		return nil
+	}
+
+	u, err := s.validateToken(ctx, token)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	if u == nil {
+		return st.AuthError{Msg: "Invalid token", Status: 401}
+	}
+	if u.ID == id {
+		return nil
+	}
+	if !contains(s.Config.AdminIDs, u.ID) {
+		return st.AuthError{Msg: "Metadata of other users is not available", Status: 403}
+	}
+	_, err = s.UserDao.Get(ctx, id)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	return nil
+}
+
+// GetMetadata returns metadata of the user in the namespace
+func (s *AuthService) GetMetadata(ctx context.Context, token string, id int, namespace string) (*st.Metadata, error) {
+	err := s.metadataAccess(ctx, token, id, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := s.UserDao.GetMetadata(ctx, id, namespace)
+	if err != nil {
+		return nil, metadataError(err)
+	}
+	return m, nil
+}
+
+// PutMetadata replaces metadata of the user in the namespace and returns its new version.
+// Expected version is dao.AnyVersion for unconditional write, dao.NoVersion to only create metadata
+// or the version the caller has read.
+func (s *AuthService) PutMetadata(ctx context.Context, token string, id int, namespace string, data []byte, expected int64) (int64, error) {
+	err := s.metadataAccess(ctx, token, id, namespace)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(data) > s.Config.MetadataMaxBytes {
+		return 0, st.AuthError{Msg: fmt.Sprintf("Metadata must not exceed %d bytes", s.Config.MetadataMaxBytes), Status: 413}
+	}
+	if !json.Valid(data) {
+		return 0, st.AuthError{Msg: "Metadata must be valid JSON", Status: 400}
+	}
+
+	version, err := s.UserDao.PutMetadata(ctx, id, namespace, string(data), expected)
+	if err != nil {
+		return 0, metadataError(err)
+	}
+	return version, nil
+}
+
+// DeleteMetadata removes metadata of the user in the namespace if it has expected version
+func (s *AuthService) DeleteMetadata(ctx context.Context, token string, id int, namespace string, expected int64) error {
+	err := s.metadataAccess(ctx, token, id, namespace)
+	if err != nil {
+		return err
+	}
+
+	err = s.UserDao.DeleteMetadata(ctx, id, namespace, expected)
+	if err != nil {
+		return metadataError(err)
+	}
+	return nil
+}
+
+func metadataError(err error) st.AuthError {
+	switch {
+	case errors.Is(err, dao.ErrVersionMismatch):
+		return st.AuthError{Msg: "Metadata version does not match", Status: 412}
+	case errors.Is(err, dao.ErrNotFound):
+		return st.AuthError{Msg: "Metadata does not exist", Status: 404}
+	}
+	return mapDaoError(err)
+}
+
+func containsString(slice []string, element string) bool {
+	for _, e := range slice {
+		if e == element {
+			return true
+		}
+	}
+	return false
+}
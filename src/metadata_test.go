@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+func createMetadataTestConfig() Config {
+	conf := createTestConfig()
+	conf.ServiceTokens = []string{"s3cr3t:onboarding,billing.prefs"}
+	conf.serviceTokens, _ = parseServiceTokens(conf.ServiceTokens)
+	conf.MetadataMaxBytes = 64
+	return conf
+}
+
+func TestParseServiceTokens(t *testing.T) {
+	tokens, err := parseServiceTokens([]string{"s3cr3t:onboarding,billing.prefs", "other:ui"})
+	assert.Nil(t, err)
+	assert.Equal(t, []serviceToken{
+		{token: "s3cr3t", namespaces: []string{"onboarding", "billing.prefs"}},
+		{token: "other", namespaces: []string{"ui"}},
+	}, tokens)
+
+	_, err = parseServiceTokens([]string{"s3cr3t"})
+	assert.NotNil(t, err)
+	_, err = parseServiceTokens([]string{"s3cr3t:"})
+	assert.NotNil(t, err)
+	_, err = parseServiceTokens([]string{"s3cr3t:Onboarding"})
+	assert.NotNil(t, err)
+}
+
+func TestAuthService_PutMetadata_ServiceToken(t *testing.T) {
+	user := createTestUser()
+	data := `{"done":true}`
+
+	userDao := dao.MockUserDao{}
+	userDao.On("Get", user.ID).Return(&user, nil)
+	userDao.On("PutMetadata", user.ID, "onboarding", data, int64(2)).Return(int64(3), nil)
+
+	s := AuthService{&mailer, &userDao, createMetadataTestConfig()}
+
+	version, err := s.PutMetadata(ctx, "s3cr3t", user.ID, "onboarding", []byte(data), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), version)
+
+	_, err = s.PutMetadata(ctx, "s3cr3t", user.ID, "ui", []byte(data), dao.AnyVersion)
+	assert.Equal(t, st.AuthError{Msg: "Namespace is not available for the service", Status: 403}, err)
+	userDao.AssertNumberOfCalls(t, "PutMetadata", 1)
+}
+
+func TestAuthService_PutMetadata_Rejected(t *testing.T) {
+	user := createTestUser()
+	other := createAnotherTestUser()
+	token := issueTestToken(other.ID, other.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", other.Username).Return(&other, nil)
+	userDao.On("PutMetadata", other.ID, "onboarding", "{}", int64(1)).Return(int64(0), dao.ErrVersionMismatch)
+
+	s := AuthService{&mailer, &userDao, createMetadataTestConfig()}
+
+	_, err := s.PutMetadata(ctx, token, user.ID, "onboarding", []byte("{}"), dao.AnyVersion)
+	assert.Equal(t, st.AuthError{Msg: "Metadata of other users is not available", Status: 403}, err)
+
+	_, err = s.PutMetadata(ctx, token, other.ID, "On Boarding", []byte("{}"), dao.AnyVersion)
+	assert.Equal(t, st.AuthError{Msg: "Invalid namespace", Status: 400}, err)
+
+	_, err = s.PutMetadata(ctx, token, other.ID, "onboarding", []byte(`{"done":`), dao.AnyVersion)
+	assert.Equal(t, st.AuthError{Msg: "Metadata must be valid JSON", Status: 400}, err)
+
+	_, err = s.PutMetadata(ctx, token, other.ID, "onboarding", make([]byte, 65), dao.AnyVersion)
+	assert.Equal(t, st.AuthError{Msg: "Metadata must not exceed 64 bytes", Status: 413}, err)
+
+	_, err = s.PutMetadata(ctx, token, other.ID, "onboarding", []byte("{}"), 1)
+	assert.Equal(t, st.AuthError{Msg: "Metadata version does not match", Status: 412}, err)
+}
+
+func TestAuthService_GetMetadata(t *testing.T) {
+	admin := createTestUser()
+	other := createAnotherTestUser()
+	m := st.Metadata{UserID: other.ID, Namespace: "onboarding", Data: `{"done":true}`, Version: 4}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("Get", other.ID).Return(&other, nil)
+	userDao.On("GetMetadata", other.ID, "onboarding").Return(&m, nil)
+	userDao.On("GetMetadata", other.ID, "billing").Return(nil, dao.ErrNotFound)
+
+	s := AuthService{&mailer, &userDao, createMetadataTestConfig()}
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+
+	result, err := s.GetMetadata(ctx, token, other.ID, "onboarding")
+	assert.Nil(t, err)
+	assert.Equal(t, &m, result)
+
+	_, err = s.GetMetadata(ctx, token, other.ID, "billing")
+	assert.Equal(t, st.AuthError{Msg: "Metadata does not exist", Status: 404}, err)
+}
+
+func TestAuthService_DeleteMetadata(t *testing.T) {
+	user := createTestUser()
+
+	userDao := dao.MockUserDao{}
+	userDao.On("Get", user.ID).Return(&user, nil)
+	userDao.On("DeleteMetadata", user.ID, "onboarding", dao.AnyVersion).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createMetadataTestConfig()}
+
+	err := s.DeleteMetadata(ctx, "s3cr3t", user.ID, "onboarding", dao.AnyVersion)
+	assert.Nil(t, err)
+
+	err = s.DeleteMetadata(ctx, "wrong", user.ID, "onboarding", dao.AnyVersion)
+	assert.Equal(t, st.AuthError{Msg: "Invalid token", Status: 401}, err)
+	userDao.AssertNumberOfCalls(t, "DeleteMetadata", 1)
+	userDao.AssertNotCalled(t, "GetMetadata", mock.Anything, mock.Anything)
+}
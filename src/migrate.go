@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"ruslanlesko/brightonum/src/dao"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// MigrateConfig provides configuration variables for migrate subcommand
+type MigrateConfig struct {
+	// MongoDB URL
+	MongoDBURL string `long:"mongoURL" required:"true" description:"URL for MongoDB"`
+
+	// Database name
+	DatabaseName string `long:"databaseName" required:"true" description:"Database name"`
+
+	Args struct {
+		Action string `positional-arg-name:"action" description:"up or status"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// runMigrate handles `migrate up` and `migrate status` subcommands
+func runMigrate(args []string) error {
+	conf := MigrateConfig{}
+	parser := flags.NewParser(&conf, flags.Default)
+	parser.Usage = "migrate [OPTIONS] up|status"
+
+	_, err := parser.ParseArgs(args)
+	if err != nil {
+		return err
+	}
+
+	userDao := dao.NewMongoUserDao(conf.MongoDBURL, conf.DatabaseName, 0)
+
+	switch conf.Args.Action {
+	case "up":
+		count, err := userDao.MigrateUp()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migration(s)\n", count)
+	case "status":
+		statuses, err := userDao.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-19s  %s\n", status.Version, applied, status.Description)
+		}
+	default:
+		return fmt.Errorf("unknown migrate action '%s', expected up or status", conf.Args.Action)
+	}
+	return nil
+}
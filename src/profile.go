@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+const maxProfileFields = 50
+
+var profileFieldNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,31}$`)
+
+// fieldPatterns caches compiled regexes of profile fields by their source, schema is loaded on every request
+var fieldPatterns sync.Map
+
+// fieldPattern compiles regex of profile field once, it has to match the whole string
+func fieldPattern(regex string) (*regexp.Regexp, error) {
+	if pattern, ok := fieldPatterns.Load(regex); ok {
+		return pattern.(*regexp.Regexp), nil
+	}
+	pattern, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return nil, err
+	}
+	fieldPatterns.Store(regex, pattern)
+	return pattern, nil
+}
+
+// GetProfileSchema returns schema of custom profile attributes. Available only for admin.
+func (s *AuthService) GetProfileSchema(ctx context.Context, token string) (*st.ProfileSchema, error) {
+	_, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := s.UserDao.GetProfileSchema(ctx)
+	if err != nil {
+		return nil, mapDaoError(err)
+	}
+	return schema, nil
+}
+
+// UpdateProfileSchema replaces schema of custom profile attributes.
+// Stored attributes are not touched: ones of removed fields are hidden and new required fields
+// are enforced only when users are created.
+func (s *AuthService) UpdateProfileSchema(ctx context.Context, token string, schema *st.ProfileSchema) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	err = validateProfileSchema(schema)
+	if err != nil {
+		return err
+	}
+
+	schema.UpdatedAt = time.Now().UTC()
+	err = s.UserDao.SaveProfileSchema(ctx, schema)
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	s.audit(ctx, admin, st.AuditUpdateProfileSchema, 0, fmt.Sprintf("%d fields", len(schema.Fields)))
+	return nil
+}
+
+func validateProfileSchema(schema *st.ProfileSchema) error {
+	if schema.Fields == nil {
+		schema.Fields = []st.ProfileField{}
+	}
+	if len(schema.Fields) > maxProfileFields {
+		return st.AuthError{Msg: fmt.Sprintf("Schema can have at most %d fields", maxProfileFields), Status: 400}
+	}
+
+	names := map[string]bool{}
+	for _, f := range schema.Fields {
+		if !profileFieldNamePattern.MatchString(f.Name) {
+			return st.AuthError{Msg: fmt.Sprintf("Invalid field name %q", f.Name), Status: 400}
+		}
+		if names[f.Name] {
+			return st.AuthError{Msg: fmt.Sprintf("Field %s is defined twice", f.Name), Status: 400}
+		}
+		names[f.Name] = true
+
+		switch f.Type {
+		case st.AttributeString, st.AttributeNumber, st.AttributeBoolean:
+		default:
+			return st.AuthError{Msg: fmt.Sprintf("Unknown type of field %s", f.Name), Status: 400}
+		}
+		switch f.Visibility {
+		case st.VisibilityPublic, st.VisibilityPrivate, st.VisibilityAdmin:
+		default:
+			return st.AuthError{Msg: fmt.Sprintf("Unknown visibility of field %s", f.Name), Status: 400}
+		}
+
+		if f.Regex == "" {
+			continue
+		}
+		if f.Type != st.AttributeString {
+			return st.AuthError{Msg: fmt.Sprintf("Regex is supported only for string field %s", f.Name), Status: 400}
+		}
+		_, err := fieldPattern(f.Regex)
+		if err != nil {
+			return st.AuthError{Msg: fmt.Sprintf("Invalid regex of field %s", f.Name), Status: 400}
+		}
+	}
+	return nil
+}
+
+// validateAttributes checks attributes against the schema. Complete set of attributes, as on creation,
+// must contain all required fields and loses null values. Otherwise null value removes the attribute,
+// which is not allowed for required fields. Attributes with admin visibility can be set only by admin.
+func validateAttributes(schema *st.ProfileSchema, attrs map[string]interface{}, complete bool, byAdmin bool) error {
+	for name, value := range attrs {
+		field := schema.Field(name)
+		if field == nil {
+			return st.AuthError{Msg: "Unknown attribute " + name, Status: 400}
+		}
+		if field.Visibility == st.VisibilityAdmin && !byAdmin {
+			return st.AuthError{Msg: fmt.Sprintf("Attribute %s can be set only by admin", name), Status: 403}
+		}
+		if value == nil {
+			if field.Required {
+				return st.AuthError{Msg: fmt.Sprintf("Attribute %s is required", name), Status: 400}
+			}
+			if complete {
+				delete(attrs, name)
+			}
+			continue
+		}
+		if !validAttributeValue(field, value) {
+			return st.AuthError{Msg: fmt.Sprintf("Attribute %s must be %s matching the schema", name, field.Type), Status: 400}
+		}
+	}
+
+	if !complete {
+		return nil
+	}
+	for _, field := range schema.Fields {
+		if !field.Required || (field.Visibility == st.VisibilityAdmin && !byAdmin) {
+			continue
+		}
+		if _, ok := attrs[field.Name]; !ok {
+			return st.AuthError{Msg: fmt.Sprintf("Attribute %s is required", field.Name), Status: 400}
+		}
+	}
+	return nil
+}
+
+// validAttributeValue checks value decoded from JSON against the field type.
+// Regex has to match the whole string.
+func validAttributeValue(field *st.ProfileField, value interface{}) bool {
+	switch field.Type {
+	case st.AttributeNumber:
+		_, ok := value.(float64)
+		return ok
+	case st.AttributeBoolean:
+		_, ok := value.(bool)
+		return ok
+	case st.AttributeString:
+		str, ok := value.(string)
+		if !ok {
+			return false
+		}
+		if field.Regex == "" {
+			return true
+		}
+		pattern, err := fieldPattern(field.Regex)
+		return err == nil && pattern.MatchString(str)
+	}
+	return false
+}
+
+// checkAttributes validates attributes of the user against stored profile schema.
+// Schema is not loaded for partial update without attributes.
+func (s *AuthService) checkAttributes(ctx context.Context, u *st.User, complete bool, byAdmin bool) error {
+	if len(u.Attributes) == 0 && !complete {
+		return nil
+	}
+	schema, err := s.UserDao.GetProfileSchema(ctx)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	return validateAttributes(schema, u.Attributes, complete, byAdmin)
+}
+
+// checkNewUserAttributes validates attributes of the user being created. Attributes of the invite were set by admin:
+// ones with admin visibility are added after validation, others are defaults the user can override.
+// Attributes of fields removed from the schema since the invite are dropped.
+func (s *AuthService) checkNewUserAttributes(ctx context.Context, u *st.User, invite *st.Invite) error {
+	schema, err := s.UserDao.GetProfileSchema(ctx)
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	granted := map[string]interface{}{}
+	if invite != nil {
+		for name, value := range invite.Attributes {
+			field := schema.Field(name)
+			if field == nil {
+				continue
+			}
+			if field.Visibility == st.VisibilityAdmin {
+				granted[name] = value
+				continue
+			}
+			if _, given := u.Attributes[name]; given {
+				continue
+			}
+			if u.Attributes == nil {
+				u.Attributes = map[string]interface{}{}
+			}
+			u.Attributes[name] = value
+		}
+	}
+
+	err = validateAttributes(schema, u.Attributes, true, false)
+	if err != nil {
+		return err
+	}
+	for name, value := range granted {
+		if u.Attributes == nil {
+			u.Attributes = map[string]interface{}{}
+		}
+		u.Attributes[name] = value
+	}
+	return nil
+}
+
+// userInfo maps user to user info with attributes visible to the viewer
+func (s *AuthService) userInfo(ctx context.Context, u *st.User, viewer *st.User) (*st.UserInfo, error) {
+	infos, err := s.userInfos(ctx, []st.User{*u}, viewer.ID, contains(s.Config.AdminIDs, viewer.ID))
+	if err != nil {
+		return nil, err
+	}
+	return &infos[0], nil
+}
+
+// userInfos maps users to user info with attributes visible to the viewer.
+// Owner sees own private attributes, admin sees all of them.
+func (s *AuthService) userInfos(ctx context.Context, users []st.User, viewerID int, admin bool) ([]st.UserInfo, error) {
+	result := make([]st.UserInfo, 0, len(users))
+
+	var schema *st.ProfileSchema
+	for i := range users {
+		info := mapToUserInfo(&users[i])
+		if len(users[i].Attributes) > 0 {
+			if schema == nil {
+				var err error
+				schema, err = s.UserDao.GetProfileSchema(ctx)
+				if err != nil {
+					return nil, mapDaoError(err)
+				}
+			}
+			info.Attributes = visibleAttributes(schema, users[i].Attributes, admin, users[i].ID == viewerID)
+		}
+		result = append(result, *info)
+	}
+	return result, nil
+}
+
+// visibleAttributes filters attributes by visibility of their fields, attributes of removed fields are hidden
+func visibleAttributes(schema *st.ProfileSchema, attrs map[string]interface{}, admin bool, owner bool) map[string]interface{} {
+	visible := map[string]interface{}{}
+	for name, value := range attrs {
+		field := schema.Field(name)
+		if field == nil {
+			continue
+		}
+		switch field.Visibility {
+		case st.VisibilityPublic:
+		case st.VisibilityPrivate:
+			if !admin && !owner {
+				continue
+			}
+		default:
+			if !admin {
+				continue
+			}
+		}
+		visible[name] = value
+	}
+	if len(visible) == 0 {
+		return nil
+	}
+	return visible
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+func createTestProfileSchema() *st.ProfileSchema {
+	return &st.ProfileSchema{Fields: []st.ProfileField{
+		{Name: "phone", Type: st.AttributeString, Required: true, Regex: `\+[0-9]{7,15}`, Visibility: st.VisibilityPrivate},
+		{Name: "department", Type: st.AttributeString, Visibility: st.VisibilityPublic},
+		{Name: "floor", Type: st.AttributeNumber, Visibility: st.VisibilityPublic},
+		{Name: "trusted", Type: st.AttributeBoolean, Required: true, Visibility: st.VisibilityAdmin},
+	}}
+}
+
+func TestValidateProfileSchema(t *testing.T) {
+	assert.Nil(t, validateProfileSchema(createTestProfileSchema()))
+	assert.Nil(t, validateProfileSchema(&st.ProfileSchema{}))
+
+	invalid := []st.ProfileField{
+		{Name: "1phone", Type: st.AttributeString, Visibility: st.VisibilityPublic},
+		{Name: "phone", Type: "date", Visibility: st.VisibilityPublic},
+		{Name: "phone", Type: st.AttributeString, Visibility: "friends"},
+		{Name: "phone", Type: st.AttributeString, Regex: "[0-9", Visibility: st.VisibilityPublic},
+		{Name: "floor", Type: st.AttributeNumber, Regex: "[0-9]+", Visibility: st.VisibilityPublic},
+	}
+	for _, f := range invalid {
+		err := validateProfileSchema(&st.ProfileSchema{Fields: []st.ProfileField{f}})
+		assert.Equal(t, 400, err.(st.AuthError).Status, f.Name)
+	}
+
+	duplicate := st.ProfileField{Name: "phone", Type: st.AttributeString, Visibility: st.VisibilityPublic}
+	err := validateProfileSchema(&st.ProfileSchema{Fields: []st.ProfileField{duplicate, duplicate}})
+	assert.Equal(t, st.AuthError{Msg: "Field phone is defined twice", Status: 400}, err)
+}
+
+func TestValidateAttributes(t *testing.T) {
+	schema := createTestProfileSchema()
+
+	attrs := map[string]interface{}{"phone": "+380501234567", "department": nil, "floor": 3.0}
+	assert.Nil(t, validateAttributes(schema, attrs, true, false))
+	assert.NotContains(t, attrs, "department")
+
+	err := validateAttributes(schema, map[string]interface{}{"department": "R&D"}, true, false)
+	assert.Equal(t, st.AuthError{Msg: "Attribute phone is required", Status: 400}, err)
+
+	err = validateAttributes(schema, map[string]interface{}{"phone": "+380501234567"}, true, true)
+	assert.Equal(t, st.AuthError{Msg: "Attribute trusted is required", Status: 400}, err)
+
+	err = validateAttributes(schema, map[string]interface{}{"phone": "call me +380501234567"}, false, false)
+	assert.Equal(t, st.AuthError{Msg: "Attribute phone must be string matching the schema", Status: 400}, err)
+
+	err = validateAttributes(schema, map[string]interface{}{"floor": "3"}, false, false)
+	assert.Equal(t, st.AuthError{Msg: "Attribute floor must be number matching the schema", Status: 400}, err)
+
+	err = validateAttributes(schema, map[string]interface{}{"phone": nil}, false, false)
+	assert.Equal(t, st.AuthError{Msg: "Attribute phone is required", Status: 400}, err)
+
+	err = validateAttributes(schema, map[string]interface{}{"trusted": true}, false, false)
+	assert.Equal(t, st.AuthError{Msg: "Attribute trusted can be set only by admin", Status: 403}, err)
+	assert.Nil(t, validateAttributes(schema, map[string]interface{}{"trusted": true}, false, true))
+
+	err = validateAttributes(schema, map[string]interface{}{"nickname": "al"}, false, false)
+	assert.Equal(t, st.AuthError{Msg: "Unknown attribute nickname", Status: 400}, err)
+
+	assert.Nil(t, validateAttributes(schema, map[string]interface{}{"department": nil}, false, false))
+}
+
+func TestFieldPattern(t *testing.T) {
+	pattern, err := fieldPattern(`[a-z]+`)
+	assert.Nil(t, err)
+	assert.True(t, pattern.MatchString("floor"))
+	assert.False(t, pattern.MatchString("floor 3"))
+
+	cached, err := fieldPattern(`[a-z]+`)
+	assert.Nil(t, err)
+	assert.Same(t, pattern, cached)
+
+	_, err = fieldPattern(`[a-z`)
+	assert.NotNil(t, err)
+}
+
+func TestAuthService_CreateUser_InvalidAttributes(t *testing.T) {
+	u := createTestUser()
+	u.Attributes = map[string]interface{}{"phone": "unknown"}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(createTestProfileSchema(), nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.CreateUser(ctx, &u)
+	assert.Equal(t, st.AuthError{Msg: "Attribute phone must be string matching the schema", Status: 400}, err)
+	userDao.AssertNotCalled(t, "Save", mock.Anything)
+}
+
+func TestAuthService_UpdateUser_Attributes(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+	payload := st.User{ID: user.ID, Attributes: map[string]interface{}{"department": "R&D", "floor": nil}}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetProfileSchema").Return(createTestProfileSchema(), nil)
+	userDao.On("Update", &payload).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.UpdateUser(ctx, &payload, token)
+	assert.Nil(t, err)
+	userDao.AssertExpectations(t)
+}
+
+func TestAuthService_GetUserById_AttributesVisibility(t *testing.T) {
+	admin := createTestUser()
+	viewer := createAnotherTestUser()
+	target := st.User{ID: 44, Username: "sarah", Attributes: map[string]interface{}{
+		"phone": "+380501234567", "department": "R&D", "trusted": true, "removed": "value",
+	}}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("GetByUsername", viewer.Username).Return(&viewer, nil)
+	userDao.On("GetByUsername", target.Username).Return(&target, nil)
+	userDao.On("Get", target.ID).Return(&target, nil)
+	userDao.On("GetProfileSchema").Return(createTestProfileSchema(), nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	info, err := s.GetUserById(ctx, target.ID, issueTestToken(viewer.ID, viewer.Username, createTestConfig().PrivKeyPath))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"department": "R&D"}, info.Attributes)
+
+	info, err = s.GetUserById(ctx, target.ID, issueTestToken(target.ID, target.Username, createTestConfig().PrivKeyPath))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"department": "R&D", "phone": "+380501234567"}, info.Attributes)
+
+	info, err = s.GetUserById(ctx, target.ID, issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"department": "R&D", "phone": "+380501234567", "trusted": true}, info.Attributes)
+}
+
+func TestAuthService_UpdateProfileSchema(t *testing.T) {
+	admin := createTestUser()
+	schema := createTestProfileSchema()
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("SaveProfileSchema", schema).Return(nil)
+	userDao.On("SaveAuditRecord", mock.MatchedBy(func(r *st.AuditRecord) bool {
+		return r.Action == st.AuditUpdateProfileSchema && r.Details == "4 fields"
+	})).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.UpdateProfileSchema(ctx, issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath), schema)
+	assert.Nil(t, err)
+	assert.False(t, schema.UpdatedAt.IsZero())
+	userDao.AssertExpectations(t)
+}
+
+func TestAuthService_UpdateProfileSchema_NotAdmin(t *testing.T) {
+	u := createAnotherTestUser()
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(&u, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.UpdateProfileSchema(ctx, issueTestToken(u.ID, u.Username, createTestConfig().PrivKeyPath), createTestProfileSchema())
+	assert.Equal(t, st.AuthError{Msg: "Available only for admin", Status: 403}, err)
+	userDao.AssertNotCalled(t, "SaveProfileSchema", mock.Anything)
+}
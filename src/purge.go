@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// PurgeDeletedUsers permanently removes users deleted longer than retention period ago
+func (s *AuthService) PurgeDeletedUsers(ctx context.Context) (int, error) {
+	before := time.Now().Add(-s.Config.DeletedUserRetention).UTC()
+	count, err := s.UserDao.PurgeDeleted(ctx, before)
+	if err != nil {
+		return 0, mapDaoError(err)
+	}
+	if count > 0 {
+		logger.Logf("INFO Purged %d deleted user(s)", count)
+	}
+	return count, nil
+}
+
+// RunPurgeJob purges deleted users right away and then every interval until context is done.
+// Replicas may run the job concurrently, the data layer lets only one of them purge at a time.
+func (s *AuthService) RunPurgeJob(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		logger.Logf("INFO Purge of deleted users is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := s.PurgeDeletedUsers(ctx)
+		if err != nil {
+			logger.Logf("WARN Purge of deleted users failed: %s", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
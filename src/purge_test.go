@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+func TestAuthService_PurgeDeletedUsers(t *testing.T) {
+	conf := createTestConfig()
+	conf.DeletedUserRetention = 24 * time.Hour
+	expectedBefore := time.Now().Add(-24 * time.Hour)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("PurgeDeleted", mock.MatchedBy(func(before time.Time) bool {
+		return before.Sub(expectedBefore) >= 0 && before.Sub(expectedBefore) < time.Minute
+	})).Return(3, nil)
+
+	s := AuthService{&mailer, &userDao, conf}
+
+	count, err := s.PurgeDeletedUsers(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestAuthService_PurgeDeletedUsers_DatabaseUnavailable(t *testing.T) {
+	userDao := dao.MockUserDao{}
+	userDao.On("PurgeDeleted", mock.Anything).Return(0, dao.ErrUnavailable)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	count, err := s.PurgeDeletedUsers(ctx)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, st.AuthError{Msg: "Database is unavailable", Status: 503}, err)
+}
+
+func TestAuthService_RunPurgeJob_StopsWithContext(t *testing.T) {
+	userDao := dao.MockUserDao{}
+	userDao.On("PurgeDeleted", mock.Anything).Return(0, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.RunPurgeJob(jobCtx, time.Hour)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("purge job did not stop")
+	}
+	userDao.AssertNumberOfCalls(t, "PurgeDeleted", 1)
+}
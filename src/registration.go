@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+// loadDomainList reads domains from the file, one per line. Empty lines and lines starting with # are skipped.
+func loadDomainList(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains[line] = true
+	}
+	return domains, scanner.Err()
+}
+
+// domainListed reports whether the domain or any of its parent domains is in the list
+func domainListed(domain string, list map[string]bool) bool {
+	for domain != "" {
+		if list[domain] {
+			return true
+		}
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+	return false
+}
+
+func domainSet(domains []string) map[string]bool {
+	set := map[string]bool{}
+	for _, domain := range domains {
+		set[strings.ToLower(strings.TrimPrefix(domain, "@"))] = true
+	}
+	return set
+}
+
+// checkRegistrationPolicy rejects self-service registration with email of blocked, not allowed or disposable domain
+func (s *AuthService) checkRegistrationPolicy(email string) error {
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+
+	notAllowed := st.AuthError{Msg: "Registration with email domain " + domain + " is not allowed", Status: 403, Code: st.CodeEmailDomainNotAllowed}
+	if domainListed(domain, domainSet(s.Config.BlockedDomains)) {
+		return notAllowed
+	}
+	if len(s.Config.AllowedDomains) > 0 && !domainListed(domain, domainSet(s.Config.AllowedDomains)) {
+		return notAllowed
+	}
+	if domainListed(domain, s.Config.disposableDomains) {
+		return st.AuthError{Msg: "Disposable email addresses are not allowed", Status: 403, Code: st.CodeDisposableEmail}
+	}
+	return nil
+}
+
+// AdminApproveUser activates account awaiting approval and notifies the user
+func (s *AuthService) AdminApproveUser(ctx context.Context, token string, id int) error {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	err = s.UserDao.ApproveUser(ctx, id)
+	if errors.Is(err, dao.ErrNotFound) {
+		_, err = s.UserDao.Get(ctx, id)
+		if err != nil {
+			return mapDaoError(err)
+		}
+		return st.AuthError{Msg: "User is not awaiting approval", Status: 409}
+	}
+	if err != nil {
+		return mapDaoError(err)
+	}
+	s.audit(ctx, admin, st.AuditApproveUser, id, "")
+
+	u, err := s.UserDao.Get(ctx, id)
+	if err != nil {
+		logger.Logf("ERROR Cannot fetch approved user %d: %s", id, err.Error())
+		return nil
+	}
+	err = s.Mailer.SendApprovalNotice(u.Email)
+	if err != nil {
+		logger.Logf("WARN Approval notice was not sent: %s", err.Error())
+	}
+	return nil
+}
+
+// AdminListPendingUsers returns a page of accounts awaiting approval
+func (s *AuthService) AdminListPendingUsers(ctx context.Context, token string, query dao.UserQuery) (*st.UserInfoPage, error) {
+	admin, err := s.requireAdmin(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = defaultPageSize
+	}
+	if query.Limit > maxPageSize {
+		query.Limit = maxPageSize
+	}
+	query.Status = st.StatusPending
+
+	page, err := s.UserDao.Find(ctx, query)
+	if errors.Is(err, dao.ErrInvalidQuery) {
+		return nil, st.AuthError{Msg: "Invalid query or cursor", Status: 400}
+	}
+	if err != nil {
+		return nil, mapDaoError(err)
+	}
+
+	infos, err := s.userInfos(ctx, page.Users, admin.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	return &st.UserInfoPage{Users: infos, NextCursor: page.NextCursor}, nil
+}
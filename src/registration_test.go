@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+func TestLoadDomainList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "domains")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "disposable.txt")
+	err = ioutil.WriteFile(path, []byte("# disposable\nMailinator.com\n\n  tempmail.dev \n"), 0600)
+	assert.Nil(t, err)
+
+	domains, err := loadDomainList(path)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"mailinator.com": true, "tempmail.dev": true}, domains)
+
+	_, err = loadDomainList(filepath.Join(dir, "missing.txt"))
+	assert.NotNil(t, err)
+}
+
+func TestDomainListed(t *testing.T) {
+	list := map[string]bool{"hollywoo.com": true}
+	assert.True(t, domainListed("hollywoo.com", list))
+	assert.True(t, domainListed("mail.hollywoo.com", list))
+	assert.False(t, domainListed("nothollywoo.com", list))
+	assert.False(t, domainListed("com", list))
+}
+
+func TestAuthService_CreateUser_RegistrationPolicy(t *testing.T) {
+	conf := createTestConfig()
+	conf.AllowedDomains = []string{"hollywoo.com", "@hollywoo.org"}
+	conf.BlockedDomains = []string{"spam.hollywoo.com"}
+	conf.disposableDomains = map[string]bool{"hollywoo.org": true}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "sarah").Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("Save", mock.Anything).Return(44, nil)
+
+	s := AuthService{&mailer, &userDao, conf}
+
+	cases := []struct {
+		email string
+		err   error
+	}{
+		{"sarah@Hollywoo.com", nil},
+		{"sarah@cast.hollywoo.com", nil},
+		{"sarah@spam.hollywoo.com", st.AuthError{Msg: "Registration with email domain spam.hollywoo.com is not allowed", Status: 403, Code: st.CodeEmailDomainNotAllowed}},
+		{"sarah@gmail.com", st.AuthError{Msg: "Registration with email domain gmail.com is not allowed", Status: 403, Code: st.CodeEmailDomainNotAllowed}},
+		{"sarah@hollywoo.org", st.AuthError{Msg: "Disposable email addresses are not allowed", Status: 403, Code: st.CodeDisposableEmail}},
+	}
+	for _, c := range cases {
+		u := st.User{Username: "sarah", Email: c.email, Password: "oakheart"}
+		err := s.CreateUser(ctx, &u)
+		assert.Equal(t, c.err, err, c.email)
+	}
+}
+
+func TestAuthService_CreateUser_InviteBypassesPolicy(t *testing.T) {
+	conf := createPrivateTestConfig()
+	conf.BlockedDomains = []string{"email.com"}
+	conf.RequireApproval = true
+	invite := createTestInvite()
+	u := st.User{Username: "sarah", Email: invite.Email, Password: "oakheart", InviteCode: code}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("GetPendingInvite", invite.Email).Return(&invite, nil)
+	userDao.On("SetInviteStatus", invite.ID, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	userDao.On("Save", mock.Anything).Return(44, nil)
+
+	s := AuthService{&mailer, &userDao, conf}
+
+	err := s.CreateUser(ctx, &u)
+	assert.Nil(t, err)
+	assert.False(t, u.IsPending())
+}
+
+func TestAuthService_CreateUser_RequireApproval(t *testing.T) {
+	conf := createTestConfig()
+	conf.RequireApproval = true
+	u := st.User{Username: "sarah", Email: "sarah@hollywoo.com", Password: "oakheart"}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("Save", mock.MatchedBy(func(saved *st.User) bool { return saved.IsPending() })).Return(44, nil)
+
+	s := AuthService{&mailer, &userDao, conf}
+
+	err := s.CreateUser(ctx, &u)
+	assert.Nil(t, err)
+	userDao.AssertExpectations(t)
+}
+
+func TestAuthService_BasicAuthToken_PendingUser(t *testing.T) {
+	u := createTestUser()
+	u.AccountStatus = st.AccountStatus{Status: st.StatusPending}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(&u, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	_, _, err := s.BasicAuthToken(ctx, u.Username, "oakheart")
+	assert.Equal(t, st.AuthError{Msg: "User is awaiting approval", Status: 403, Code: st.CodeAccountPending}, err)
+}
+
+func TestAuthService_AdminApproveUser(t *testing.T) {
+	admin := createTestUser()
+	pending := createAnotherTestUser()
+	active := createAnotherTestUser()
+	active.ID = 44
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("ApproveUser", pending.ID).Return(nil)
+	userDao.On("ApproveUser", active.ID).Return(dao.ErrNotFound)
+	userDao.On("ApproveUser", 45).Return(dao.ErrNotFound)
+	userDao.On("Get", pending.ID).Return(&pending, nil)
+	userDao.On("Get", active.ID).Return(&active, nil)
+	userDao.On("Get", 45).Return(nil, dao.ErrNotFound)
+	userDao.On("SaveAuditRecord", mock.Anything).Return(nil)
+	mailer.On("SendApprovalNotice", pending.Email).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+
+	assert.Nil(t, s.AdminApproveUser(ctx, token, pending.ID))
+	mailer.AssertCalled(t, "SendApprovalNotice", pending.Email)
+
+	err := s.AdminApproveUser(ctx, token, active.ID)
+	assert.Equal(t, st.AuthError{Msg: "User is not awaiting approval", Status: 409}, err)
+
+	err = s.AdminApproveUser(ctx, token, 45)
+	assert.Equal(t, 404, err.(st.AuthError).Status)
+}
+
+func TestAuthService_AdminListPendingUsers(t *testing.T) {
+	admin := createTestUser()
+	pending := createAnotherTestUser()
+	query := dao.UserQuery{Limit: defaultPageSize, Status: st.StatusPending}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("Find", query).Return(&dao.UserPage{Users: []st.User{pending}}, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+
+	page, err := s.AdminListPendingUsers(ctx, token, dao.UserQuery{})
+	assert.Nil(t, err)
+	assert.Len(t, page.Users, 1)
+	assert.Equal(t, pending.ID, page.Users[0].ID)
+}
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"ruslanlesko/brightonum/src/crypto"
 	"ruslanlesko/brightonum/src/dao"
 	"ruslanlesko/brightonum/src/email"
 	st "ruslanlesko/brightonum/src/structs"
-	"strconv"
 
 	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+
+	// tokenVersion marks tokens with user UUID as subject, older tokens carry username
+	tokenVersion       = 2
+	legacyTokensLayout = "2006-01-02"
+
+	recoveryNotInitiatedMsg = "Username does not registered or recovery process has not been initiated"
+)
+
 // AuthService provides all auth operations
 type AuthService struct {
 	Mailer  email.Mailer
@@ -22,59 +33,72 @@ type AuthService struct {
 	Config  Config
 }
 
-// InviteUser sends invite code for given email
-func (s *AuthService) InviteUser(email string, token string) error {
-	if !s.validateAdminToken(token) {
-		return st.AuthError{Msg: "Available only for admin", Status: 403}
-	}
-
-	var code = generateCode(32)
-	var user = st.User{Email: email, InviteCode: code}
-
-	id := s.UserDao.Save(&user)
-	if id < 0 {
-		return st.AuthError{Msg: "Cannot save user invite", Status: 500}
-	}
-
-	err := s.Mailer.SendInviteCode(email, code)
+func (s *AuthService) validateAdminToken(ctx context.Context, token string) (bool, error) {
+	u, err := s.validateToken(ctx, token)
 	if err != nil {
-		logger.Logf("ERROR Email was not sent: " + err.Error())
-		return st.AuthError{Msg: err.Error(), Status: 500}
+		return false, err
 	}
-
-	return err
-}
-
-func (s *AuthService) validateAdminToken(token string) bool {
-	u, valid := s.validateToken(token)
-	return valid && contains(s.Config.AdminIDs, u.ID)
+	return u != nil && contains(s.Config.AdminIDs, u.ID), nil
 }
 
 // CreateUser creates new User
-func (s *AuthService) CreateUser(u *st.User) error {
+func (s *AuthService) CreateUser(ctx context.Context, u *st.User) error {
 	logger.Logf("DEBUG creating user")
 
 	uname := u.Username
 
-	alreadyExists, err := s.usernameExists(uname)
+	alreadyExists, err := s.usernameExists(ctx, uname)
 	if err != nil {
-		return st.AuthError{Msg: err.Error(), Status: 500}
+		return mapDaoError(err)
 	}
-	if alreadyExists {
+	// In anti-enumeration mode taken username is rejected only after the same work as for a new one
+	if alreadyExists && !s.Config.AntiEnumeration {
 		logger.Logf("WARN Username %s already exists", uname)
-		return st.AuthError{Msg: "Username already exists", Status: 400}
+		return st.AuthError{Msg: "Username already exists", Status: 409}
 	}
 
-	if s.Config.Private {
-		dbUser, err := s.UserDao.GetByEmail(u.Email)
+	// Roles and organization are assigned only by admin
+	u.Roles = nil
+	u.Organization = ""
+	u.AccountStatus = st.AccountStatus{}
+
+	// In private mode user registers either with invite code sent to the email or with invite link token
+	var invite *st.Invite
+	var link *st.InviteLink
+	switch {
+	case s.Config.Private && u.InviteToken != "":
+		link, err = s.findInviteLink(ctx, u.InviteToken, u.Email)
+		if err != nil {
+			return err
+		}
+		applyInviteLink(u, link)
+	case s.Config.Private:
+		invite, err = s.findInvite(ctx, u.Email, u.InviteCode)
 		if err != nil {
-			logger.Logf("ERROR Failed to fetch user, %s", err.Error())
-			return st.AuthError{Msg: err.Error(), Status: 500}
+			return err
 		}
-		if dbUser == nil || u.InviteCode == "" || dbUser.InviteCode != u.InviteCode {
-			return st.AuthError{Msg: "Wrong email or invite code", Status: 401}
+		applyInvite(u, invite)
+	}
+
+	// Invite for the email was sent by admin, so policy applies only to other registrations
+	if invite == nil {
+		err = s.checkRegistrationPolicy(u.Email)
+		if err != nil {
+			return err
 		}
 	}
+	if s.Config.RequireApproval && invite == nil && link == nil {
+		u.AccountStatus = st.AccountStatus{Status: st.StatusPending}
+	}
+
+	err = s.checkNewUserAttributes(ctx, u, invite)
+	if err != nil {
+		return err
+	}
+	err = s.validatePassword(u, u.Password)
+	if err != nil {
+		return err
+	}
 
 	hashedPassword, err := crypto.Hash(u.Password)
 	if err != nil {
@@ -82,138 +106,183 @@ func (s *AuthService) CreateUser(u *st.User) error {
 		return st.AuthError{Msg: err.Error(), Status: 500}
 	}
 
-	var verificationCode = generateCode(4)
-
+	u.VerificationCode = ""
+	var verificationCode string
 	if s.Config.EmailVerification {
-		u.VerificationCode = verificationCode
+		verificationCode, err = s.newCode(codeVerification)
+		if err != nil {
+			return err
+		}
+		s.setVerificationCode(u, verificationCode)
+	}
+
+	if alreadyExists {
+		logger.Logf("WARN Username %s already exists", uname)
+		return s.concealTakenUsername(u)
+	}
+
+	if invite != nil {
+		err = s.claimInvite(ctx, invite)
+		if err != nil {
+			return err
+		}
+	}
+	if link != nil {
+		err = s.useInviteLink(ctx, link)
+		if err != nil {
+			return err
+		}
 	}
 
 	u.Password = hashedPassword
 	u.InviteCode = ""
-	ID := s.UserDao.Save(u)
-	if ID < 0 {
-		return st.AuthError{Msg: "Cannot save user", Status: 500}
+	u.InviteToken = ""
+	ID, err := s.UserDao.Save(ctx, u)
+	if err != nil {
+		if invite != nil {
+			s.releaseInvite(ctx, invite)
+		}
+		if link != nil {
+			s.releaseInviteLink(ctx, link)
+		}
+		if s.Config.AntiEnumeration && errors.Is(err, dao.ErrDuplicateUsername) {
+			return s.concealTakenUsername(u)
+		}
+		if s.Config.AntiEnumeration && errors.Is(err, dao.ErrDuplicateEmail) {
+			return s.concealTakenEmail(u)
+		}
+		return mapDaoError(err)
 	}
 	u.ID = ID
+	if invite != nil {
+		s.recordInviteAcceptance(ctx, invite, ID)
+	}
 
 	if s.Config.EmailVerification {
-		err := s.Mailer.SendVerificationCode(u.Email, verificationCode)
-		if err != nil {
-			return st.AuthError{Msg: err.Error(), Status: 500}
-		}
+		return s.sendVerificationCode(u, verificationCode)
 	}
 
 	return nil
 }
 
 // UpdateUser updates existing user
-func (s *AuthService) UpdateUser(u *st.User, token string) error {
+func (s *AuthService) UpdateUser(ctx context.Context, u *st.User, token string) error {
 	logger.Logf("DEBUG Updating user with id %d", u.ID)
 
-	tokenUser, valid := s.validateToken(token)
-	if !valid || tokenUser.ID != u.ID {
+	tokenUser, err := s.validateToken(ctx, token)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	if tokenUser == nil || tokenUser.ID != u.ID {
 		return st.AuthError{Msg: "Invalid token", Status: 401}
 	}
 
 	if !validateUpdatePayload(u) {
 		return st.AuthError{Msg: "Invalid Update payload", Status: 400}
 	}
-
-	userExists, err := s.userExists(u.ID)
-	if err != nil {
-		return st.AuthError{Msg: err.Error(), Status: 500}
+	if u.Email != "" {
+		return st.AuthError{Msg: "Email can be changed only with confirmation", Status: 400}
 	}
-	if !userExists {
-		return st.AuthError{Msg: "User does not exist", Status: 404}
+	err = s.checkAttributes(ctx, u, false, false)
+	if err != nil {
+		return err
 	}
 
-	err = s.UserDao.Update(u)
+	err = s.UserDao.Update(ctx, u)
 	if err != nil {
-		return st.AuthError{Msg: err.Error(), Status: 500}
+		return mapDaoError(err)
 	}
 
 	return nil
 }
 
-// VerifyUser verifies user email by code
-func (s *AuthService) VerifyUser(username string, code string) error {
-	logger.Logf("DEBUG Verifying user id with username %s", username)
-
-	user, err := s.UserDao.GetByUsername(username)
+// DeleteUser delets user
+func (s *AuthService) DeleteUser(ctx context.Context, id int, token string) error {
+	tokenUser, err := s.validateToken(ctx, token)
 	if err != nil {
-		return st.AuthError{Msg: err.Error(), Status: 500}
-	}
-	if user == nil {
-		return st.AuthError{Msg: "User does not exist", Status: 404}
+		return mapDaoError(err)
 	}
-
-	if code == "" || user.VerificationCode != code {
-		return st.AuthError{Msg: "Verification code does not match", Status: 400}
+	if tokenUser == nil || tokenUser.ID != id && !contains(s.Config.AdminIDs, tokenUser.ID) {
+		return st.AuthError{Msg: "Invalid token", Status: 401}
 	}
 
-	user.VerificationCode = ""
-	err = s.UserDao.ClearVerificationCode(user.ID)
+	err = s.UserDao.DeleteById(ctx, id)
 	if err != nil {
-		return st.AuthError{Msg: err.Error(), Status: 500}
+		return mapDaoError(err)
 	}
 
 	return nil
 }
 
-// DeleteUser delets user
-func (s *AuthService) DeleteUser(id int, token string) error {
-	tokenUser, valid := s.validateToken(token)
-	if !valid || tokenUser.ID != id && contains(s.Config.AdminIDs, tokenUser.ID) {
-		return st.AuthError{Msg: "Invalid token", Status: 401}
+func (s *AuthService) usernameExists(ctx context.Context, username string) (bool, error) {
+	_, err := s.UserDao.GetByUsername(ctx, username)
+	if errors.Is(err, dao.ErrNotFound) {
+		return false, nil
 	}
+	return err == nil, err
+}
 
-	err := s.UserDao.DeleteById(id)
-	if err != nil {
-		return st.AuthError{Msg: err.Error(), Status: 500}
+// accountStatusError returns error if user is not allowed to use their account at the moment.
+// Suspension ends by itself once its expiry passes.
+func accountStatusError(u *st.User) error {
+	if u.IsDisabled() {
+		return st.AuthError{Msg: "User is disabled", Status: 403, Code: st.CodeAccountDisabled}
+	}
+	if u.IsPending() {
+		return st.AuthError{Msg: "User is awaiting approval", Status: 403, Code: st.CodeAccountPending}
+	}
+	if u.IsSuspended(time.Now()) {
+		msg := "User is suspended"
+		if u.Until != nil {
+			msg += " until " + u.Until.UTC().Format(time.RFC3339)
+		}
+		if u.Reason != "" {
+			msg += ": " + u.Reason
+		}
+		return st.AuthError{Msg: msg, Status: 403, Code: st.CodeAccountSuspended}
 	}
-
 	return nil
 }
 
-func (s *AuthService) usernameExists(username string) (bool, error) {
-	u, err := s.UserDao.GetByUsername(username)
-	return u != nil, err
-}
-
 func validateUpdatePayload(u *st.User) bool {
 	return u.ID > 0 && u.Username == "" && u.Password == ""
 }
 
-func (s *AuthService) userExists(id int) (bool, error) {
-	u, err := s.UserDao.Get(id)
-	if err != nil {
-		return false, err
-	}
-	return u != nil, nil
-}
-
 // BasicAuthToken issues new token by username and password
-func (s *AuthService) BasicAuthToken(username, password string) (string, string, error) {
-	user, err := s.UserDao.GetByUsername(username)
+func (s *AuthService) BasicAuthToken(ctx context.Context, username, password string) (string, string, error) {
+	user, err := s.UserDao.GetByUsername(ctx, username)
 
-	if err != nil {
-		return "", "", st.AuthError{Msg: "Cannot extract user", Status: 500}
+	if err != nil && !errors.Is(err, dao.ErrNotFound) {
+		return "", "", mapDaoError(err)
 	}
 
-	if user == nil || !crypto.Match(password, user.Password) {
+	if user == nil {
+		if s.Config.AntiEnumeration {
+			crypto.DummyMatch(password)
+		}
+		return "", "", st.AuthError{Msg: "Username or password is wrong", Status: 403}
+	}
+	if !crypto.Match(password, user.Password) {
 		return "", "", st.AuthError{Msg: "Username or password is wrong", Status: 403}
 	}
 
+	err = accountStatusError(user)
+	if err != nil {
+		return "", "", err
+	}
+
 	if len(user.VerificationCode) > 0 {
 		return "", "", st.AuthError{Msg: "User is not verified", Status: 409}
 	}
 
-	tokenString, err := s.issueAccessToken(user)
+	s.rehashPassword(ctx, user, password)
+
+	tokenString, err := s.issueAccessToken(ctx, user)
 	if err != nil {
 		return "", "", err
 	}
 
-	refreshTokenString, err := s.issueRefreshToken(user)
+	refreshTokenString, err := s.issueRefreshToken(ctx, user)
 	if err != nil {
 		return "", "", err
 	}
@@ -221,10 +290,32 @@ func (s *AuthService) BasicAuthToken(username, password string) (string, string,
 	return tokenString, refreshTokenString, nil
 }
 
-func (s *AuthService) issueAccessToken(user *st.User) (string, error) {
+// rehashPassword replaces hash of the password if it is made by other than preferred algorithm or is weaker than new hashes.
+// Login does not depend on it, so failure is only logged.
+func (s *AuthService) rehashPassword(ctx context.Context, user *st.User, password string) {
+	if !crypto.NeedsRehash(password, user.Password) {
+		return
+	}
+	hash, err := crypto.Hash(password)
+	if err != nil {
+		logger.Logf("ERROR Failed to rehash password of user %d: %s", user.ID, err.Error())
+		return
+	}
+	// Password changed meanwhile has a new hash already
+	err = s.UserDao.RehashPassword(ctx, user.ID, user.Password, hash)
+	if err != nil && !errors.Is(err, dao.ErrNotFound) {
+		logger.Logf("ERROR Failed to store rehashed password of user %d: %s", user.ID, err.Error())
+	}
+}
+
+func (s *AuthService) issueAccessToken(ctx context.Context, user *st.User) (string, error) {
 	if user == nil {
 		return "", st.AuthError{Msg: "User is missing", Status: 403}
 	}
+	err := s.ensureUUID(ctx, user)
+	if err != nil {
+		return "", err
+	}
 
 	keyData, err := ioutil.ReadFile(s.Config.PrivKeyPath)
 	if err != nil {
@@ -235,12 +326,17 @@ func (s *AuthService) issueAccessToken(user *st.User) (string, error) {
 		return "", st.AuthError{Msg: err.Error(), Status: 500}
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"sub":    user.Username,
+	claims := jwt.MapClaims{
 		"userId": user.ID,
+		"iat":    time.Now().UTC().Unix(),
 		"exp":    time.Now().Add(time.Hour).UTC().Unix(),
 		"admin":  contains(s.Config.AdminIDs, user.ID),
-	})
+	}
+	if len(user.Roles) > 0 {
+		claims["roles"] = user.Roles
+	}
+	setSubject(claims, user)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 
 	tokenString, err := token.SignedString(key)
 	if err != nil {
@@ -250,7 +346,12 @@ func (s *AuthService) issueAccessToken(user *st.User) (string, error) {
 	return tokenString, nil
 }
 
-func (s *AuthService) issueRefreshToken(user *st.User) (string, error) {
+func (s *AuthService) issueRefreshToken(ctx context.Context, user *st.User) (string, error) {
+	err := s.ensureUUID(ctx, user)
+	if err != nil {
+		return "", err
+	}
+
 	keyData, err := ioutil.ReadFile(s.Config.PrivKeyPath)
 	if err != nil {
 		return "", st.AuthError{Msg: err.Error(), Status: 500}
@@ -260,10 +361,13 @@ func (s *AuthService) issueRefreshToken(user *st.User) (string, error) {
 		return "", st.AuthError{Msg: err.Error(), Status: 500}
 	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"sub": user.Username,
-		"exp": time.Now().AddDate(1, 0, 0).UTC().Unix(),
-	})
+	claims := jwt.MapClaims{
+		"userId": user.ID,
+		"iat":    time.Now().UTC().Unix(),
+		"exp":    time.Now().AddDate(1, 0, 0).UTC().Unix(),
+	}
+	setSubject(claims, user)
+	refreshToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 
 	refreshTokenString, err := refreshToken.SignedString(key)
 	if err != nil {
@@ -273,25 +377,51 @@ func (s *AuthService) issueRefreshToken(user *st.User) (string, error) {
 	return refreshTokenString, nil
 }
 
+// setSubject makes UUID of the user the token subject
+func setSubject(claims jwt.MapClaims, user *st.User) {
+	claims["sub"] = user.UUID
+	claims["v"] = tokenVersion
+}
+
+// ensureUUID assigns UUID to the user created before UUIDs were introduced, if UUID migration is not applied yet,
+// so tokens with username subject are not issued anymore
+func (s *AuthService) ensureUUID(ctx context.Context, user *st.User) error {
+	if user.UUID != "" {
+		return nil
+	}
+	uuid, err := s.UserDao.AssignUUID(ctx, user.ID)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	user.UUID = uuid
+	return nil
+}
+
 // RefreshToken refreshes existing token
-func (s *AuthService) RefreshToken(t string) (string, error) {
-	u, ok := s.validateToken(t)
-	if ok {
-		accessToken, err := s.issueAccessToken(u)
+func (s *AuthService) RefreshToken(ctx context.Context, t string) (string, error) {
+	u, err := s.validateToken(ctx, t)
+	if err != nil {
+		return "", mapDaoError(err)
+	}
+	if u != nil {
+		accessToken, err := s.issueAccessToken(ctx, u)
 		return accessToken, err
 	}
 	return "", st.AuthError{Msg: "Refresh token is not valid", Status: 403}
 }
 
-func (s *AuthService) validateToken(t string) (*st.User, bool) {
+// validateToken returns token owner.
+// Returns nil user when token is invalid or revoked or its owner does not exist,
+// returns AuthError if the owner is suspended or disabled and dao error if data access failed.
+func (s *AuthService) validateToken(ctx context.Context, t string) (*st.User, error) {
 	keyData, err := ioutil.ReadFile(s.Config.PubKeyPath)
 	if err != nil {
-		return nil, false
+		return nil, nil
 	}
 	key, err := jwt.ParseRSAPublicKeyFromPEM(keyData)
 	if err != nil {
 		logger.Logf("WARN %s", err.Error())
-		return nil, false
+		return nil, nil
 	}
 
 	token, err := jwt.Parse(t, func(token *jwt.Token) (interface{}, error) {
@@ -302,21 +432,139 @@ func (s *AuthService) validateToken(t string) (*st.User, bool) {
 	})
 	if err != nil {
 		logger.Logf("WARN %s", err.Error())
-		return nil, false
+		return nil, nil
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		u, err := s.UserDao.GetByUsername(fmt.Sprintf("%s", claims["sub"]))
+		u, err := s.tokenOwner(ctx, claims)
+		if err != nil || u == nil {
+			return nil, err
+		}
+		err = accountStatusError(u)
+		if err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+	return nil, nil
+}
+
+// tokenOwner finds user the token was issued to. Returns nil user if there is no such user or the token is revoked.
+func (s *AuthService) tokenOwner(ctx context.Context, claims jwt.MapClaims) (*st.User, error) {
+	var u *st.User
+	var err error
+	if version, _ := claims["v"].(float64); int(version) >= tokenVersion {
+		uuid, _ := claims["sub"].(string)
+		u, err = s.UserDao.GetByUUID(ctx, uuid)
+		if errors.Is(err, dao.ErrNotFound) {
+			return nil, nil
+		}
+	} else {
+		accepted, err := s.acceptsLegacyTokens(ctx, time.Now())
+		if err != nil || !accepted {
+			return nil, err
+		}
+		u, err = s.legacyTokenOwner(ctx, claims)
+	}
+	if err != nil || u == nil {
+		return nil, err
+	}
+
+	if revoked(claims, u) {
+		return nil, nil
+	}
+	return u, nil
+}
+
+// acceptsLegacyTokens reports whether tokens with username subject are still accepted.
+// Unless the end is configured, they are accepted for a refresh token lifetime after UUID migration is applied,
+// since then every user has UUID and no tokens with username subject are issued.
+func (s *AuthService) acceptsLegacyTokens(ctx context.Context, now time.Time) (bool, error) {
+	if s.Config.LegacyTokensUntil != "" {
+		until, err := time.Parse(legacyTokensLayout, s.Config.LegacyTokensUntil)
 		if err != nil {
-			return nil, false
+			return false, nil
+		}
+		return now.Before(until), nil
+	}
+
+	appliedAt, err := s.UserDao.GetMigrationAppliedAt(ctx, dao.UUIDMigration)
+	if errors.Is(err, dao.ErrNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return now.Before(appliedAt.AddDate(1, 0, 0)), nil
+}
+
+// legacyTokenOwner finds owner of the token issued with username as subject.
+// Username in the token might have been changed since, then the user is found by id from the token
+// or, for tokens without id, by the reservation of the previous username.
+func (s *AuthService) legacyTokenOwner(ctx context.Context, claims jwt.MapClaims) (*st.User, error) {
+	username := fmt.Sprintf("%s", claims["sub"])
+	rawID, hasID := claims["userId"].(float64)
+	id := int(rawID)
+
+	u, err := s.UserDao.GetByUsername(ctx, username)
+	if errors.Is(err, dao.ErrNotFound) {
+		if !hasID {
+			id, err = s.UserDao.GetUsernameHolder(ctx, username)
+			if errors.Is(err, dao.ErrNotFound) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		u, err = s.UserDao.Get(ctx, id)
+	}
+	if errors.Is(err, dao.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Username now belongs to another user
+	if hasID && u.ID != id {
+		return nil, nil
+	}
+	// Token without id might be issued to previous holder of the username, so the user has to exist by then.
+	// Users created by previous versions have no creation time and predate the token.
+	if !hasID && !u.CreatedAt.IsZero() {
+		issuedAt, ok := legacyIssueTime(claims)
+		if !ok || u.CreatedAt.After(issuedAt) {
+			return nil, nil
 		}
-		return u, true
 	}
-	return nil, false
+	return u, nil
+}
+
+// legacyIssueTime returns issue time of legacy token. Legacy refresh tokens carry only expiry,
+// they were issued for a year.
+func legacyIssueTime(claims jwt.MapClaims) (time.Time, bool) {
+	if iat, ok := claims["iat"].(float64); ok {
+		return time.Unix(int64(iat), 0), true
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		return time.Unix(int64(exp), 0).AddDate(-1, 0, 0), true
+	}
+	return time.Time{}, false
+}
+
+// revoked reports whether token was issued before tokens of its owner were revoked.
+// Tokens without issue time predate revocation support and are treated as issued at Unix epoch.
+func revoked(claims jwt.MapClaims, u *st.User) bool {
+	if u.TokensRevokedAt == nil {
+		return false
+	}
+	issuedAt, _ := claims["iat"].(float64)
+	return int64(issuedAt) < u.TokensRevokedAt.Unix()
 }
 
 // GetUserByToken returns user by token
-func (s *AuthService) GetUserByToken(t string) (*st.User, error) {
+func (s *AuthService) GetUserByToken(ctx context.Context, t string) (*st.User, error) {
 	keyData, err := ioutil.ReadFile(s.Config.PubKeyPath)
 	if err != nil {
 		return nil, st.AuthError{Msg: err.Error(), Status: 500}
@@ -337,9 +585,16 @@ func (s *AuthService) GetUserByToken(t string) (*st.User, error) {
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		u, err := s.UserDao.GetByUsername(fmt.Sprintf("%s", claims["sub"]))
+		u, err := s.tokenOwner(ctx, claims)
+		if err != nil {
+			return nil, mapDaoError(err)
+		}
+		if u == nil {
+			return nil, nil
+		}
+		err = accountStatusError(u)
 		if err != nil {
-			return nil, st.AuthError{Msg: err.Error(), Status: 500}
+			return nil, err
 		}
 		return u, nil
 	}
@@ -347,135 +602,224 @@ func (s *AuthService) GetUserByToken(t string) (*st.User, error) {
 }
 
 // GetUserById returns user info for specific id
-func (s *AuthService) GetUserById(id int, token string) (*st.UserInfo, error) {
-	_, ok := s.validateToken(token)
-	if !ok {
+func (s *AuthService) GetUserById(ctx context.Context, id int, token string) (*st.UserInfo, error) {
+	tokenUser, err := s.validateToken(ctx, token)
+	if err != nil {
+		return nil, mapDaoError(err)
+	}
+	if tokenUser == nil {
 		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
 	}
-	u, err := s.UserDao.Get(id)
+	u, err := s.UserDao.Get(ctx, id)
 	if err != nil {
-		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+		return nil, mapDaoError(err)
 	}
-	if u == nil {
-		return nil, nil
-	}
-	return &st.UserInfo{ID: u.ID, Username: u.Username, FirstName: u.FirstName, LastName: u.LastName, Email: u.Email}, nil
+	return s.userInfo(ctx, u, tokenUser)
 }
 
 // GetUserByUsername returns user info for username
-func (s *AuthService) GetUserByUsername(username string, token string) (*st.UserInfo, error) {
-	_, ok := s.validateToken(token)
-	if !ok {
+func (s *AuthService) GetUserByUsername(ctx context.Context, username string, token string) (*st.UserInfo, error) {
+	tokenUser, err := s.validateToken(ctx, token)
+	if err != nil {
+		return nil, mapDaoError(err)
+	}
+	if tokenUser == nil {
 		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
 	}
-	u, err := s.UserDao.GetByUsername(username)
+	u, err := s.UserDao.GetByUsername(ctx, username)
 	if err != nil {
-		return nil, st.AuthError{Msg: err.Error(), Status: 500}
-	}
-	if u == nil {
-		return nil, nil
+		return nil, mapDaoError(err)
 	}
-	return mapToUserInfo(u), nil
+	return s.userInfo(ctx, u, tokenUser)
 }
 
 // GetUsers returns all users info
-func (s *AuthService) GetUsers(token string) (*[]st.UserInfo, error) {
-	_, ok := s.validateToken(token)
-	if !ok {
+func (s *AuthService) GetUsers(ctx context.Context, token string) (*[]st.UserInfo, error) {
+	tokenUser, err := s.validateToken(ctx, token)
+	if err != nil {
+		return nil, mapDaoError(err)
+	}
+	if tokenUser == nil {
 		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
 	}
-	us, err := s.UserDao.GetAll()
+	us, err := s.UserDao.GetAll(ctx)
 	if err != nil {
-		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+		return nil, mapDaoError(err)
+	}
+	infos, err := s.userInfos(ctx, *us, tokenUser.ID, contains(s.Config.AdminIDs, tokenUser.ID))
+	if err != nil {
+		return nil, err
 	}
-	return mapToUserInfoList(us), nil
+	return &infos, nil
 }
 
-// SendRecoveryEmail sends password recovery email for user or error is user does not exist or email sending fails
-func (s *AuthService) SendRecoveryEmail(username string) error {
-	u, err := s.UserDao.GetByUsername(username)
+// ListUsers returns a page of users info matching the query.
+// Role "admin" limits the page to admins, role "user" excludes them, other roles match users they are assigned to.
+func (s *AuthService) ListUsers(ctx context.Context, token string, query dao.UserQuery, role string) (*st.UserInfoPage, error) {
+	tokenUser, err := s.validateToken(ctx, token)
 	if err != nil {
-		return st.AuthError{Msg: err.Error(), Status: 500}
+		return nil, mapDaoError(err)
 	}
-	if u == nil || u.Email == "" {
-		return st.AuthError{Msg: "Username does not registered or email is absent", Status: 404}
+	if tokenUser == nil {
+		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
 	}
 
-	code := generateCode(6)
-	err = s.Mailer.SendRecoveryCode(u.Email, code)
-	if err != nil {
-		logger.Logf("ERROR Email was not sent: " + err.Error())
-		return st.AuthError{Msg: err.Error(), Status: 500}
+	if query.Limit <= 0 {
+		query.Limit = defaultPageSize
+	}
+	if query.Limit > maxPageSize {
+		query.Limit = maxPageSize
+	}
+
+	// Admins are configured by ids, other roles are assigned to users
+	switch {
+	case role == "":
+	case role == "admin":
+		query.IDs = append([]int{}, s.Config.AdminIDs...)
+	case role == "user":
+		query.ExcludeIDs = s.Config.AdminIDs
+	case rolePattern.MatchString(role):
+		query.Roles = []string{role}
+	default:
+		return nil, st.AuthError{Msg: "Invalid role", Status: 400}
 	}
 
-	hashedCode, err := crypto.Hash(code)
+	page, err := s.UserDao.Find(ctx, query)
+	if errors.Is(err, dao.ErrInvalidQuery) {
+		return nil, st.AuthError{Msg: "Invalid query or cursor", Status: 400}
+	}
 	if err != nil {
-		logger.Logf("ERROR Failed to hash code, %s", err.Error())
-		return st.AuthError{Msg: err.Error(), Status: 500}
+		return nil, mapDaoError(err)
 	}
 
-	return s.UserDao.SetRecoveryCode(u.ID, hashedCode)
+	infos, err := s.userInfos(ctx, page.Users, tokenUser.ID, contains(s.Config.AdminIDs, tokenUser.ID))
+	if err != nil {
+		return nil, err
+	}
+	return &st.UserInfoPage{Users: infos, NextCursor: page.NextCursor}, nil
 }
 
-// ExchangeRecoveryCode exchanges recovery code for a password resetting one
-func (s *AuthService) ExchangeRecoveryCode(username string, code string) (string, error) {
-	generalErrorMsg := "Username does not registered or recovery process has not been initiated"
-
-	u, err := s.UserDao.GetByUsername(username)
+// SearchUsers returns a page of users info matching the text, most relevant first. Available only for admin.
+func (s *AuthService) SearchUsers(ctx context.Context, token string, query dao.SearchQuery) (*st.UserInfoPage, error) {
+	isAdmin, err := s.validateAdminToken(ctx, token)
 	if err != nil {
-		return "", st.AuthError{Msg: err.Error(), Status: 500}
+		return nil, mapDaoError(err)
 	}
-	if u == nil {
-		return "", st.AuthError{Msg: generalErrorMsg, Status: 404}
+	if !isAdmin {
+		return nil, st.AuthError{Msg: "Available only for admin", Status: 403}
 	}
 
-	existingCodeHash, err := s.UserDao.GetRecoveryCode(u.ID)
+	if query.Text == "" {
+		return nil, st.AuthError{Msg: "Search text is missing", Status: 400}
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultPageSize
+	}
+	if query.Limit > maxPageSize {
+		query.Limit = maxPageSize
+	}
+
+	page, err := s.UserDao.Search(ctx, query)
+	if errors.Is(err, dao.ErrInvalidQuery) {
+		return nil, st.AuthError{Msg: "Invalid query or cursor", Status: 400}
+	}
 	if err != nil {
-		return "", st.AuthError{Msg: err.Error(), Status: 500}
+		return nil, mapDaoError(err)
 	}
 
-	if existingCodeHash == "" {
-		return "", st.AuthError{Msg: generalErrorMsg, Status: 404}
+	infos, err := s.userInfos(ctx, page.Users, 0, true)
+	if err != nil {
+		return nil, err
 	}
+	return &st.UserInfoPage{Users: infos, NextCursor: page.NextCursor}, nil
+}
 
-	if !crypto.Match(code, existingCodeHash) {
-		return "", st.AuthError{Msg: "Provided recovery code does not match", Status: 403}
+// SendRecoveryEmail sends password recovery email for user or error is user does not exist or email sending fails.
+// Codes are issued to the same user at most once per RecoveryResendInterval, so every code does not bring
+// another round of attempts right away. In anti-enumeration mode missing user and throttling are not reported.
+func (s *AuthService) SendRecoveryEmail(ctx context.Context, username string) error {
+	u, err := s.UserDao.GetByUsername(ctx, username)
+	if err != nil && !errors.Is(err, dao.ErrNotFound) {
+		return mapDaoError(err)
+	}
+	if u == nil || u.Email == "" {
+		if s.Config.AntiEnumeration {
+			return nil
+		}
+		return st.AuthError{Msg: "Username does not registered or email is absent", Status: 404}
 	}
 
-	resetingCode := generateCode(10)
-	resetingCodeHash, err := crypto.Hash(resetingCode)
+	code, err := s.newCode(codeRecovery)
 	if err != nil {
-		logger.Logf("ERROR Failed to hash code, %s", err.Error())
-		return "", st.AuthError{Msg: err.Error(), Status: 500}
+		return err
+	}
+	issuedBefore := time.Now().Add(-s.Config.RecoveryResendInterval)
+	err = s.UserDao.SetRecoveryCode(ctx, u.ID, crypto.HashCode(code), issuedBefore)
+	if errors.Is(err, dao.ErrNotFound) {
+		if s.Config.AntiEnumeration {
+			return nil
+		}
+		return st.AuthError{Msg: "Recovery code was sent recently, try again later", Status: 429}
 	}
-
-	err = s.UserDao.SetResettingCode(u.ID, resetingCodeHash)
 	if err != nil {
-		return "", st.AuthError{Msg: err.Error(), Status: 500}
+		return mapDaoError(err)
 	}
 
-	return resetingCode, nil
+	return s.deliver(func() error { return s.Mailer.SendRecoveryCode(u.Email, code) })
 }
 
-// ResetPassword resets password given username and code
-func (s *AuthService) ResetPassword(username string, code string, newPassword string) error {
-	generalErrorMsg := "Username does not registered or recovery process has not been initiated"
+// ExchangeRecoveryCode exchanges recovery code for a password resetting one
+func (s *AuthService) ExchangeRecoveryCode(ctx context.Context, username string, code string) (string, error) {
+	u, err := s.UserDao.GetByUsername(ctx, username)
+	if errors.Is(err, dao.ErrNotFound) {
+		return "", s.rejectCode(code, false, st.AuthError{Msg: recoveryNotInitiatedMsg, Status: 404}, invalidRecoveryCodeError)
+	}
+	if err != nil {
+		return "", mapDaoError(err)
+	}
 
-	u, err := s.UserDao.GetByUsername(username)
+	existingCode, err := s.UserDao.GetRecoveryCode(ctx, u.ID)
 	if err != nil {
-		return st.AuthError{Msg: err.Error(), Status: 500}
+		return "", mapDaoError(err)
 	}
-	if u == nil {
-		return st.AuthError{Msg: generalErrorMsg, Status: 404}
+	err = s.checkIssuedCode(ctx, u.ID, dao.RecoveryCode, existingCode, code, s.Config.RecoveryCodeTTL)
+	if err != nil {
+		return "", err
 	}
 
-	existingCodeHash, err := s.UserDao.GetResettingCode(u.ID)
+	resetingCode, err := s.newCode(codeResetting)
 	if err != nil {
-		return st.AuthError{Msg: err.Error(), Status: 500}
+		return "", err
+	}
+	err = s.UserDao.SetResettingCode(ctx, u.ID, crypto.HashCode(resetingCode))
+	if err != nil {
+		return "", mapDaoError(err)
+	}
+
+	return resetingCode, nil
+}
+
+// ResetPassword resets password given username and code
+func (s *AuthService) ResetPassword(ctx context.Context, username string, code string, newPassword string) error {
+	u, err := s.UserDao.GetByUsername(ctx, username)
+	if errors.Is(err, dao.ErrNotFound) {
+		return s.rejectCode(code, false, st.AuthError{Msg: recoveryNotInitiatedMsg, Status: 404}, invalidRecoveryCodeError)
+	}
+	if err != nil {
+		return mapDaoError(err)
 	}
 
-	if !crypto.Match(code, existingCodeHash) {
-		return st.AuthError{Msg: "Provided recovery code does not match", Status: 403}
+	existingCode, err := s.UserDao.GetResettingCode(ctx, u.ID)
+	if err != nil {
+		return mapDaoError(err)
+	}
+	err = s.checkIssuedCode(ctx, u.ID, dao.ResettingCode, existingCode, code, s.Config.ResettingCodeTTL)
+	if err != nil {
+		return err
+	}
+	err = s.validatePassword(u, newPassword)
+	if err != nil {
+		return err
 	}
 
 	hashedPassword, err := crypto.Hash(newPassword)
@@ -484,36 +828,62 @@ func (s *AuthService) ResetPassword(username string, code string, newPassword st
 		return st.AuthError{Msg: err.Error(), Status: 500}
 	}
 
-	err = s.UserDao.ResetPassword(u.ID, hashedPassword)
+	err = s.UserDao.ResetPassword(ctx, u.ID, hashedPassword)
 	if err != nil {
-		return st.AuthError{Msg: err.Error(), Status: 500}
+		return mapDaoError(err)
 	}
 
 	return nil
 }
 
-func generateCode(size int) string {
-	rand.Seed(time.Now().UnixNano())
-	result := ""
-
-	for i := 0; i < size; i++ {
-		d := rand.Intn(10)
-		result += strconv.Itoa(d)
+// checkIssuedCode matches the code against stored recovery or resetting code.
+// Missing code is rejected explicitly, every attempt is counted before matching, so parallel guesses share the limit.
+func (s *AuthService) checkIssuedCode(ctx context.Context, id int, kind string, stored *st.IssuedCode, code string, ttl time.Duration) error {
+	if stored.Hash == "" {
+		return s.rejectCode(code, false, st.AuthError{Msg: recoveryNotInitiatedMsg, Status: 404}, invalidRecoveryCodeError)
 	}
-
-	return result
-}
-
-func mapToUserInfoList(us *[]st.User) *[]st.UserInfo {
-	result := []st.UserInfo{}
-	for _, u := range *us {
-		result = append(result, *mapToUserInfo(&u))
+	if stored.Expired(time.Now(), ttl) {
+		return s.rejectCode(code, false, st.AuthError{Msg: "Provided recovery code has expired", Status: 403}, invalidRecoveryCodeError)
+	}
+	if s.Config.RecoveryMaxAttempts > 0 {
+		err := s.UserDao.TakeCodeAttempt(ctx, id, kind, s.Config.RecoveryMaxAttempts)
+		if errors.Is(err, dao.ErrNotFound) {
+			return s.rejectCode(code, false, st.AuthError{Msg: "Too many wrong recovery codes, request a new one", Status: 403}, invalidRecoveryCodeError)
+		}
+		if err != nil {
+			return mapDaoError(err)
+		}
 	}
-	return &result
+	if code == "" || !crypto.MatchCode(code, stored.Hash) {
+		return s.rejectCode(code, true, st.AuthError{Msg: "Provided recovery code does not match", Status: 403}, invalidRecoveryCodeError)
+	}
+	return nil
 }
 
 func mapToUserInfo(u *st.User) *st.UserInfo {
-	return &st.UserInfo{ID: u.ID, Username: u.Username, FirstName: u.FirstName, LastName: u.LastName, Email: u.Email}
+	return &st.UserInfo{ID: u.ID, Username: u.Username, FirstName: u.FirstName, LastName: u.LastName, Email: u.Email, Roles: u.Roles, Organization: u.Organization}
+}
+
+// mapDaoError converts data access error into AuthError with matching status.
+// AuthError is returned as is.
+func mapDaoError(err error) st.AuthError {
+	if authErr, ok := err.(st.AuthError); ok {
+		return authErr
+	}
+	switch {
+	case errors.Is(err, dao.ErrNotFound):
+		return st.AuthError{Msg: "User does not exist", Status: 404}
+	case errors.Is(err, dao.ErrDuplicateUsername):
+		return st.AuthError{Msg: "Username already exists", Status: 409}
+	case errors.Is(err, dao.ErrDuplicateEmail):
+		return st.AuthError{Msg: "Email already exists", Status: 409}
+	case errors.Is(err, dao.ErrTimeout):
+		return st.AuthError{Msg: "Database did not respond in time", Status: 504}
+	case errors.Is(err, dao.ErrUnavailable):
+		return st.AuthError{Msg: "Database is unavailable", Status: 503}
+	}
+	logger.Logf("ERROR %s", err.Error())
+	return st.AuthError{Msg: "Internal error", Status: 500}
 }
 
 func contains(slice []int, element int) bool {
@@ -1,20 +1,26 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/bcrypt"
 
+	"ruslanlesko/brightonum/src/crypto"
 	"ruslanlesko/brightonum/src/dao"
 	"ruslanlesko/brightonum/src/email"
 	st "ruslanlesko/brightonum/src/structs"
 )
 
 var mailer = email.MailerMock{}
+var ctx = context.Background()
 
 func TestAuthService_InviteUser(t *testing.T) {
 	var token = issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
@@ -22,19 +28,23 @@ func TestAuthService_InviteUser(t *testing.T) {
 	var codeMatcher = func(code string) bool {
 		return len(code) == 32
 	}
-	var userMatcher = func(u *st.User) bool {
-		return u.Email == email && len(u.InviteCode) == 32
+	var inviteMatcher = func(i *st.Invite) bool {
+		return i.Email == email && i.CodeHash != "" && i.InviterID == user.ID && i.ExpiresAt != nil
 	}
 
-	dao := dao.MockUserDao{}
-	dao.On("GetByUsername", user.Username).Return(&user, nil)
-	dao.On("Save", mock.MatchedBy(userMatcher)).Return(42)
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetByEmail", email).Return(nil, dao.ErrNotFound)
+	userDao.On("SaveInvite", mock.MatchedBy(inviteMatcher)).Return(&st.Invite{ID: "invite-1", Email: email}, nil)
+	userDao.On("SaveAuditRecord", mock.Anything).Return(nil)
 	mailer.On("SendInviteCode", email, mock.MatchedBy(codeMatcher)).Return(nil)
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	conf := createTestConfig()
+	conf.InviteExpiration = time.Hour
+	s := AuthService{&mailer, &userDao, conf}
 
-	err := s.InviteUser(email, token)
+	err := s.InviteUser(ctx, &st.Invite{Email: email}, token)
 	assert.Nil(t, err)
-	dao.AssertExpectations(t)
+	userDao.AssertExpectations(t)
 	mailer.AssertExpectations(t)
 }
 
@@ -46,7 +56,7 @@ func TestAuthService_InviteUser_Forbidden(t *testing.T) {
 	dao.On("GetByUsername", user.Username).Return(&st.User{ID: user.ID + 1}, nil)
 	s := AuthService{&mailer, &dao, createTestConfig()}
 
-	err := s.InviteUser(email, token)
+	err := s.InviteUser(ctx, &st.Invite{Email: email}, token)
 	assert.Equal(t, st.AuthError{Msg: "Available only for admin", Status: 403}, err)
 	dao.AssertExpectations(t)
 }
@@ -54,15 +64,35 @@ func TestAuthService_InviteUser_Forbidden(t *testing.T) {
 func TestAuthService_CreateUser(t *testing.T) {
 	var u = st.User{ID: -1, Username: "uname", FirstName: "test", LastName: "user", Email: "test@email.com", Password: "pwd"}
 
-	dao := dao.MockUserDao{}
-	dao.On("Save", &u).Return(1)
-	dao.On("GetByUsername", u.Username).Return(nil, nil)
+	userDao := dao.MockUserDao{}
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("Save", &u).Return(1, nil)
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
-	err := s.CreateUser(&u)
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+	err := s.CreateUser(ctx, &u)
 
 	assert.Nil(t, err)
-	dao.AssertExpectations(t)
+	userDao.AssertExpectations(t)
+}
+
+func TestAuthService_CreateUser_PasswordPolicy(t *testing.T) {
+	u := st.User{Username: "sarah", Email: "sarah@example.com", Password: strings.Repeat("p", 73)}
+	conf := createTestConfig()
+	conf.PasswordMinLength = 8
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+
+	s := AuthService{&mailer, &userDao, conf}
+
+	err := s.CreateUser(ctx, &u)
+	assert.Equal(t, st.AuthError{Msg: "Password must be at most 72 bytes long", Status: 400}, err)
+	u.Password = "pwd"
+	err = s.CreateUser(ctx, &u)
+	assert.Equal(t, st.AuthError{Msg: "Password must be at least 8 characters long", Status: 400}, err)
+	userDao.AssertNotCalled(t, "Save", mock.Anything)
 }
 
 func TestAuthService_CreateUser_DuplicateHandling(t *testing.T) {
@@ -72,8 +102,34 @@ func TestAuthService_CreateUser_DuplicateHandling(t *testing.T) {
 	dao.On("GetByUsername", u.Username).Return(&u, nil)
 
 	s := AuthService{&mailer, &dao, createTestConfig()}
-	err := s.CreateUser(&u)
-	assert.Equal(t, st.AuthError{Msg: "Username already exists", Status: 400}, err)
+	err := s.CreateUser(ctx, &u)
+	assert.Equal(t, st.AuthError{Msg: "Username already exists", Status: 409}, err)
+}
+
+func TestAuthService_CreateUser_DuplicateEmail(t *testing.T) {
+	u := st.User{ID: -1, Username: "alle", FirstName: "Alle", LastName: "Alle", Email: "alle@alle.com", Password: "pwd"}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("Save", &u).Return(0, dao.ErrDuplicateEmail)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+	err := s.CreateUser(ctx, &u)
+	assert.Equal(t, st.AuthError{Msg: "Email already exists", Status: 409}, err)
+}
+
+func TestAuthService_CreateUser_DuplicateUsernameOnSave(t *testing.T) {
+	u := st.User{ID: -1, Username: "alle", FirstName: "Alle", LastName: "Alle", Email: "alle@alle.com", Password: "pwd"}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("Save", &u).Return(0, dao.ErrDuplicateUsername)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+	err := s.CreateUser(ctx, &u)
+	assert.Equal(t, st.AuthError{Msg: "Username already exists", Status: 409}, err)
 }
 
 func TestAuthService_BasicAuthToken(t *testing.T) {
@@ -85,13 +141,14 @@ func TestAuthService_BasicAuthToken(t *testing.T) {
 	dao.On("GetByUsername", username).Return(&user, nil)
 
 	s := AuthService{&mailer, &dao, createTestConfig()}
-	accessToken, refreshToken, err := s.BasicAuthToken(username, password)
+	accessToken, refreshToken, err := s.BasicAuthToken(ctx, username, password)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, accessToken)
 	assert.True(t, testJWTIntField(accessToken, "userId", 42))
-	assert.True(t, testJWTStringField(accessToken, "sub", "alle"))
+	assert.True(t, testJWTStringField(accessToken, "sub", user.UUID))
+	assert.True(t, testJWTIntField(accessToken, "v", tokenVersion))
 	assert.NotEmpty(t, refreshToken)
-	assert.True(t, testJWTStringField(refreshToken, "sub", "alle"))
+	assert.True(t, testJWTStringField(refreshToken, "sub", user.UUID))
 
 	expRaw := exctractField(accessToken, "exp", -1)
 	exp := int64(expRaw.(float64))
@@ -103,7 +160,7 @@ func TestAuthService_BasicAuthToken(t *testing.T) {
 	estimatedEx = time.Now().AddDate(1, 0, 0).UTC().Unix()
 	assert.True(t, exp >= estimatedEx-1 && exp <= estimatedEx+1)
 
-	accessToken, refreshToken, err = s.BasicAuthToken(username, password+"xyz")
+	accessToken, refreshToken, err = s.BasicAuthToken(ctx, username, password+"xyz")
 	assert.Empty(t, accessToken)
 	assert.Empty(t, refreshToken)
 	assert.Equal(t, st.AuthError{Msg: "Username or password is wrong", Status: 403}, err)
@@ -116,17 +173,18 @@ func TestAuthService_RefreshToken(t *testing.T) {
 
 	dao := dao.MockUserDao{}
 	dao.On("GetByUsername", username).Return(&user, nil)
+	dao.On("GetByUUID", user.UUID).Return(&user, nil)
 
 	s := AuthService{&mailer, &dao, createTestConfig()}
-	accessToken, refreshToken, err := s.BasicAuthToken(username, password)
+	accessToken, refreshToken, err := s.BasicAuthToken(ctx, username, password)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, accessToken)
 
-	refreshedToken, err := s.RefreshToken(refreshToken)
+	refreshedToken, err := s.RefreshToken(ctx, refreshToken)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, refreshedToken)
 
-	refreshedToken, err = s.RefreshToken(refreshedToken + "xyz")
+	refreshedToken, err = s.RefreshToken(ctx, refreshedToken+"xyz")
 	assert.Empty(t, refreshedToken)
 	assert.Equal(t, st.AuthError{Msg: "Refresh token is not valid", Status: 403}, err)
 }
@@ -138,20 +196,135 @@ func TestAuthService_GetUserByToken(t *testing.T) {
 
 	dao := dao.MockUserDao{}
 	dao.On("GetByUsername", username).Return(&user, nil)
+	dao.On("GetByUUID", user.UUID).Return(&user, nil)
 
 	s := AuthService{&mailer, &dao, createTestConfig()}
-	token, _, err := s.BasicAuthToken(username, password)
+	token, _, err := s.BasicAuthToken(ctx, username, password)
 	assert.Nil(t, err)
 
-	u, err := s.GetUserByToken(token)
+	u, err := s.GetUserByToken(ctx, token)
 	assert.Nil(t, err)
 	assert.Equal(t, user, *u)
 
-	u, err = s.GetUserByToken(token + "xyz")
+	u, err = s.GetUserByToken(ctx, token+"xyz")
 	assert.NotNil(t, err)
 	assert.Nil(t, u)
 }
 
+func TestAuthService_UUIDTokenAfterUsernameChange(t *testing.T) {
+	user := createTestUser()
+	token := issueTestTokenWithClaims(jwt.MapClaims{"sub": user.UUID, "v": tokenVersion, "userId": user.ID, "exp": time.Now().Add(time.Hour).Unix()}, createTestConfig().PrivKeyPath)
+	user.Username = "bojack"
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUUID", user.UUID).Return(&user, nil)
+
+	s := AuthService{&mailer, &dao, createTestConfig()}
+
+	u, err := s.GetUserByToken(ctx, token)
+	assert.Nil(t, err)
+	assert.Equal(t, user, *u)
+	dao.AssertNotCalled(t, "GetByUsername", mock.Anything)
+}
+
+func TestAuthService_LegacyTokensWindow(t *testing.T) {
+	user := createTestUser()
+	legacyToken := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+	token := issueTestTokenWithClaims(jwt.MapClaims{"sub": user.UUID, "v": tokenVersion, "userId": user.ID, "exp": time.Now().Add(time.Hour).Unix()}, createTestConfig().PrivKeyPath)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("GetByUUID", user.UUID).Return(&user, nil)
+
+	conf := createTestConfig()
+	conf.LegacyTokensUntil = time.Now().AddDate(0, 0, 2).Format(legacyTokensLayout)
+	s := AuthService{&mailer, &dao, conf}
+
+	owner, err := s.validateToken(ctx, legacyToken)
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, owner.ID)
+
+	s.Config.LegacyTokensUntil = time.Now().AddDate(0, 0, -1).Format(legacyTokensLayout)
+
+	owner, err = s.validateToken(ctx, legacyToken)
+	assert.Nil(t, err)
+	assert.Nil(t, owner)
+
+	owner, err = s.validateToken(ctx, token)
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, owner.ID)
+}
+
+func TestAuthService_LegacyTokensDefaultWindow(t *testing.T) {
+	appliedAt := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	conf := createTestConfig()
+	conf.LegacyTokensUntil = ""
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetMigrationAppliedAt", dao.UUIDMigration).Return(appliedAt, nil)
+	s := AuthService{&mailer, &userDao, conf}
+
+	accepted, err := s.acceptsLegacyTokens(ctx, appliedAt.AddDate(1, 0, -1))
+	assert.Nil(t, err)
+	assert.True(t, accepted)
+	accepted, err = s.acceptsLegacyTokens(ctx, appliedAt.AddDate(1, 0, 0))
+	assert.Nil(t, err)
+	assert.False(t, accepted)
+
+	// Users without UUID might still get tokens with username subject from previous versions
+	pendingDao := dao.MockUserDao{}
+	pendingDao.On("GetMigrationAppliedAt", dao.UUIDMigration).Return(time.Time{}, dao.ErrNotFound)
+	s = AuthService{&mailer, &pendingDao, conf}
+
+	accepted, err = s.acceptsLegacyTokens(ctx, time.Now().AddDate(10, 0, 0))
+	assert.Nil(t, err)
+	assert.True(t, accepted)
+}
+
+func TestAuthService_BasicAuthToken_AssignsUUID(t *testing.T) {
+	user := createTestUser()
+	user.UUID = ""
+	uuid := "0c6a3d2e-8f1b-4c7a-9e5d-3b2a1f0e4d6c"
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("AssignUUID", user.ID).Return(uuid, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	accessToken, refreshToken, err := s.BasicAuthToken(ctx, user.Username, "oakheart")
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(accessToken, "sub", uuid))
+	assert.True(t, testJWTStringField(refreshToken, "sub", uuid))
+	userDao.AssertNumberOfCalls(t, "AssignUUID", 1)
+}
+
+func TestAuthService_LegacyTokenWithoutID_NewUsernameHolder(t *testing.T) {
+	user := createTestUser()
+	// Legacy refresh token carries only username and expiry a year after issue
+	refreshToken := issueTestTokenWithClaims(jwt.MapClaims{"sub": user.Username, "exp": time.Now().AddDate(1, 0, -1).Unix()}, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	user.CreatedAt = time.Now().Add(-time.Hour)
+	owner, err := s.validateToken(ctx, refreshToken)
+	assert.Nil(t, err)
+	assert.Nil(t, owner)
+
+	user.CreatedAt = time.Now().AddDate(0, 0, -2)
+	owner, err = s.validateToken(ctx, refreshToken)
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, owner.ID)
+
+	noExpiry := issueTestTokenWithClaims(jwt.MapClaims{"sub": user.Username}, createTestConfig().PrivKeyPath)
+	owner, err = s.validateToken(ctx, noExpiry)
+	assert.Nil(t, err)
+	assert.Nil(t, owner)
+}
+
 func TestAuthService_GetUsers(t *testing.T) {
 	user1 := createTestUser()
 	user2 := createAnotherTestUser()
@@ -166,11 +339,217 @@ func TestAuthService_GetUsers(t *testing.T) {
 	userInfo := createTestUserInfo()
 	userInfo2 := createAdditionalTestUserInfo()
 	expected := &[]st.UserInfo{userInfo, userInfo2}
-	us, err := s.GetUsers(token)
+	us, err := s.GetUsers(ctx, token)
 	assert.Nil(t, err)
 	assert.Equal(t, expected, us)
 }
 
+func TestAuthService_GetUsers_DatabaseTimeout(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetAll").Return(nil, fmt.Errorf("%w: context deadline exceeded", dao.ErrTimeout))
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	us, err := s.GetUsers(ctx, token)
+	assert.Nil(t, us)
+	assert.Equal(t, st.AuthError{Msg: "Database did not respond in time", Status: 504}, err)
+}
+
+func TestAuthService_BasicAuthToken_DatabaseUnavailable(t *testing.T) {
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", "alle").Return(nil, dao.ErrUnavailable)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	_, _, err := s.BasicAuthToken(ctx, "alle", "oakheart")
+	assert.Equal(t, st.AuthError{Msg: "Database is unavailable", Status: 503}, err)
+}
+
+func TestAuthService_BasicAuthToken_RehashesWeakPassword(t *testing.T) {
+	user := createTestUser()
+	weakHash := user.Password
+	assert.Nil(t, crypto.SetCost(bcrypt.MinCost+1))
+	defer crypto.SetCost(bcrypt.MinCost)
+
+	hasRaisedCost := func(hash string) bool {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err == nil && cost == bcrypt.MinCost+1 && crypto.Match("oakheart", hash)
+	}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("RehashPassword", user.ID, weakHash, mock.MatchedBy(hasRaisedCost)).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	_, _, err := s.BasicAuthToken(ctx, user.Username, "oakheart")
+	assert.Nil(t, err)
+	userDao.AssertExpectations(t)
+}
+
+func TestAuthService_BasicAuthToken_RehashFailureIgnored(t *testing.T) {
+	user := createTestUser()
+	assert.Nil(t, crypto.SetCost(bcrypt.MinCost+1))
+	defer crypto.SetCost(bcrypt.MinCost)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("RehashPassword", user.ID, user.Password, mock.AnythingOfType("string")).Return(dao.ErrUnavailable)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	_, _, err := s.BasicAuthToken(ctx, user.Username, "oakheart")
+	assert.Nil(t, err)
+}
+
+func TestAuthService_BasicAuthToken_MigratesToArgon2id(t *testing.T) {
+	user := createTestUser()
+	bcryptHash := user.Password
+	assert.Nil(t, crypto.SetArgon2Params(64, 1, 1))
+	defer crypto.SetArgon2Params(64*1024, 3, 4)
+	assert.Nil(t, crypto.Use("argon2id"))
+	defer crypto.Use("bcrypt")
+
+	isArgon2id := func(hash string) bool {
+		return strings.HasPrefix(hash, "$argon2id$") && crypto.Match("oakheart", hash)
+	}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("RehashPassword", user.ID, bcryptHash, mock.MatchedBy(isArgon2id)).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	_, _, err := s.BasicAuthToken(ctx, user.Username, "oakheart")
+	assert.Nil(t, err)
+	userDao.AssertExpectations(t)
+}
+
+func BenchmarkAuthService_BasicAuthToken(b *testing.B) {
+	defer crypto.SetCost(bcrypt.MinCost)
+
+	for _, cost := range []int{4, 8, 10, 12} {
+		b.Run(fmt.Sprintf("cost=%d", cost), func(b *testing.B) {
+			hash, err := bcrypt.GenerateFromPassword([]byte("oakheart"), cost)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = crypto.SetCost(cost)
+			if err != nil {
+				b.Fatal(err)
+			}
+			user := createTestUser()
+			user.Password = string(hash)
+
+			userDao := dao.MockUserDao{}
+			userDao.On("GetByUsername", user.Username).Return(&user, nil)
+			s := AuthService{&mailer, &userDao, createTestConfig()}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _, err = s.BasicAuthToken(ctx, user.Username, "oakheart")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthService_ListUsers(t *testing.T) {
+	user1 := createTestUser()
+	user2 := createAnotherTestUser()
+	token := issueTestToken(user1.ID, user1.Username, createTestConfig().PrivKeyPath)
+
+	expectedQuery := dao.UserQuery{Limit: maxPageSize, SortBy: dao.SortByUsername, ExcludeIDs: []int{user1.ID}}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user1.Username).Return(&user1, nil)
+	userDao.On("Find", expectedQuery).Return(&dao.UserPage{Users: []st.User{user2}, NextCursor: "next"}, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	page, err := s.ListUsers(ctx, token, dao.UserQuery{Limit: 1000, SortBy: dao.SortByUsername}, "user")
+	assert.Nil(t, err)
+	assert.Equal(t, &st.UserInfoPage{Users: []st.UserInfo{createAdditionalTestUserInfo()}, NextCursor: "next"}, page)
+}
+
+func TestAuthService_ListUsers_AssignedRole(t *testing.T) {
+	user1 := createTestUser()
+	user2 := createAnotherTestUser()
+	token := issueTestToken(user1.ID, user1.Username, createTestConfig().PrivKeyPath)
+
+	expectedQuery := dao.UserQuery{Limit: defaultPageSize, Roles: []string{"editor"}}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user1.Username).Return(&user1, nil)
+	userDao.On("Find", expectedQuery).Return(&dao.UserPage{Users: []st.User{user2}}, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	page, err := s.ListUsers(ctx, token, dao.UserQuery{}, "editor")
+	assert.Nil(t, err)
+	assert.Equal(t, &st.UserInfoPage{Users: []st.UserInfo{createAdditionalTestUserInfo()}}, page)
+}
+
+func TestAuthService_ListUsers_InvalidCursor(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("Find", dao.UserQuery{Limit: defaultPageSize, Cursor: "xyz"}).Return(nil, dao.ErrInvalidQuery)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	page, err := s.ListUsers(ctx, token, dao.UserQuery{Cursor: "xyz"}, "")
+	assert.Nil(t, page)
+	assert.Equal(t, st.AuthError{Msg: "Invalid query or cursor", Status: 400}, err)
+
+	page, err = s.ListUsers(ctx, token, dao.UserQuery{}, "Super User")
+	assert.Nil(t, page)
+	assert.Equal(t, st.AuthError{Msg: "Invalid role", Status: 400}, err)
+}
+
+func TestAuthService_SearchUsers(t *testing.T) {
+	user1 := createTestUser()
+	user2 := createAnotherTestUser()
+	token := issueTestToken(user1.ID, user1.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user1.Username).Return(&user1, nil)
+	userDao.On("Search", dao.SearchQuery{Text: "alice", Limit: defaultPageSize}).Return(&dao.UserPage{Users: []st.User{user2}, NextCursor: "next"}, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	page, err := s.SearchUsers(ctx, token, dao.SearchQuery{Text: "alice"})
+	assert.Nil(t, err)
+	assert.Equal(t, &st.UserInfoPage{Users: []st.UserInfo{createAdditionalTestUserInfo()}, NextCursor: "next"}, page)
+
+	page, err = s.SearchUsers(ctx, token, dao.SearchQuery{})
+	assert.Nil(t, page)
+	assert.Equal(t, st.AuthError{Msg: "Search text is missing", Status: 400}, err)
+}
+
+func TestAuthService_SearchUsers_NotAdmin(t *testing.T) {
+	user := createAnotherTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	page, err := s.SearchUsers(ctx, token, dao.SearchQuery{Text: "alice"})
+	assert.Nil(t, page)
+	assert.Equal(t, st.AuthError{Msg: "Available only for admin", Status: 403}, err)
+	userDao.AssertNotCalled(t, "Search", mock.Anything)
+}
+
 func TestAuthService_UpdateUser(t *testing.T) {
 	user := createTestUserUpdatePayload()
 	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
@@ -182,10 +561,25 @@ func TestAuthService_UpdateUser(t *testing.T) {
 
 	s := AuthService{&mailer, &dao, createTestConfig()}
 
-	err := s.UpdateUser(&user, token)
+	err := s.UpdateUser(ctx, &user, token)
 	assert.Nil(t, err)
 }
 
+func TestAuthService_UpdateUser_EmailRequiresConfirmation(t *testing.T) {
+	user := createTestUser()
+	payload := st.User{ID: user.ID, Email: "changed@email.com"}
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.UpdateUser(ctx, &payload, token)
+	assert.Equal(t, st.AuthError{Msg: "Email can be changed only with confirmation", Status: 400}, err)
+	userDao.AssertNotCalled(t, "Update", mock.Anything)
+}
+
 func TestAuthService_UpdateUserInvalidToken(t *testing.T) {
 	user := createTestUserUpdatePayload()
 	token := "invalid token"
@@ -193,7 +587,7 @@ func TestAuthService_UpdateUserInvalidToken(t *testing.T) {
 	dao := dao.MockUserDao{}
 	s := AuthService{&mailer, &dao, createTestConfig()}
 
-	err := s.UpdateUser(&user, token)
+	err := s.UpdateUser(ctx, &user, token)
 	assert.Equal(t, st.AuthError{Msg: "Invalid token", Status: 401}, err)
 }
 
@@ -207,35 +601,126 @@ func TestAuthService_DeleteUser(t *testing.T) {
 
 	s := AuthService{&mailer, &dao, createTestConfig()}
 
-	err := s.DeleteUser(user.ID, token)
+	err := s.DeleteUser(ctx, user.ID, token)
+	assert.Nil(t, err)
+}
+
+func TestAuthService_DeleteUser_ByAdmin(t *testing.T) {
+	admin := createTestUser()
+	token := issueTestToken(admin.ID, admin.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", admin.Username).Return(&admin, nil)
+	userDao.On("DeleteById", 43).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.DeleteUser(ctx, 43, token)
 	assert.Nil(t, err)
+
+	other := createAnotherTestUser()
+	otherToken := issueTestToken(other.ID, other.Username, createTestConfig().PrivKeyPath)
+	userDao.On("GetByUsername", other.Username).Return(&other, nil)
+
+	err = s.DeleteUser(ctx, admin.ID, otherToken)
+	assert.Equal(t, st.AuthError{Msg: "Invalid token", Status: 401}, err)
+	userDao.AssertNumberOfCalls(t, "DeleteById", 1)
+}
+
+func TestAuthService_DeleteUser_NotFound(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("DeleteById", user.ID).Return(dao.ErrNotFound)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.DeleteUser(ctx, user.ID, token)
+	assert.Equal(t, st.AuthError{Msg: "User does not exist", Status: 404}, err)
+}
+
+func TestAuthService_GetUserById_NotFound(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("Get", 404).Return(nil, dao.ErrNotFound)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	u, err := s.GetUserById(ctx, 404, token)
+	assert.Nil(t, u)
+	assert.Equal(t, st.AuthError{Msg: "User does not exist", Status: 404}, err)
+}
+
+func TestAuthService_GetUserById_DeletedTokenOwner(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("Get", user.ID).Return(nil, dao.ErrNotFound)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	u, err := s.GetUserById(ctx, user.ID, token)
+	assert.Nil(t, u)
+	assert.Equal(t, st.AuthError{Msg: "Invalid token", Status: 401}, err)
 }
 
 func TestAuthService_SendRecoveryEmail(t *testing.T) {
 	user := createTestUser()
 
+	var sentCode string
 	codeMatcher := func(code string) bool {
+		sentCode = code
 		return len(code) == 6
 	}
 
 	dao := dao.MockUserDao{}
+	mailer := email.MailerMock{}
 
 	mailer.On(
 		"SendRecoveryCode",
 		user.Email,
 		mock.MatchedBy(codeMatcher)).Return(nil)
 
+	conf := createTestConfig()
+	conf.RecoveryResendInterval = time.Minute
+
 	dao.On(
 		"SetRecoveryCode",
 		user.ID,
-		mock.MatchedBy(func(hashedCode string) bool { return hashedCode != "" })).Return(nil)
+		mock.MatchedBy(func(hashedCode string) bool { return hashedCode != "" }),
+		mock.MatchedBy(func(issuedBefore time.Time) bool {
+			return time.Since(issuedBefore) >= conf.RecoveryResendInterval
+		})).Return(nil)
 
 	dao.On("GetByUsername", user.Username).Return(&user, nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	s := AuthService{&mailer, &dao, conf}
 
-	err := s.SendRecoveryEmail(user.Username)
+	err := s.SendRecoveryEmail(ctx, user.Username)
 	assert.Nil(t, err)
+	dao.AssertCalled(t, "SetRecoveryCode", user.ID, crypto.HashCode(sentCode), mock.Anything)
+}
+
+func TestAuthService_SendRecoveryEmail_Throttled(t *testing.T) {
+	user := createTestUser()
+
+	mailer := email.MailerMock{}
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("SetRecoveryCode", user.ID, mock.AnythingOfType("string"), mock.Anything).Return(dao.ErrNotFound)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.SendRecoveryEmail(ctx, user.Username)
+	assert.Equal(t, st.AuthError{Msg: "Recovery code was sent recently, try again later", Status: 429}, err)
+	mailer.AssertNotCalled(t, "SendRecoveryCode", mock.Anything, mock.Anything)
 }
 
 func TestAuthService_ExchangeRecoveryCode(t *testing.T) {
@@ -246,7 +731,7 @@ func TestAuthService_ExchangeRecoveryCode(t *testing.T) {
 	dao := dao.MockUserDao{}
 
 	dao.On("GetByUsername", user.Username).Return(&user, nil)
-	dao.On("GetRecoveryCode", user.ID).Return(hashedCode, nil)
+	dao.On("GetRecoveryCode", user.ID).Return(&st.IssuedCode{Hash: hashedCode}, nil)
 	dao.On(
 		"SetResettingCode",
 		user.ID,
@@ -254,7 +739,7 @@ func TestAuthService_ExchangeRecoveryCode(t *testing.T) {
 
 	s := AuthService{&mailer, &dao, createTestConfig()}
 
-	resettingCode, err := s.ExchangeRecoveryCode(user.Username, code)
+	resettingCode, err := s.ExchangeRecoveryCode(ctx, user.Username, code)
 	assert.Nil(t, err)
 	assert.True(t, len(resettingCode) == 10)
 }
@@ -267,7 +752,7 @@ func TestAuthService_ResetPassword(t *testing.T) {
 	dao := dao.MockUserDao{}
 
 	dao.On("GetByUsername", user.Username).Return(&user, nil)
-	dao.On("GetResettingCode", user.ID).Return(hashedCode, nil)
+	dao.On("GetResettingCode", user.ID).Return(&st.IssuedCode{Hash: hashedCode}, nil)
 	dao.On(
 		"ResetPassword",
 		user.ID,
@@ -275,16 +760,94 @@ func TestAuthService_ResetPassword(t *testing.T) {
 
 	s := AuthService{&mailer, &dao, createTestConfig()}
 
-	err := s.ResetPassword(user.Username, code, "kek")
+	err := s.ResetPassword(ctx, user.Username, code, "kek")
 	assert.Nil(t, err)
 }
 
+func TestAuthService_ResetPassword_PasswordPolicy(t *testing.T) {
+	user := createTestUser()
+	conf := createTestConfig()
+	conf.PasswordMinLength = 8
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetResettingCode", user.ID).Return(&st.IssuedCode{Hash: hashedCode}, nil)
+
+	s := AuthService{&mailer, &userDao, conf}
+
+	err := s.ResetPassword(ctx, user.Username, code, "kek")
+	assert.Equal(t, st.AuthError{Msg: "Password must be at least 8 characters long", Status: 400}, err)
+	err = s.ResetPassword(ctx, user.Username, code, user.Email)
+	assert.Equal(t, st.AuthError{Msg: "Password must not match username or email", Status: 400}, err)
+	userDao.AssertNotCalled(t, "ResetPassword", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_ExchangeRecoveryCode_ExpiredAndAttempts(t *testing.T) {
+	user := createTestUser()
+	conf := createTestConfig()
+	conf.RecoveryCodeTTL = 15 * time.Minute
+	conf.RecoveryMaxAttempts = 5
+	issuedAt := time.Now().Add(-time.Hour)
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetRecoveryCode", user.ID).Return(&st.IssuedCode{Hash: hashedCode, IssuedAt: &issuedAt}, nil).Once()
+	userDao.On("GetRecoveryCode", user.ID).Return(&st.IssuedCode{Hash: hashedCode}, nil).Once()
+	userDao.On("TakeCodeAttempt", user.ID, dao.RecoveryCode, 5).Return(dao.ErrNotFound)
+
+	s := AuthService{&mailer, &userDao, conf}
+
+	_, err := s.ExchangeRecoveryCode(ctx, user.Username, code)
+	assert.Equal(t, st.AuthError{Msg: "Provided recovery code has expired", Status: 403}, err)
+
+	_, err = s.ExchangeRecoveryCode(ctx, user.Username, code)
+	assert.Equal(t, st.AuthError{Msg: "Provided recovery code has expired", Status: 403}, err)
+
+	now := time.Now()
+	userDao.On("GetRecoveryCode", user.ID).Return(&st.IssuedCode{Hash: hashedCode, IssuedAt: &now, Attempts: 5}, nil)
+	_, err = s.ExchangeRecoveryCode(ctx, user.Username, code)
+	assert.Equal(t, st.AuthError{Msg: "Too many wrong recovery codes, request a new one", Status: 403}, err)
+	userDao.AssertNotCalled(t, "SetResettingCode", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_ResetPassword_WrongCodeCounted(t *testing.T) {
+	user := createTestUser()
+	conf := createTestConfig()
+	conf.RecoveryMaxAttempts = 5
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetResettingCode", user.ID).Return(&st.IssuedCode{Hash: hashedCode}, nil)
+	userDao.On("TakeCodeAttempt", user.ID, dao.ResettingCode, 5).Return(nil)
+
+	s := AuthService{&mailer, &userDao, conf}
+
+	err := s.ResetPassword(ctx, user.Username, "000000", "new password")
+	assert.Equal(t, st.AuthError{Msg: "Provided recovery code does not match", Status: 403}, err)
+	userDao.AssertCalled(t, "TakeCodeAttempt", user.ID, dao.ResettingCode, 5)
+	userDao.AssertNotCalled(t, "ResetPassword", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_ResetPassword_NoResettingCode(t *testing.T) {
+	user := createTestUser()
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", user.Username).Return(&user, nil)
+	userDao.On("GetResettingCode", user.ID).Return(&st.IssuedCode{}, nil)
+
+	s := AuthService{&mailer, &userDao, createTestConfig()}
+
+	err := s.ResetPassword(ctx, user.Username, "", "new password")
+	assert.Equal(t, st.AuthError{Msg: recoveryNotInitiatedMsg, Status: 404}, err)
+	userDao.AssertNotCalled(t, "ResetPassword", mock.Anything, mock.Anything)
+}
+
 func createTestUser() st.User {
-	return st.User{ID: 42, Username: "alle", FirstName: "test", LastName: "user", Email: "test@email.com", Password: "$2a$04$Mhlu1.a4QchlVgGQFc/0N.qAw9tsXqm1OMwjJRaPRCWn47bpsRa4S"}
+	return st.User{ID: 42, UUID: "9b2f6c1e-4a7d-4e3b-8c5f-2d1a0e9f7b63", Username: "alle", FirstName: "test", LastName: "user", Email: "test@email.com", Password: "$2a$04$Mhlu1.a4QchlVgGQFc/0N.qAw9tsXqm1OMwjJRaPRCWn47bpsRa4S"}
 }
 
 func createTestUserUpdatePayload() st.User {
-	return st.User{ID: 42, Email: "changed@email.com"}
+	return st.User{ID: 42, FirstName: "changed"}
 }
 
 func createTestUserInfo() st.UserInfo {
@@ -300,7 +863,8 @@ func createAdditionalTestUserInfo() st.UserInfo {
 }
 
 func createTestConfig() Config {
-	return Config{PrivKeyPath: "../test_data/private.pem", PubKeyPath: "../test_data/public.pem", AdminIDs: []int{user.ID}}
+	// Test tokens have username subject, they have to keep working after the default legacy tokens window
+	return Config{PrivKeyPath: "../test_data/private.pem", PubKeyPath: "../test_data/public.pem", AdminIDs: []int{user.ID}, LegacyTokensUntil: "2100-01-01"}
 }
 
 func testJWTIntField(tokenStr string, fieldName string, fieldValue int) bool {
@@ -345,6 +909,14 @@ func exctractField(tokenStr string, fieldName string, defaultValue interface{})
 }
 
 func issueTestToken(userID int, username string, privKeyPath string) string {
+	return issueTestTokenWithClaims(jwt.MapClaims{
+		"sub":    username,
+		"userId": userID,
+		"exp":    time.Now().Add(time.Hour).UTC().Unix(),
+	}, privKeyPath)
+}
+
+func issueTestTokenWithClaims(claims jwt.MapClaims, privKeyPath string) string {
 	keyData, err := ioutil.ReadFile(privKeyPath)
 	if err != nil {
 		return ""
@@ -354,11 +926,7 @@ func issueTestToken(userID int, username string, privKeyPath string) string {
 		return ""
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"sub":    username,
-		"userId": userID,
-		"exp":    time.Now().Add(time.Hour).UTC().Unix(),
-	})
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 
 	tokenString, err := token.SignedString(key)
 	if err != nil {
@@ -0,0 +1,33 @@
+package structs
+
+import "time"
+
+// Audited admin actions
+const (
+	AuditCreateUser          = "create_user"
+	AuditUpdateUser          = "update_user"
+	AuditSetPassword         = "set_password"
+	AuditForceReset          = "force_password_reset"
+	AuditVerifyEmail         = "verify_email"
+	AuditSuspendUser         = "suspend_user"
+	AuditDisableUser         = "disable_user"
+	AuditEnableUser          = "enable_user"
+	AuditApproveUser         = "approve_user"
+	AuditDeleteUser          = "delete_user"
+	AuditRestoreUser         = "restore_user"
+	AuditUpdateProfileSchema = "update_profile_schema"
+	AuditInviteUser          = "invite_user"
+	AuditResendInvite        = "resend_invite"
+	AuditRevokeInvite        = "revoke_invite"
+	AuditCreateInviteLink    = "create_invite_link"
+	AuditRevokeInviteLink    = "revoke_invite_link"
+)
+
+// AuditRecord describes a single admin action
+type AuditRecord struct {
+	ActorID  int       `bson:"actorId"`
+	Action   string    `bson:"action"`
+	TargetID int       `bson:"targetId"`
+	Details  string    `bson:"details,omitempty"`
+	At       time.Time `bson:"at"`
+}
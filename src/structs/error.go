@@ -1,9 +1,21 @@
 package structs
 
+// Codes of errors which clients may need to tell apart from others with the same status
+const (
+	CodeAccountSuspended = "account_suspended"
+	CodeAccountDisabled  = "account_disabled"
+	CodeAccountPending   = "account_pending"
+
+	CodeEmailDomainNotAllowed = "email_domain_not_allowed"
+	CodeDisposableEmail       = "disposable_email"
+)
+
 // AuthError simple error
 type AuthError struct {
 	Msg    string
 	Status int
+	// Code is optional machine readable error code
+	Code string
 }
 
 func (e AuthError) Error() string {
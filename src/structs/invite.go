@@ -0,0 +1,51 @@
+package structs
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Invite statuses. Expired is never stored, it is reported for pending invites past their expiry.
+const (
+	InviteStatusPending  = "pending"
+	InviteStatusAccepted = "accepted"
+	InviteStatusRevoked  = "revoked"
+	InviteStatusExpired  = "expired"
+)
+
+// Invite lets the person with the email register in private mode
+type Invite struct {
+	ID         string     `bson:"_id" json:"id"`
+	Email      string     `bson:"email" json:"email"`
+	CodeHash   string     `bson:"codeHash" json:"-"`
+	InviterID  int        `bson:"inviterId" json:"inviterId"`
+	CreatedAt  time.Time  `bson:"createdAt" json:"createdAt"`
+	SentAt     time.Time  `bson:"sentAt" json:"sentAt"`
+	ExpiresAt  *time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	Status     string     `bson:"status" json:"status"`
+	AcceptedBy int        `bson:"acceptedBy,omitempty" json:"acceptedBy,omitempty"`
+	AcceptedAt *time.Time `bson:"acceptedAt,omitempty" json:"acceptedAt,omitempty"`
+
+	// Profile of the invited user, applied when the user registers
+	FirstName    string                 `bson:"firstName,omitempty" json:"firstName,omitempty"`
+	LastName     string                 `bson:"lastName,omitempty" json:"lastName,omitempty"`
+	Roles        []string               `bson:"roles,omitempty" json:"roles,omitempty"`
+	Organization string                 `bson:"organization,omitempty" json:"organization,omitempty"`
+	Attributes   map[string]interface{} `bson:"attributes,omitempty" json:"attributes,omitempty"`
+}
+
+// Expired reports whether pending invite can not be used anymore
+func (i *Invite) Expired(now time.Time) bool {
+	return i.Status == InviteStatusPending && i.ExpiresAt != nil && !now.Before(*i.ExpiresAt)
+}
+
+// InvitePage structure
+type InvitePage struct {
+	Invites    []Invite `json:"invites"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+func IP2JSON(p *InvitePage) []byte {
+	data, _ := json.Marshal(p)
+	return data
+}
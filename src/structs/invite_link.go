@@ -0,0 +1,48 @@
+package structs
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// InviteLink lets anyone with its token register in private mode while it has uses left
+type InviteLink struct {
+	ID        string `bson:"_id" json:"id"`
+	TokenHash string `bson:"tokenHash" json:"-"`
+	// Token is known only when the link is created
+	Token     string     `bson:"-" json:"token,omitempty"`
+	CreatorID int        `bson:"creatorId" json:"creatorId"`
+	CreatedAt time.Time  `bson:"createdAt" json:"createdAt"`
+	ExpiresAt *time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	MaxUses   int        `bson:"maxUses" json:"maxUses"`
+	UsesLeft  int        `bson:"usesLeft" json:"usesLeft"`
+	// Domain restricts registration to emails of the domain, empty allows any email
+	Domain    string     `bson:"domain,omitempty" json:"domain,omitempty"`
+	Revoked   bool       `bson:"revoked" json:"revoked"`
+	RevokedAt *time.Time `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+
+	// Assigned to every user registered with the link
+	Roles        []string `bson:"roles,omitempty" json:"roles,omitempty"`
+	Organization string   `bson:"organization,omitempty" json:"organization,omitempty"`
+}
+
+// Expired reports whether the link can not be used anymore because of its expiry
+func (l *InviteLink) Expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !now.Before(*l.ExpiresAt)
+}
+
+// InviteLinkPage structure
+type InviteLinkPage struct {
+	Links      []InviteLink `json:"links"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+func IL2JSON(l *InviteLink) []byte {
+	data, _ := json.Marshal(l)
+	return data
+}
+
+func ILP2JSON(p *InviteLinkPage) []byte {
+	data, _ := json.Marshal(p)
+	return data
+}
@@ -0,0 +1,12 @@
+package structs
+
+import "time"
+
+// Metadata is a JSON document stored for the user by an application under its namespace
+type Metadata struct {
+	UserID    int       `bson:"userId"`
+	Namespace string    `bson:"namespace"`
+	Data      string    `bson:"data"`
+	Version   int64     `bson:"version"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
@@ -0,0 +1,51 @@
+package structs
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Types of custom profile attributes
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+)
+
+// Visibility of custom profile attributes.
+// Public attributes are shown to every user, private ones to the owner and admins, admin ones only to admins.
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+	VisibilityAdmin   = "admin"
+)
+
+// ProfileField describes custom profile attribute
+type ProfileField struct {
+	Name       string `bson:"name" json:"name"`
+	Type       string `bson:"type" json:"type"`
+	Required   bool   `bson:"required" json:"required"`
+	Regex      string `bson:"regex,omitempty" json:"regex,omitempty"`
+	Visibility string `bson:"visibility" json:"visibility"`
+}
+
+// ProfileSchema lists custom profile attributes users can have
+type ProfileSchema struct {
+	Fields    []ProfileField `bson:"fields" json:"fields"`
+	UpdatedAt time.Time      `bson:"updatedAt" json:"updatedAt"`
+}
+
+// Field returns field with given name or nil if schema has no such field
+func (s *ProfileSchema) Field(name string) *ProfileField {
+	for i := range s.Fields {
+		if s.Fields[i].Name == name {
+			return &s.Fields[i]
+		}
+	}
+	return nil
+}
+
+func PS2JSON(s *ProfileSchema) []byte {
+	data, _ := json.Marshal(s)
+	return data
+}
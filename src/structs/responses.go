@@ -4,10 +4,13 @@ import "encoding/json"
 
 type ErrorResp struct {
 	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
 }
 
 type IDResp struct {
 	ID int `json:"id"`
+	// Status is set for accounts which can not be used yet
+	Status string `json:"status,omitempty"`
 }
 
 type AccessAndRefreshTokenResp struct {
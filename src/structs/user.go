@@ -2,18 +2,103 @@ package structs
 
 import (
 	"encoding/json"
+	"time"
 )
 
+// Account statuses, empty status means active. Pending accounts await admin approval.
+const (
+	StatusActive    = "active"
+	StatusPending   = "pending"
+	StatusSuspended = "suspended"
+	StatusDisabled  = "disabled"
+)
+
+// AccountStatus tells whether user is allowed to use their account
+type AccountStatus struct {
+	Status string `bson:"status,omitempty"`
+	// Reason of suspension, shown to the user
+	Reason string `bson:"statusReason,omitempty"`
+	// Until is the end of suspension, nil means it lasts until lifted by admin
+	Until *time.Time `bson:"statusUntil,omitempty"`
+}
+
+// IsDisabled reports whether account was disabled by admin
+func (s AccountStatus) IsDisabled() bool {
+	return s.Status == StatusDisabled
+}
+
+// IsPending reports whether account awaits admin approval
+func (s AccountStatus) IsPending() bool {
+	return s.Status == StatusPending
+}
+
+// IsSuspended reports whether account is suspended at the given time
+func (s AccountStatus) IsSuspended(now time.Time) bool {
+	return s.Status == StatusSuspended && (s.Until == nil || now.Before(*s.Until))
+}
+
+// EmailChange is a pending change of user email awaiting confirmation
+type EmailChange struct {
+	Email string `bson:"email"`
+	// CodeHash is hash of the code sent to the new email
+	CodeHash  string    `bson:"codeHash"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// IssuedCode is hash of password recovery or resetting code with time it was issued and number of attempts to enter it
+type IssuedCode struct {
+	Hash string
+	// IssuedAt is nil for codes issued by previous versions
+	IssuedAt *time.Time
+	Attempts int
+}
+
+// Expired reports whether the code is older than ttl, codes with unknown issue time are expired. Zero ttl never expires.
+func (c *IssuedCode) Expired(now time.Time, ttl time.Duration) bool {
+	if ttl <= 0 {
+		return false
+	}
+	return c.IssuedAt == nil || !now.Before(c.IssuedAt.Add(ttl))
+}
+
+// UsernameChange records previous username of the user
+type UsernameChange struct {
+	Username  string    `bson:"username"`
+	ChangedAt time.Time `bson:"changedAt"`
+}
+
 // User structure
 type User struct {
-	ID               int    `bson:"_id"`
-	Username         string `bson:"username"`
-	FirstName        string `bson:"firstName"`
-	LastName         string `bson:"lastName"`
-	Email            string `bson:"email"`
-	Password         string `bson:"password"`
-	InviteCode 	     string `bson:"inviteCode"`
+	ID int `bson:"_id"`
+	// UUID is assigned once on save and identifies the user in tokens
+	UUID       string `bson:"uuid,omitempty" json:"-"`
+	Username   string `bson:"username"`
+	FirstName  string `bson:"firstName"`
+	LastName   string `bson:"lastName"`
+	Email      string `bson:"email"`
+	Password   string `bson:"password"`
+	InviteCode string `bson:"inviteCode"`
+	// InviteToken is the token of invite link given on registration instead of invite code
+	InviteToken     string     `bson:"-" json:"inviteToken,omitempty"`
+	InviteExpiresAt *time.Time `bson:"inviteExpiresAt,omitempty" json:"-"`
+	// VerificationCode is hash of the code verifying email, empty once email is verified
 	VerificationCode string `bson:"verificationCode"`
+	// Verification code expiry, time it was sent and number of failed attempts to enter it
+	VerificationExpiresAt *time.Time       `bson:"verificationExpiresAt,omitempty" json:"-"`
+	VerificationSentAt    *time.Time       `bson:"verificationSentAt,omitempty" json:"-"`
+	VerificationAttempts  int              `bson:"verificationAttempts,omitempty" json:"-"`
+	CreatedAt             time.Time        `bson:"createdAt" json:"-"`
+	DeletedAt             *time.Time       `bson:"deletedAt,omitempty" json:"-"`
+	EmailChange           *EmailChange     `bson:"emailChange,omitempty" json:"-"`
+	UsernameHistory       []UsernameChange `bson:"usernameHistory,omitempty" json:"-"`
+	// Roles and organization are assigned by admin and passed to applications as is
+	Roles        []string `bson:"roles,omitempty" json:"roles,omitempty"`
+	Organization string   `bson:"organization,omitempty" json:"organization,omitempty"`
+	// Attributes holds custom profile attributes described by the profile schema
+	Attributes map[string]interface{} `bson:"attributes,omitempty" json:"attributes,omitempty"`
+	// TokensRevokedAt invalidates tokens issued before it
+	TokensRevokedAt *time.Time `bson:"tokensRevokedAt,omitempty" json:"-"`
+	AccountStatus   `bson:",inline" json:"-"`
 }
 
 // UserInfo structure
@@ -23,6 +108,17 @@ type UserInfo struct {
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 	Email     string `json:"email"`
+	// Roles and organization are present only if assigned
+	Roles        []string `json:"roles,omitempty"`
+	Organization string   `json:"organization,omitempty"`
+	// Attributes contains only custom attributes visible to the requester
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// UserInfoPage structure
+type UserInfoPage struct {
+	Users      []UserInfo `json:"users"`
+	NextCursor string     `json:"nextCursor,omitempty"`
 }
 
 func U2JSON(u *User) []byte {
@@ -39,3 +135,8 @@ func UL2JSON(us *[]UserInfo) []byte {
 	data, _ := json.Marshal(us)
 	return data
 }
+
+func UIP2JSON(p *UserInfoPage) []byte {
+	data, _ := json.Marshal(p)
+	return data
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/url"
+	"time"
+
+	"ruslanlesko/brightonum/src/crypto"
+	"ruslanlesko/brightonum/src/dao"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+// VerifyUser verifies user email by code. Code can not be used after it expires or too many codes were entered.
+// Attempts are counted before matching, so parallel guesses share the limit. Every new code gets its own attempts,
+// codes are sent at most once per VerificationResendInterval, which bounds the rate of guesses.
+func (s *AuthService) VerifyUser(ctx context.Context, username string, code string) error {
+	logger.Logf("DEBUG Verifying user id with username %s", username)
+
+	user, err := s.UserDao.GetByUsername(ctx, username)
+	if errors.Is(err, dao.ErrNotFound) {
+		return s.rejectCode(code, false, mapDaoError(err), invalidVerificationCodeError)
+	}
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	if user.VerificationCode == "" {
+		return s.rejectCode(code, false, st.AuthError{Msg: "User is already verified", Status: 409}, invalidVerificationCodeError)
+	}
+	if user.VerificationExpiresAt != nil && !time.Now().Before(*user.VerificationExpiresAt) {
+		return s.rejectCode(code, false, st.AuthError{Msg: "Verification code has expired, request a new one", Status: 400}, invalidVerificationCodeError)
+	}
+	if s.Config.VerificationMaxAttempts > 0 {
+		err = s.UserDao.TakeVerificationAttempt(ctx, user.ID, s.Config.VerificationMaxAttempts)
+		if errors.Is(err, dao.ErrNotFound) {
+			return s.rejectCode(code, false, st.AuthError{Msg: "Too many wrong verification codes, request a new one", Status: 400}, invalidVerificationCodeError)
+		}
+		if err != nil {
+			return mapDaoError(err)
+		}
+	}
+
+	if code == "" || !matchVerificationCode(code, user.VerificationCode) {
+		return s.rejectCode(code, true, st.AuthError{Msg: "Verification code does not match", Status: 400}, invalidVerificationCodeError)
+	}
+
+	user.VerificationCode = ""
+	err = s.UserDao.ClearVerificationCode(ctx, user.ID)
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	return nil
+}
+
+// ResendVerificationCode sends new verification code, which replaces the previous one.
+// Codes are sent to the same user at most once per VerificationResendInterval.
+// In anti-enumeration mode the code is silently not sent if user is missing, verified or got a code recently.
+func (s *AuthService) ResendVerificationCode(ctx context.Context, username string) error {
+	user, err := s.UserDao.GetByUsername(ctx, username)
+	if errors.Is(err, dao.ErrNotFound) && s.Config.AntiEnumeration {
+		return nil
+	}
+	if err != nil {
+		return mapDaoError(err)
+	}
+	if user.VerificationCode == "" {
+		if s.Config.AntiEnumeration {
+			return nil
+		}
+		return st.AuthError{Msg: "User is already verified", Status: 409}
+	}
+
+	code, err := s.newCode(codeVerification)
+	if err != nil {
+		return err
+	}
+	s.setVerificationCode(user, code)
+	user.VerificationAttempts = 0
+
+	sentBefore := user.VerificationSentAt.Add(-s.Config.VerificationResendInterval)
+	err = s.UserDao.ReplaceVerificationCode(ctx, user.ID, user.VerificationCode, user.VerificationExpiresAt, sentBefore)
+	if errors.Is(err, dao.ErrNotFound) {
+		if s.Config.AntiEnumeration {
+			return nil
+		}
+		return st.AuthError{Msg: "Verification code was sent recently, try again later", Status: 429}
+	}
+	if err != nil {
+		return mapDaoError(err)
+	}
+
+	return s.sendVerificationCode(user, code)
+}
+
+// setVerificationCode sets hash of the code on the user along with time it is sent and its expiry
+func (s *AuthService) setVerificationCode(u *st.User, code string) {
+	now := time.Now().UTC()
+	u.VerificationCode = crypto.HashCode(code)
+	u.VerificationSentAt = &now
+	u.VerificationExpiresAt = nil
+	if s.Config.VerificationExpiration > 0 {
+		expiresAt := now.Add(s.Config.VerificationExpiration)
+		u.VerificationExpiresAt = &expiresAt
+	}
+}
+
+// sendVerificationCode emails the code with a link verifying the email in one click, if the link is configured
+func (s *AuthService) sendVerificationCode(u *st.User, code string) error {
+	link := s.verificationLink(u.Username, code)
+	return s.deliver(func() error { return s.Mailer.SendVerificationCode(u.Email, code, link) })
+}
+
+// verificationLink adds username and code to VerificationLinkURL, empty link is returned if it is not set
+func (s *AuthService) verificationLink(username string, code string) string {
+	if s.Config.VerificationLinkURL == "" {
+		return ""
+	}
+	link, err := url.Parse(s.Config.VerificationLinkURL)
+	if err != nil {
+		logger.Logf("ERROR Invalid verification link URL: %s", err.Error())
+		return ""
+	}
+	params := link.Query()
+	params.Set("username", username)
+	params.Set("code", code)
+	link.RawQuery = params.Encode()
+	return link.String()
+}
+
+// matchVerificationCode compares code with stored hash. Codes stored by previous versions are plain digits or salted hashes.
+func matchVerificationCode(code string, stored string) bool {
+	if isDigits(stored) {
+		return subtle.ConstantTimeCompare([]byte(code), []byte(stored)) == 1
+	}
+	return crypto.MatchCode(code, stored)
+}
+
+func isDigits(value string) bool {
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return value != ""
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"ruslanlesko/brightonum/src/crypto"
+	"ruslanlesko/brightonum/src/dao"
+	"ruslanlesko/brightonum/src/email"
+	st "ruslanlesko/brightonum/src/structs"
+)
+
+func createVerificationTestConfig() Config {
+	conf := createTestConfig()
+	conf.EmailVerification = true
+	conf.VerificationExpiration = time.Hour
+	conf.VerificationMaxAttempts = 3
+	conf.VerificationResendInterval = time.Minute
+	conf.VerificationLinkURL = "https://hollywoo.com/verify?lang=en"
+	return conf
+}
+
+func TestAuthService_CreateUser_HashesVerificationCode(t *testing.T) {
+	u := st.User{Username: "sarah", Email: "sarah@email.com", Password: "oakheart"}
+	var sentCode string
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", u.Username).Return(nil, dao.ErrNotFound)
+	userDao.On("GetProfileSchema").Return(&st.ProfileSchema{}, nil)
+	userDao.On("Save", mock.Anything).Return(44, nil)
+	mailer := email.MailerMock{}
+	mailer.On("SendVerificationCode", u.Email, mock.MatchedBy(func(code string) bool {
+		sentCode = code
+		return len(code) == 4
+	}), mock.MatchedBy(func(link string) bool {
+		return link == "https://hollywoo.com/verify?code="+sentCode+"&lang=en&username=sarah"
+	})).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createVerificationTestConfig()}
+
+	err := s.CreateUser(ctx, &u)
+	assert.Nil(t, err)
+	mailer.AssertExpectations(t)
+	assert.NotEqual(t, sentCode, u.VerificationCode)
+	assert.True(t, crypto.MatchCode(sentCode, u.VerificationCode))
+	assert.NotNil(t, u.VerificationSentAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *u.VerificationExpiresAt, time.Minute)
+}
+
+func TestAuthService_VerifyUser(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour)
+	expiredAt := time.Now().Add(-time.Minute)
+	pending := st.User{ID: 44, Username: "sarah", VerificationCode: hashedCode, VerificationExpiresAt: &expiresAt}
+	expired := st.User{ID: 45, Username: "expired", VerificationCode: hashedCode, VerificationExpiresAt: &expiredAt}
+	locked := st.User{ID: 46, Username: "locked", VerificationCode: hashedCode, VerificationAttempts: 3}
+	legacy := st.User{ID: 47, Username: "legacy", VerificationCode: "1234"}
+	verified := st.User{ID: 48, Username: "verified"}
+
+	userDao := dao.MockUserDao{}
+	for _, u := range []st.User{pending, expired, locked, legacy, verified} {
+		u := u
+		userDao.On("GetByUsername", u.Username).Return(&u, nil)
+	}
+	userDao.On("TakeVerificationAttempt", pending.ID, 3).Return(nil)
+	userDao.On("TakeVerificationAttempt", legacy.ID, 3).Return(nil)
+	userDao.On("TakeVerificationAttempt", locked.ID, 3).Return(dao.ErrNotFound)
+	userDao.On("ClearVerificationCode", pending.ID).Return(nil)
+	userDao.On("ClearVerificationCode", legacy.ID).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createVerificationTestConfig()}
+
+	err := s.VerifyUser(ctx, pending.Username, "0000")
+	assert.Equal(t, st.AuthError{Msg: "Verification code does not match", Status: 400}, err)
+	userDao.AssertCalled(t, "TakeVerificationAttempt", pending.ID, 3)
+
+	assert.Nil(t, s.VerifyUser(ctx, pending.Username, code))
+	userDao.AssertCalled(t, "ClearVerificationCode", pending.ID)
+
+	err = s.VerifyUser(ctx, expired.Username, code)
+	assert.Equal(t, st.AuthError{Msg: "Verification code has expired, request a new one", Status: 400}, err)
+
+	err = s.VerifyUser(ctx, locked.Username, code)
+	assert.Equal(t, st.AuthError{Msg: "Too many wrong verification codes, request a new one", Status: 400}, err)
+
+	assert.Nil(t, s.VerifyUser(ctx, legacy.Username, "1234"))
+
+	err = s.VerifyUser(ctx, verified.Username, code)
+	assert.Equal(t, st.AuthError{Msg: "User is already verified", Status: 409}, err)
+}
+
+func TestAuthService_ResendVerificationCode(t *testing.T) {
+	pending := st.User{ID: 44, Username: "sarah", Email: "sarah@email.com", VerificationCode: hashedCode}
+	throttled := st.User{ID: 45, Username: "throttled", Email: "throttled@email.com", VerificationCode: hashedCode}
+	verified := st.User{ID: 46, Username: "verified"}
+	locked := st.User{ID: 47, Username: "locked", Email: "locked@email.com", VerificationCode: hashedCode, VerificationAttempts: 3}
+
+	userDao := dao.MockUserDao{}
+	userDao.On("GetByUsername", pending.Username).Return(&pending, nil)
+	userDao.On("GetByUsername", throttled.Username).Return(&throttled, nil)
+	userDao.On("GetByUsername", verified.Username).Return(&verified, nil)
+	userDao.On("GetByUsername", locked.Username).Return(&locked, nil)
+	userDao.On("ReplaceVerificationCode", pending.ID, mock.Anything, mock.Anything, mock.MatchedBy(func(sentBefore time.Time) bool {
+		return time.Now().Add(-time.Minute).Sub(sentBefore) < time.Second
+	})).Return(nil)
+	userDao.On("ReplaceVerificationCode", throttled.ID, mock.Anything, mock.Anything, mock.Anything).Return(dao.ErrNotFound)
+	userDao.On("ReplaceVerificationCode", locked.ID, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mailer := email.MailerMock{}
+	mailer.On("SendVerificationCode", pending.Email, mock.Anything, mock.Anything).Return(nil)
+	mailer.On("SendVerificationCode", locked.Email, mock.Anything, mock.Anything).Return(nil)
+
+	s := AuthService{&mailer, &userDao, createVerificationTestConfig()}
+
+	assert.Nil(t, s.ResendVerificationCode(ctx, pending.Username))
+	mailer.AssertCalled(t, "SendVerificationCode", pending.Email, mock.Anything, mock.Anything)
+
+	err := s.ResendVerificationCode(ctx, throttled.Username)
+	assert.Equal(t, st.AuthError{Msg: "Verification code was sent recently, try again later", Status: 429}, err)
+	mailer.AssertNotCalled(t, "SendVerificationCode", throttled.Email, mock.Anything, mock.Anything)
+
+	err = s.ResendVerificationCode(ctx, verified.Username)
+	assert.Equal(t, st.AuthError{Msg: "User is already verified", Status: 409}, err)
+
+	// New code gets its own attempts, so wrong guesses by others do not lock the user out
+	assert.Nil(t, s.ResendVerificationCode(ctx, locked.Username))
+	assert.Equal(t, 0, locked.VerificationAttempts)
+	mailer.AssertCalled(t, "SendVerificationCode", locked.Email, mock.Anything, mock.Anything)
+}